@@ -0,0 +1,183 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// accessFlushInterval is how often the access counts buffered by
+// WithAccessCounting are written to the database, and accessFlushMax the
+// number of buffered tokens which triggers an earlier flush.
+const (
+	accessFlushInterval = 10 * time.Second
+	accessFlushMax      = 1000
+)
+
+// WithAccessCounting counts how many times each session is read by Find and
+// FindAndMaybeTouch in the access_count column, as reported by DumpRow. To
+// avoid a write on every read, the counts are buffered in memory and added to
+// the database every 10 seconds, or sooner once many sessions have been read,
+// and by Shutdown. Counts still buffered when the process exits are lost. It
+// has no effect on a read-only store.
+//
+// Tables created before the access_count column was added to Schema need it
+// added before this option is used:
+//
+//	ALTER TABLE sessions ADD COLUMN access_count INTEGER NOT NULL DEFAULT 0;
+func WithAccessCounting() Option {
+	return func(p *SQLitexStore) {
+		p.access = &accessCounter{}
+	}
+}
+
+// accessCounter buffers access counts until they are flushed to the database,
+// see WithAccessCounting.
+type accessCounter struct {
+	mu      sync.Mutex
+	pending map[string]int64
+
+	// flushMu serializes flushes, so that counts put back by a failed
+	// flush are not lost to a concurrent one.
+	flushMu sync.Mutex
+
+	full     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (a *accessCounter) start(p *SQLitexStore) {
+	a.pending = make(map[string]int64)
+	a.full = make(chan struct{}, 1)
+	a.stop = make(chan struct{})
+	a.done = make(chan struct{})
+	go p.runAccessFlush()
+}
+
+// countAccess buffers a read of the session of the normalized token key.
+func (p *SQLitexStore) countAccess(key string) {
+	if p.access == nil {
+		return
+	}
+	a := p.access
+	a.mu.Lock()
+	a.pending[key]++
+	full := len(a.pending) >= accessFlushMax
+	a.mu.Unlock()
+
+	if full {
+		select {
+		case a.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *SQLitexStore) runAccessFlush() {
+	a := p.access
+	defer close(a.done)
+
+	ticker := time.NewTicker(accessFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.full:
+		case <-a.stop:
+			return
+		}
+		if p.corrupt.Load() {
+			continue
+		}
+		// As with write-behind, the pool is taken from directly so that
+		// counts are still flushed after StopCleanup.
+		db := p.pool()
+		conn, err := db.Take(context.Background())
+		if err == nil {
+			err = p.prepareConn(conn)
+			if err == nil {
+				err = p.flushAccess(conn)
+			}
+			db.Put(conn)
+		}
+		p.recordResult(err)
+		if err != nil {
+			p.logger.Printf("zqlsession: %s: access count flush: %v", p.name, err)
+		}
+	}
+}
+
+// stopAccessFlush stops the access count goroutine and flushes the remaining
+// counts. It is called by Shutdown once no operations are in flight.
+func (p *SQLitexStore) stopAccessFlush(ctx context.Context) error {
+	a := p.access
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	db := p.pool()
+	conn, err := db.Take(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Put(conn)
+
+	if err := p.prepareConn(conn); err != nil {
+		return err
+	}
+	return p.flushAccess(conn)
+}
+
+// flushAccess adds the buffered access counts to the database. If it fails
+// the counts stay buffered for the next flush.
+func (p *SQLitexStore) flushAccess(conn *sqlite.Conn) error {
+	a := p.access
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	batch := a.pending
+	if len(batch) == 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	a.pending = make(map[string]int64)
+	a.mu.Unlock()
+
+	err := p.flushAccessBatch(conn, batch)
+	if err != nil {
+		a.mu.Lock()
+		for token, n := range batch {
+			a.pending[token] += n
+		}
+		a.mu.Unlock()
+	}
+	return err
+}
+
+func (p *SQLitexStore) flushAccessBatch(conn *sqlite.Conn, batch map[string]int64) (err error) {
+	defer p.checkCorrupt(&err)
+	defer sqlitex.Save(conn)(&err)
+
+	for token, n := range batch {
+		err = sqlitex.Execute(conn, p.q.addAccessCount,
+			&sqlitex.ExecOptions{
+				Args: []any{n, token},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
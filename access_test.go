@@ -0,0 +1,163 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// accessCount returns the access count stored for token, without flushing
+// the buffered counts as DumpRow does.
+func accessCount(t testing.TB, db *sqlitex.Pool, token string) int64 {
+	t.Helper()
+
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take connection: %v", err)
+	}
+	defer db.Put(conn)
+
+	var n int64
+	err = sqlitex.Execute(conn, "SELECT access_count FROM sessions WHERE token = $1", &sqlitex.ExecOptions{
+		Args: []any{token},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("select access count: %v", err)
+	}
+	return n
+}
+
+func TestAccessCounting(t *testing.T) {
+	const readers, reads = 8, 50
+	db := newPool(t)
+	store, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate(), zqlsession.WithAccessCounting())
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < reads; j++ {
+				if _, _, err := store.Find("token"); err != nil {
+					t.Errorf("find: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	// A session which is not found is not counted.
+	if _, _, err := store.Find("missing"); err != nil {
+		t.Fatalf("find missing: %v", err)
+	}
+
+	// The counts are buffered rather than written on every read.
+	if n := accessCount(t, db, "token"); n != 0 {
+		t.Errorf("access count before a flush: got %d, want 0", n)
+	}
+	if err := store.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shut down: %v", err)
+	}
+	if n := accessCount(t, db, "token"); n != readers*reads {
+		t.Errorf("access count after shutdown: got %d, want %d", n, readers*reads)
+	}
+	if n := countRows(t, db, "sessions"); n != 1 {
+		t.Errorf("got %d rows, want the missing session not created", n)
+	}
+}
+
+// TestAccessCountingFull checks that the counts are flushed early once many
+// sessions have been read.
+func TestAccessCountingFull(t *testing.T) {
+	const n = 1000
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithAccessCounting())
+
+	sessions := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		sessions[fmt.Sprint("token", i)] = []byte("data")
+	}
+	if err := store.CommitAll(sessions, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit all: %v", err)
+	}
+	for token := range sessions {
+		if _, _, err := store.Find(token); err != nil {
+			t.Fatalf("find: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c := accessCount(t, db, "token0")
+		if c == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("access count: got %d, want the full buffer flushed", c)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccessCountingDumpRow(t *testing.T) {
+	store := newStore(t, newPool(t), zqlsession.WithAccessCounting())
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := store.Find("token"); err != nil {
+			t.Fatalf("find: %v", err)
+		}
+	}
+	// DumpRow flushes the buffered counts first.
+	dump, _, err := store.DumpRow("token")
+	if err != nil || dump.AccessCount != 3 {
+		t.Errorf("dump: got access count %d, %v, want 3", dump.AccessCount, err)
+	}
+}
+
+func TestAccessCountingRecommit(t *testing.T) {
+	store := newStore(t, newPool(t), zqlsession.WithAccessCounting())
+	expiry := time.Now().Add(time.Hour)
+	if err := store.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := store.Find("token"); err != nil {
+			t.Fatalf("find: %v", err)
+		}
+	}
+	if dump, _, err := store.DumpRow("token"); err != nil || dump.AccessCount != 5 {
+		t.Fatalf("dump: got access count %d, %v, want 5", dump.AccessCount, err)
+	}
+
+	// Committing the session again, as scs does whenever it changes, keeps
+	// its count.
+	if err := store.Commit("token", []byte("changed"), expiry.Add(time.Hour)); err != nil {
+		t.Fatalf("commit again: %v", err)
+	}
+	if dump, _, err := store.DumpRow("token"); err != nil || dump.AccessCount != 5 {
+		t.Errorf("dump after commit: got access count %d, %v, want 5", dump.AccessCount, err)
+	}
+	if b, _, _ := store.Find("token"); string(b) != "changed" {
+		t.Errorf("find: got %q, want %q", b, "changed")
+	}
+}
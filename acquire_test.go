@@ -0,0 +1,47 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestAcquireTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	store := newStore(t, db, zqlsession.WithAcquireTimeout(50*time.Millisecond))
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	start := time.Now()
+	_, _, err = store.Find("token")
+	if !errors.Is(err, zqlsession.ErrPoolTimeout) {
+		t.Errorf("find with the pool held: got %v, want ErrPoolTimeout", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > 5*time.Second {
+		t.Errorf("find waited %v for the pool, want about 50ms", waited)
+	}
+	db.Put(conn)
+
+	// Once the connection is returned the timeout no longer applies to the
+	// query itself.
+	if _, found, err := store.Find("token"); err != nil || !found {
+		t.Errorf("find: got %v, %v, want the session", found, err)
+	}
+}
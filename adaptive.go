@@ -0,0 +1,94 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import "sync/atomic"
+
+// adaptiveMaxSkips is the most consecutive cleanups which WithAdaptiveCleanup
+// skips, so that expired sessions are still removed during a long peak.
+const adaptiveMaxSkips = 3
+
+// adaptiveBatch is the number of expired sessions deleted by a cleanup which
+// WithAdaptiveCleanup shortens.
+const adaptiveBatch = 1000
+
+// cleanupPlan is the work an adaptive cleanup run does.
+type cleanupPlan int
+
+const (
+	cleanupFull cleanupPlan = iota
+	cleanupShort
+	cleanupSkip
+)
+
+// WithAdaptiveCleanup makes the background cleanup, or the shared Cleaner,
+// give way to the store's own load. Before each cleanup the number of
+// operations the store started since the previous one is compared with its
+// moving average: at more than twice the average cleanup is skipped, at most 3
+// times in a row, and above the average it deletes a single batch of 1000
+// expired sessions. At or below the average, when the store is quiet, it
+// deletes every expired session as usual, catching up on the cleanups it
+// skipped or shortened.
+//
+// The first cleanup always runs in full, to measure the load. Cleanup with
+// WithExpiredArchive is never shortened, only skipped. Calls to DeleteExpired
+// are not affected.
+func WithAdaptiveCleanup() Option {
+	return func(p *SQLitexStore) {
+		p.adaptive = &adaptiveCleanup{}
+	}
+}
+
+// adaptiveCleanup is the state of WithAdaptiveCleanup.
+type adaptiveCleanup struct {
+	// ops counts the operations started since the last cleanup.
+	ops atomic.Int64
+
+	// The rest is only used by whichever goroutine runs the cleanups.
+	avg     float64
+	started bool
+	skipped int
+}
+
+// countLoad counts an operation other than cleanup towards the load seen by
+// WithAdaptiveCleanup.
+func (p *SQLitexStore) countLoad(op Op) {
+	if p.adaptive != nil && op != OpDeleteExpired {
+		p.adaptive.ops.Add(1)
+	}
+}
+
+// plan decides how much work a cleanup does from the load since the last one,
+// and folds that load into the average.
+func (a *adaptiveCleanup) plan() cleanupPlan {
+	load := float64(a.ops.Swap(0))
+	avg := a.avg
+	if !a.started {
+		a.started = true
+		a.avg = load
+		return cleanupFull
+	}
+	a.avg += (load - avg) / 4
+	switch {
+	case load > 2*avg && a.skipped < adaptiveMaxSkips:
+		a.skipped++
+		return cleanupSkip
+	case load > avg:
+		a.skipped = 0
+		return cleanupShort
+	}
+	a.skipped = 0
+	return cleanupFull
+}
+
+// deleteExpiredShort deletes a single batch of expired sessions, for a cleanup
+// shortened by WithAdaptiveCleanup.
+func (p *SQLitexStore) deleteExpiredShort() (n int, err error) {
+	defer p.checkCorrupt(&err)
+
+	n, err = p.deleteExpiredBatch(p.cleanupCtx, adaptiveBatch)
+	if n > 0 {
+		p.lifecycle(OpSessionsExpired, n)
+	}
+	return n, err
+}
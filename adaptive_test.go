@@ -0,0 +1,117 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// TestAdaptiveCleanup runs cleanups by hand after simulated bursts of load,
+// and checks that each does the work its load calls for.
+func TestAdaptiveCleanup(t *testing.T) {
+	var deleted []int
+	// The interval is long enough that only the cleanups run here happen.
+	p, err := NewMemory(time.Hour, WithAdaptiveCleanup(),
+		WithAfterCleanup(func(n int, _ time.Duration, err error) {
+			if err != nil {
+				t.Errorf("cleanup: %v", err)
+			}
+			deleted = append(deleted, n)
+		}))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	defer p.Shutdown(context.Background())
+
+	// The test's own queries are taken as cleanup, so that they do not
+	// count towards the load.
+	exec := func(query string, fn func(stmt *sqlite.Stmt) error) {
+		t.Helper()
+		conn, put, err := p.take(context.Background(), OpDeleteExpired)
+		if err != nil {
+			t.Fatalf("take: %v", err)
+		}
+		defer put(&err)
+		if err := sqlitex.ExecuteTransient(conn, query, &sqlitex.ExecOptions{ResultFunc: fn}); err != nil {
+			t.Fatalf("execute %q: %v", query, err)
+		}
+	}
+	expire := func(n int) {
+		t.Helper()
+		exec(fmt.Sprintf("WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < %d) "+
+			"INSERT INTO sessions (token, data, expiry) "+
+			"SELECT 'expired' || i, X'00', julianday('now', '-1 hour') FROM seq", n), nil)
+	}
+	rows := func() int {
+		t.Helper()
+		var n int
+		exec("SELECT COUNT(*) FROM sessions", func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt(0)
+			return nil
+		})
+		return n
+	}
+	load := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := p.Exists("token"); err != nil {
+				t.Fatalf("exists: %v", err)
+			}
+		}
+	}
+
+	// The first cleanup runs in full, measuring a load of 10.
+	load(10)
+	p.runCleanup()
+	expire(2*adaptiveBatch + 500)
+
+	// At more than twice the average load, cleanup is skipped.
+	load(100)
+	p.runCleanup()
+	if got := rows(); got != 2*adaptiveBatch+500 {
+		t.Errorf("after a peak: got %d rows, want cleanup skipped", got)
+	}
+	// Above the average it deletes a single batch.
+	load(40)
+	p.runCleanup()
+	if got := rows(); got != adaptiveBatch+500 {
+		t.Errorf("under load: got %d rows, want one batch deleted", got)
+	}
+	// When quiet it catches up on the rest.
+	p.runCleanup()
+	if got := rows(); got != 0 {
+		t.Errorf("when quiet: got %d rows, want all deleted", got)
+	}
+	if want := []int{0, adaptiveBatch, adaptiveBatch + 500}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("cleanups deleted %v, want %v", deleted, want)
+	}
+}
+
+// TestAdaptiveCleanupMaxSkips checks that a sustained rise in load skips at
+// most adaptiveMaxSkips cleanups in a row.
+func TestAdaptiveCleanupMaxSkips(t *testing.T) {
+	var a adaptiveCleanup
+	load := int64(10)
+	a.ops.Store(load)
+	if plan := a.plan(); plan != cleanupFull {
+		t.Fatalf("first cleanup: got plan %d, want full", plan)
+	}
+	for i := 0; i <= adaptiveMaxSkips; i++ {
+		load *= 10
+		a.ops.Store(load)
+		want := cleanupSkip
+		if i == adaptiveMaxSkips {
+			want = cleanupShort
+		}
+		if plan := a.plan(); plan != want {
+			t.Errorf("cleanup %d at load %d: got plan %d, want %d", i, load, plan, want)
+		}
+	}
+}
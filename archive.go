@@ -0,0 +1,44 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// archiveExpired moves expired sessions to the archive table and purges
+// archived sessions older than the retention, all in one transaction. It
+// returns the number of sessions moved.
+func (p *SQLitexStore) archiveExpired(conn *sqlite.Conn) (n int, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	now := time.Now()
+	cutoff := p.encodeExpiry(now)
+	err = sqlitex.Execute(conn, p.q.archiveExpired,
+		&sqlitex.ExecOptions{
+			Args: []any{cutoff},
+		})
+	if err != nil {
+		return 0, err
+	}
+	err = sqlitex.Execute(conn, p.q.deleteExpiredBefore,
+		&sqlitex.ExecOptions{
+			Args: []any{cutoff},
+		})
+	if err != nil {
+		return 0, err
+	}
+	n = conn.Changes()
+
+	err = sqlitex.Execute(conn, p.q.purgeArchive,
+		&sqlitex.ExecOptions{
+			Args: []any{p.encodeExpiry(now.Add(-p.archiveRetention))},
+		})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
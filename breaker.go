@@ -0,0 +1,133 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// ErrCircuitOpen is returned instead of querying the database while the
+// circuit breaker enabled by WithCircuitBreaker is open.
+var ErrCircuitOpen = errors.New("zqlsession: circuit breaker is open")
+
+// WithCircuitBreaker makes the store fail fast with ErrCircuitOpen once
+// failures consecutive operations have failed against the database, rather
+// than letting every request wait on a database which is persistently
+// failing. After cooldown the breaker lets a single operation through to test
+// the database, closing again if it succeeds and staying open for another
+// cooldown if it fails.
+//
+// Only errors which suggest the database itself is failing are counted, such
+// as a full disk, an I/O error or corruption. Missing sessions, conflicts and
+// cancelled contexts are not failures.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(p *SQLitexStore) {
+		if failures <= 0 {
+			p.breaker = nil
+			return
+		}
+		p.breaker = &breaker{
+			threshold: failures,
+			cooldown:  cooldown,
+		}
+	}
+}
+
+// breaker is the state of the circuit breaker, see WithCircuitBreaker.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// probing is set while a single operation tests the database after the
+	// cooldown, since probeAt.
+	probing bool
+	probeAt time.Time
+}
+
+// allow returns ErrCircuitOpen if an operation must fail fast.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(b.openedAt.Add(b.cooldown)) {
+		return ErrCircuitOpen
+	}
+	// A probe which never reports back, such as one which does not reach
+	// the database, must not keep the breaker open forever.
+	if b.probing && now.Before(b.probeAt.Add(b.cooldown)) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	b.probeAt = now
+	return nil
+}
+
+// record counts the result of an operation, reporting whether it first opened
+// the breaker.
+func (b *breaker) record(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		// The operation never reached the database.
+	case isDatabaseFailure(err):
+		b.failures++
+		if b.failures < b.threshold {
+			return false
+		}
+		b.openedAt = time.Now()
+		b.probing = false
+		return b.failures == b.threshold
+	case err != nil && (errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		sqlite.ErrCode(err).ToPrimary() == sqlite.ResultInterrupt):
+		// The operation was abandoned, which says nothing about the
+		// database, so another probe may be tried.
+		b.probing = false
+	case b.failures >= b.threshold && !b.probing:
+		// Only the probe may close an open breaker. Other operations
+		// finishing now were either let through before it opened or
+		// returned without reaching the database.
+	default:
+		b.failures = 0
+		b.probing = false
+	}
+	return false
+}
+
+// isDatabaseFailure reports whether err suggests the database is failing,
+// rather than the operation or its caller.
+func isDatabaseFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch sqlite.ErrCode(err).ToPrimary() {
+	case sqlite.ResultIOErr, sqlite.ResultCorrupt, sqlite.ResultFull,
+		sqlite.ResultCantOpen, sqlite.ResultNotADB, sqlite.ResultNoLFS:
+		return true
+	}
+	return false
+}
+
+// recordResult counts err towards the circuit breaker, if one is enabled.
+func (p *SQLitexStore) recordResult(err error) {
+	if p.breaker == nil {
+		return
+	}
+	if p.breaker.record(err) {
+		p.logger.Printf("zqlsession: %s: circuit breaker opened: %v", p.name, err)
+	}
+}
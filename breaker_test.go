@@ -0,0 +1,115 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// newFullStore returns a store on a single connection, and a function which
+// limits the size of its database so that growing it fails with SQLITE_FULL,
+// or lifts the limit again.
+func newFullStore(t *testing.T, opts ...zqlsession.Option) (*zqlsession.SQLitexStore, func(full bool)) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	opts = append([]zqlsession.Option{zqlsession.WithoutCleanup()}, opts...)
+	store := newStore(t, db, opts...)
+	setFull := func(full bool) {
+		t.Helper()
+		if full {
+			execute(t, db, "PRAGMA max_page_count = 1")
+		} else {
+			execute(t, db, "PRAGMA max_page_count = 1073741823")
+		}
+	}
+	return store, setFull
+}
+
+func isFull(err error) bool {
+	return sqlite.ErrCode(err).ToPrimary() == sqlite.ResultFull
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 200 * time.Millisecond
+	store, setFull := newFullStore(t, zqlsession.WithCircuitBreaker(2, cooldown))
+	big := bytes.Repeat([]byte("x"), 1<<16)
+	expiry := time.Now().Add(time.Hour)
+
+	setFull(true)
+	for i := 0; i < 2; i++ {
+		if err := store.Commit("token", big, expiry); !isFull(err) {
+			t.Fatalf("commit %d: got %v, want SQLITE_FULL", i, err)
+		}
+	}
+	if _, err := store.Count(); !errors.Is(err, zqlsession.ErrCircuitOpen) {
+		t.Fatalf("count while open: got %v, want ErrCircuitOpen", err)
+	}
+	// An operation which does not reach the database does not close the
+	// breaker.
+	if err := store.Delete(""); err != nil {
+		t.Fatalf("delete empty token: %v", err)
+	}
+	if _, err := store.Count(); !errors.Is(err, zqlsession.ErrCircuitOpen) {
+		t.Fatalf("count after delete: got %v, want ErrCircuitOpen", err)
+	}
+
+	// Once the cooldown has passed, a successful Count probes the database
+	// and closes the breaker.
+	setFull(false)
+	time.Sleep(cooldown)
+	if _, err := store.Count(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if err := store.Commit("token", big, expiry); err != nil {
+		t.Fatalf("commit after probe: %v", err)
+	}
+}
+
+func TestCircuitBreakerCounts(t *testing.T) {
+	store, setFull := newFullStore(t, zqlsession.WithCircuitBreaker(2, time.Hour))
+	big := bytes.Repeat([]byte("x"), 1<<16)
+	expiry := time.Now().Add(time.Hour)
+
+	// A failure inside a transaction is counted once, with the
+	// transaction.
+	setFull(true)
+	err := store.WithTx(context.Background(), func(tx *zqlsession.Tx) error {
+		return tx.Commit("token", big, expiry)
+	})
+	if !isFull(err) {
+		t.Fatalf("tx: got %v, want SQLITE_FULL", err)
+	}
+	if _, err := store.Count(); err != nil {
+		t.Fatalf("count after one failure: %v", err)
+	}
+
+	// The count is reset by the success, so two more failures are needed
+	// to open the breaker.
+	err = store.Import(context.Background(), []zqlsession.SessionRecord{
+		{Token: "token", Data: big, Expiry: expiry},
+	}, zqlsession.Decoded)
+	if !isFull(err) {
+		t.Fatalf("import: got %v, want SQLITE_FULL", err)
+	}
+	if err := store.CommitAll(map[string][]byte{"token": big}, expiry); !isFull(err) {
+		t.Fatalf("commit all: got %v, want SQLITE_FULL", err)
+	}
+	if _, err := store.All(); !errors.Is(err, zqlsession.ErrCircuitOpen) {
+		t.Fatalf("all: got %v, want ErrCircuitOpen", err)
+	}
+}
@@ -0,0 +1,47 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import "time"
+
+// budgetBatch is the number of expired sessions deleted at a time by a cleanup
+// with a time budget, unless WithPoliteCleanup sets another.
+const budgetBatch = 1000
+
+// WithCleanupTimeBudget limits each run of the background cleanup to about d.
+// Expired sessions are deleted in batches, and once d has passed no further
+// batch is started and the rest are left for the next run, so that a large
+// backlog of expired sessions is worked through over several runs rather than
+// holding a connection for as long as it takes. The batches are of 1000
+// sessions, or the size given to WithPoliteCleanup. A batch is never
+// interrupted, and every run deletes at least one, so a run can take longer
+// than d by as long as a batch takes.
+//
+// The budget does not apply to calls to DeleteExpired, nor to cleanup with
+// WithExpiredArchive, which moves every expired session in one transaction. A
+// d of 0, the default, sets no limit.
+func WithCleanupTimeBudget(d time.Duration) Option {
+	return func(p *SQLitexStore) {
+		p.cleanupBudget = d
+	}
+}
+
+// deleteExpiredWithin deletes expired sessions for the cleanup goroutine until
+// none are left or budget has passed, returning the number deleted.
+func (p *SQLitexStore) deleteExpiredWithin(budget time.Duration) (n int, err error) {
+	defer p.checkCorrupt(&err)
+
+	// The deadline is checked between batches rather than set on the
+	// context, since a batch interrupted by it would be rolled back, and a
+	// budget shorter than one batch would then never delete anything.
+	deadline := time.Now().Add(budget)
+	batch := budgetBatch
+	if p.politeBatch > 0 {
+		batch = p.politeBatch
+	}
+	n, err = p.deleteExpiredBatches(p.cleanupCtx, batch, p.politeBatch > 0, deadline)
+	if n > 0 {
+		p.lifecycle(OpSessionsExpired, n)
+	}
+	return n, err
+}
@@ -0,0 +1,118 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+// TestCleanupTimeBudget gives the background cleanup a backlog too large for
+// one run, and checks that each run starts no batch past its budget and that
+// the backlog is worked through over several.
+func TestCleanupTimeBudget(t *testing.T) {
+	const n, budget = 20000, 20 * time.Millisecond
+	db := newPool(t)
+	newStore(t, db).Shutdown(context.Background())
+	execute(t, db, "WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < $1) "+
+		"INSERT INTO sessions (token, data, expiry) "+
+		"SELECT 'expired' || i, zeroblob(256), julianday('now', '-1 hour') FROM seq", n)
+
+	type cycle struct {
+		deleted int
+		d       time.Duration
+		err     error
+	}
+	var mu sync.Mutex
+	var cycles []cycle
+	done := make(chan struct{})
+	var total int
+	store := zqlsession.NewWithCleanupInterval(db, 10*time.Millisecond,
+		zqlsession.WithCleanupTimeBudget(budget),
+		zqlsession.WithAfterCleanup(func(deleted int, d time.Duration, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			cycles = append(cycles, cycle{deleted, d, err})
+			total += deleted
+			if total == n && deleted > 0 {
+				close(done)
+			}
+		}))
+	defer store.Shutdown(context.Background())
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("backlog was not cleaned")
+	}
+	store.StopCleanup()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(cycles) < 2 {
+		t.Errorf("backlog cleaned in %d cycle, want several", len(cycles))
+	}
+	for i, c := range cycles {
+		if c.err != nil {
+			t.Errorf("cycle %d: %v", i, c.err)
+		}
+		// The last batch of a cycle may run past the budget, however long
+		// a batch takes, but every batch before it must have started
+		// within the budget. Batches take about as long as each other.
+		batches := time.Duration((c.deleted + 999) / 1000)
+		if batches > 1 && c.d*(batches-1)/batches > 2*budget {
+			t.Errorf("cycle %d deleted %d in %v, over the budget of %v", i, c.deleted, c.d, budget)
+		}
+	}
+}
+
+// TestCleanupTimeBudgetShort gives the background cleanup a budget shorter than
+// any batch can take, and checks that each run still deletes a batch.
+func TestCleanupTimeBudgetShort(t *testing.T) {
+	const n = 3000
+	db := newPool(t)
+	newStore(t, db).Shutdown(context.Background())
+	execute(t, db, "WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < $1) "+
+		"INSERT INTO sessions (token, data, expiry) "+
+		"SELECT 'expired' || i, zeroblob(256), julianday('now', '-1 hour') FROM seq", n)
+
+	var mu sync.Mutex
+	var deleted []int
+	done := make(chan struct{})
+	store := zqlsession.NewWithCleanupInterval(db, 10*time.Millisecond,
+		zqlsession.WithCleanupTimeBudget(time.Nanosecond),
+		zqlsession.WithAfterCleanup(func(n int, d time.Duration, err error) {
+			if err != nil {
+				t.Errorf("cleanup: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			deleted = append(deleted, n)
+			if len(deleted) == 3 {
+				close(done)
+			}
+		}))
+	defer store.Shutdown(context.Background())
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("cleanup did not run")
+	}
+	store.StopCleanup()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, got := range deleted[:3] {
+		if got != 1000 {
+			t.Errorf("cycle %d deleted %d, want a batch of 1000", i, got)
+		}
+	}
+	if got := countRows(t, db, "sessions"); got != 0 {
+		t.Errorf("got %d rows left, want the backlog deleted", got)
+	}
+}
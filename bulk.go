@@ -0,0 +1,68 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// CommitAll commits every session in sessions with the given expiry in a
+// single transaction, so that a map returned by All can be restored, or test
+// fixtures seeded, in one step. Existing sessions with the same tokens are
+// overwritten, and other sessions are left alone. If any session fails to
+// commit nothing is committed.
+func (p *SQLitexStore) CommitAll(sessions map[string][]byte, expiry time.Time) error {
+	return p.CommitAllWithExpiry(sessions, func(string) time.Time {
+		return expiry
+	})
+}
+
+// CommitAllWithExpiry is like CommitAll, but commits each session with the
+// expiry returned by expiry for its token, such as one derived from the TTLs
+// returned by AllWithTTL. The WithPastExpiry policy applies to each session.
+func (p *SQLitexStore) CommitAllWithExpiry(sessions map[string][]byte, expiry func(token string) time.Time) (err error) {
+	defer p.logSlow(OpCommitAll, 0, time.Now())
+	defer p.wrapError(OpCommitAll, &err)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(context.Background(), OpCommitAll)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	// As with Swap, buffered writes are flushed first so that they cannot
+	// later overwrite the committed sessions.
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+	return p.commitAll(conn, sessions, expiry)
+}
+
+func (p *SQLitexStore) commitAll(conn *sqlite.Conn, sessions map[string][]byte, expiry func(token string) time.Time) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	for token, b := range sessions {
+		if token == "" {
+			return ErrEmptyToken
+		}
+		e := expiry(token)
+		skip, err := p.pastExpiry(e)
+		if err != nil {
+			return err
+		}
+		e = p.jitter(e)
+		if err := p.commitOrDelete(conn, token, b, e, skip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
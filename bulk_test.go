@@ -0,0 +1,84 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestCommitAllRoundTrip(t *testing.T) {
+	src := zqlsessiontest.NewMemoryStore(t)
+	dst := zqlsessiontest.NewMemoryStore(t)
+
+	now := time.Now()
+	for i, token := range []string{"a", "b", "c", "empty"} {
+		data := []byte("data " + token)
+		if token == "empty" {
+			data = []byte{}
+		}
+		if err := src.Commit(token, data, now.Add(time.Duration(i+1)*time.Hour)); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+
+	all, err := src.All()
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	if err := dst.CommitAll(all, now.Add(time.Hour)); err != nil {
+		t.Fatalf("commit all: %v", err)
+	}
+	got, err := dst.All()
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("restored sessions: got %q, want %q", got, all)
+	}
+
+	// With AllWithTTL the expiry of each session is restored too.
+	ttls, err := src.AllWithTTL()
+	if err != nil {
+		t.Fatalf("all with ttl: %v", err)
+	}
+	restored := zqlsessiontest.NewMemoryStore(t)
+	err = restored.CommitAllWithExpiry(all, func(token string) time.Time {
+		return time.Now().Add(ttls[token])
+	})
+	if err != nil {
+		t.Fatalf("commit all with expiry: %v", err)
+	}
+	for token, ttl := range ttls {
+		dump, _, err := restored.DumpRow(token)
+		if err != nil {
+			t.Fatalf("dump: %v", err)
+		}
+		if d := time.Until(dump.Expiry) - ttl; d < -time.Second || d > time.Second {
+			t.Errorf("%q: expiry %v, want a TTL of %v", token, dump.Expiry, ttl)
+		}
+	}
+}
+
+func TestCommitAllAtomic(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	sessions := map[string][]byte{"a": []byte("a"), "past": []byte("past"), "b": []byte("b")}
+	err := store.CommitAllWithExpiry(sessions, func(token string) time.Time {
+		if token == "past" {
+			return time.Now().Add(-time.Hour)
+		}
+		return time.Now().Add(time.Hour)
+	})
+	if !errors.Is(err, zqlsession.ErrExpiryInPast) {
+		t.Fatalf("commit all: got %v, want ErrExpiryInPast", err)
+	}
+	if n, err := store.Count(); err != nil || n != 0 {
+		t.Errorf("count: got %d, %v, want nothing committed", n, err)
+	}
+}
@@ -0,0 +1,88 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// checksumMagic precedes the CRC-32C checksum which ends the stored form of
+// session data committed with WithDataChecksum.
+const checksumMagic = "\x00zqc"
+
+// checksumLen is the length of the magic and checksum added to stored data.
+const checksumLen = len(checksumMagic) + crc32.Size
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch is returned when reading session data whose stored form
+// does not match the checksum stored with it, or has none, see
+// WithDataChecksum.
+var ErrChecksumMismatch = errors.New("zqlsession: session data does not match its checksum")
+
+// WithDataChecksum stores a CRC-32C checksum with the data of each session
+// committed, and verifies it whenever the data is read, so that data damaged
+// after SQLite wrote it, or by a faulty codec, is reported as
+// ErrChecksumMismatch rather than returned. The checksum covers the data as
+// stored, after the WithCodec codec and encryption, and adds 8 bytes to each
+// session.
+//
+// Data without a checksum is reported as ErrChecksumMismatch too, since the
+// checksum is found at the end of the data and a truncated or damaged end
+// cannot be told apart from none. Sessions stored before the option was given
+// have no checksum, so a table which holds them also needs
+// WithChecksumFallback until they have expired or been committed again. Data
+// with a checksum cannot be read by a store without the option, so it must be
+// kept for as long as such sessions are stored. Sessions exported Verbatim
+// keep their checksum.
+func WithDataChecksum() Option {
+	return func(p *SQLitexStore) {
+		p.dataChecksum = true
+	}
+}
+
+// WithChecksumFallback lets a store using WithDataChecksum read data which has
+// no checksum, such as that of sessions stored before WithDataChecksum was
+// given, returning it without verification. Data whose checksum has been
+// damaged along with the bytes marking it is then returned unverified too, so
+// the option should only be used while such sessions remain.
+func WithChecksumFallback() Option {
+	return func(p *SQLitexStore) {
+		p.checksumFallback = true
+	}
+}
+
+// addChecksum returns stored followed by its checksum, if WithDataChecksum is
+// used.
+func (p *SQLitexStore) addChecksum(stored []byte) []byte {
+	if !p.dataChecksum {
+		return stored
+	}
+	out := make([]byte, len(stored), len(stored)+checksumLen)
+	copy(out, stored)
+	out = append(out, checksumMagic...)
+	return binary.BigEndian.AppendUint32(out, crc32.Checksum(stored, castagnoli))
+}
+
+// verifyChecksum returns stored without its checksum, or ErrChecksumMismatch
+// if the checksum does not match or is missing. With WithChecksumFallback data
+// without a checksum is returned as is.
+func (p *SQLitexStore) verifyChecksum(stored []byte) ([]byte, error) {
+	if !p.dataChecksum {
+		return stored, nil
+	}
+	n := len(stored) - checksumLen
+	if n < 0 || string(stored[n:n+len(checksumMagic)]) != checksumMagic {
+		if p.checksumFallback {
+			return stored, nil
+		}
+		return nil, ErrChecksumMismatch
+	}
+	sum := binary.BigEndian.Uint32(stored[n+len(checksumMagic):])
+	if crc32.Checksum(stored[:n], castagnoli) != sum {
+		return nil, ErrChecksumMismatch
+	}
+	return stored[:n], nil
+}
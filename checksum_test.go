@@ -0,0 +1,126 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+// flipByte flips the bits of the first byte of the stored data of token.
+func flipByte(t *testing.T, sessions []zqlsession.SessionRecord, token string) {
+	t.Helper()
+
+	for _, s := range sessions {
+		if s.Token == token {
+			s.Data[0] ^= 0xff
+			return
+		}
+	}
+	t.Fatalf("no session %q", token)
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithDataChecksum())
+
+	if err := store.Commit("token", []byte("hello"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got, _, err := store.Find("token"); err != nil || string(got) != "hello" {
+		t.Fatalf("find: got %q, %v, want %q", got, err, "hello")
+	}
+	// Replace the first byte of the stored data.
+	execute(t, db, "UPDATE sessions SET data = X'00' || substr(data, 2) WHERE token = 'token'")
+
+	_, _, err := store.Find("token")
+	if !errors.Is(err, zqlsession.ErrChecksumMismatch) {
+		t.Fatalf("find corrupted data: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestChecksumWithoutOption(t *testing.T) {
+	db := newPool(t)
+	plain := newStore(t, db)
+	checked := newStore(t, db, zqlsession.WithDataChecksum())
+	fallback := newStore(t, db, zqlsession.WithDataChecksum(), zqlsession.WithChecksumFallback())
+
+	if err := plain.Commit("old", []byte("legacy"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	_, _, err := checked.Find("old")
+	if !errors.Is(err, zqlsession.ErrChecksumMismatch) {
+		t.Fatalf("find without checksum: got %v, want ErrChecksumMismatch", err)
+	}
+	// With the fallback sessions stored before the option was given are
+	// read unverified.
+	if got, _, err := fallback.Find("old"); err != nil || string(got) != "legacy" {
+		t.Fatalf("find with fallback: got %q, %v, want %q", got, err, "legacy")
+	}
+}
+
+func TestChecksumDamagedTrailer(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithDataChecksum())
+
+	if err := store.Commit("token", []byte("hello"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// Replace the first byte of the bytes marking the checksum, and the last
+	// byte of the checksum itself.
+	execute(t, db, "UPDATE sessions SET data = substr(data, 1, length(data) - 8) || X'01' || substr(data, length(data) - 6, 6) || X'00' WHERE token = 'token'")
+
+	_, _, err := store.Find("token")
+	if !errors.Is(err, zqlsession.ErrChecksumMismatch) {
+		t.Fatalf("find damaged checksum: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestChecksumImportVerbatim(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"NoUserID", "UserID"} {
+		t.Run(name, func(t *testing.T) {
+			opts := []zqlsession.Option{zqlsession.WithDataChecksum()}
+			if name == "UserID" {
+				opts = append(opts, zqlsession.WithUserID(func(b []byte) string {
+					user, _, _ := strings.Cut(string(b), ":")
+					return user
+				}))
+			}
+			src := newStore(t, newPool(t), opts...)
+			dst := newStore(t, newPool(t), opts...)
+
+			expiry := time.Now().Add(time.Hour)
+			if err := src.Commit("good", []byte("alice:cart"), expiry); err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			if err := src.Commit("bad", []byte("bob:cart"), expiry); err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			sessions, err := src.Export(ctx, zqlsession.Verbatim)
+			if err != nil {
+				t.Fatalf("export: %v", err)
+			}
+			if err := dst.Import(ctx, sessions, zqlsession.Verbatim); err != nil {
+				t.Fatalf("import: %v", err)
+			}
+			if name == "UserID" {
+				dump, _, err := dst.DumpRow("good")
+				if err != nil || dump.UserID != "alice" {
+					t.Errorf("user_id: got %q, %v, want %q", dump.UserID, err, "alice")
+				}
+			}
+
+			flipByte(t, sessions, "bad")
+			err = dst.Import(ctx, sessions, zqlsession.Verbatim)
+			if !errors.Is(err, zqlsession.ErrChecksumMismatch) {
+				t.Fatalf("import corrupted data: got %v, want ErrChecksumMismatch", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Cleaner removes expired sessions from several stores with a single
+// goroutine, in place of each store running its own, such as for a store per
+// tenant in one database. On each tick it cleans the registered stores one
+// after another, so their deletes do not all contend for the database at once.
+type Cleaner struct {
+	interval time.Duration
+	// next is the UnixNano time of the next tick, or 0 once stopped.
+	next atomic.Int64
+
+	mu     sync.Mutex
+	stores []*SQLitexStore
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewCleaner returns a Cleaner which cleans its registered stores every
+// interval, and starts its goroutine. Call Stop when it is no longer needed.
+func NewCleaner(interval time.Duration) *Cleaner {
+	c := &Cleaner{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	c.next.Store(time.Now().Add(interval).UnixNano())
+	go c.run()
+	return c
+}
+
+// NewWithCleaner returns a new SQLitexStore instance which is cleaned by the
+// shared Cleaner c instead of a cleanup goroutine of its own. The store is
+// unregistered from c by StopCleanup or Shutdown.
+func NewWithCleaner(db *sqlitex.Pool, c *Cleaner, opts ...Option) *SQLitexStore {
+	p := NewWithCleanupInterval(db, 0, opts...)
+	if p.readOnly || p.withoutCleanup || p.cleanupSchedule != nil {
+		return p
+	}
+	p.cleanupInterval = c.interval
+	p.cleaner = c
+	p.cleanupCtx, p.cancelCleanup = context.WithCancel(context.Background())
+	c.Register(p)
+	return p
+}
+
+// Register adds p to the stores cleaned by c. Registering a store twice has
+// no effect. It is safe to call while c is running.
+func (c *Cleaner) Register(p *SQLitexStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range c.stores {
+		if s == p {
+			return
+		}
+	}
+	c.stores = append(c.stores, p)
+}
+
+// Unregister removes p from the stores cleaned by c. A cleanup of p which is
+// already running is not interrupted. It is safe to call while c is running.
+func (c *Cleaner) Unregister(p *SQLitexStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, s := range c.stores {
+		if s == p {
+			c.stores = append(c.stores[:i], c.stores[i+1:]...)
+			return
+		}
+	}
+}
+
+// Stop stops c's goroutine, waiting for a cleanup in progress to finish. The
+// registered stores stay open, but are no longer cleaned.
+func (c *Cleaner) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
+func (c *Cleaner) run() {
+	defer close(c.done)
+	defer c.next.Store(0)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.next.Store(now.Add(c.interval).UnixNano())
+		case <-c.stop:
+			return
+		}
+		c.mu.Lock()
+		stores := make([]*SQLitexStore, len(c.stores))
+		copy(stores, c.stores)
+		c.mu.Unlock()
+
+		for _, p := range stores {
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+			if !p.corrupt.Load() {
+				p.runCleanup()
+			}
+		}
+	}
+}
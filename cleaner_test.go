@@ -0,0 +1,79 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// countRows returns the number of rows in table, expired or not.
+func countRows(t testing.TB, db *sqlitex.Pool, table string) int {
+	t.Helper()
+
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take connection: %v", err)
+	}
+	defer db.Put(conn)
+
+	var n int
+	err = sqlitex.ExecuteTransient(conn, "SELECT COUNT(*) FROM "+table, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt(0)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+	return n
+}
+
+func TestCleaner(t *testing.T) {
+	db := newPool(t)
+	cleaner := zqlsession.NewCleaner(10 * time.Millisecond)
+	defer cleaner.Stop()
+
+	tables := []string{"tenant_a", "tenant_b", "tenant_c", "tenant_d"}
+	stores := make(map[string]*zqlsession.SQLitexStore)
+	for _, table := range tables {
+		store := zqlsession.NewWithCleaner(db, cleaner,
+			zqlsession.WithAutoMigrate(), zqlsession.WithTableName(table))
+		defer store.Shutdown(context.Background())
+		stores[table] = store
+	}
+	// tenant_d leaves the cleaner, so its sessions are kept.
+	cleaner.Unregister(stores["tenant_d"])
+
+	for _, table := range tables {
+		store := stores[table]
+		if err := store.Commit("short", []byte("data"), time.Now().Add(50*time.Millisecond)); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if err := store.Commit("long", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, table := range tables[:3] {
+		for countRows(t, db, table) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expired session was not cleaned", table)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, found, _ := stores[table].Find("long"); !found {
+			t.Errorf("%s: active session was cleaned", table)
+		}
+	}
+	if n := countRows(t, db, "tenant_d"); n != 2 {
+		t.Errorf("tenant_d: got %d rows, want the unregistered store left alone", n)
+	}
+}
@@ -0,0 +1,81 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import "zombiezen.com/go/sqlite"
+
+// Codec transforms session data on its way into and out of the database, for
+// example to compress it. See WithCodec.
+type Codec interface {
+	// Encode returns the stored form of data.
+	Encode(data []byte) ([]byte, error)
+	// Decode returns the data whose stored form is b. Codecs should
+	// recognise data stored before the codec was introduced and return it
+	// unchanged, so that a codec can be added to an existing store.
+	Decode(b []byte) ([]byte, error)
+}
+
+// encodeData applies the WithCodec codec, if any, to session data before it
+// is stored.
+func (p *SQLitexStore) encodeData(b []byte) ([]byte, error) {
+	if p.codec == nil {
+		return b, nil
+	}
+	stored, err := p.codec.Encode(b)
+	if err != nil {
+		return nil, err
+	}
+	p.originalBytes.Add(int64(len(b)))
+	p.storedBytes.Add(int64(len(stored)))
+	return stored, nil
+}
+
+// CompressionStats reports the total size of the session data encoded by the
+// WithCodec codec since the store was created or last Reset, before and after
+// encoding, and the ratio of the stored size to the original. The totals
+// include commits whose transaction was later rolled back. They are all zero
+// without a codec.
+func (p *SQLitexStore) CompressionStats() (original, stored int64, ratio float64) {
+	original = p.originalBytes.Load()
+	stored = p.storedBytes.Load()
+	if original > 0 {
+		ratio = float64(stored) / float64(original)
+	}
+	return original, stored, ratio
+}
+
+// columnData reads the session data in column col of stmt, for the session
+// whose stored token is key, see decodeStored.
+func (p *SQLitexStore) columnData(stmt *sqlite.Stmt, col int, key string) ([]byte, error) {
+	b := make([]byte, stmt.ColumnLen(col))
+	stmt.ColumnBytes(col, b)
+	return p.decodeStored(b, key)
+}
+
+// decodeStored returns the session data whose stored form is b, for the
+// session whose stored token is key, verifying its WithDataChecksum checksum,
+// decrypting it if it was committed with CommitEncrypted and decoding it with
+// the WithCodec codec, if any. Empty data is returned as an empty, non-nil
+// slice, even when the decryption or the codec returns nil, so that callers
+// can tell an empty session from a missing one without checking the exists
+// flag.
+func (p *SQLitexStore) decodeStored(b []byte, key string) ([]byte, error) {
+	b, err := p.verifyChecksum(b)
+	if err != nil {
+		return nil, err
+	}
+	b, err = p.decrypt(b, key)
+	if err != nil {
+		return nil, err
+	}
+	if p.codec != nil {
+		b, err = p.codec.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	return b, nil
+}
@@ -0,0 +1,67 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+func TestMaxConcurrency(t *testing.T) {
+	store := newStore(t, newPool(t), zqlsession.WithMaxConcurrency(1))
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// Hold the only slot with a transaction until release is closed.
+	running := make(chan struct{})
+	release := make(chan struct{})
+	held := make(chan error)
+	go func() {
+		held <- store.WithTx(context.Background(), func(tx *zqlsession.Tx) error {
+			close(running)
+			<-release
+			return nil
+		})
+	}()
+	<-running
+
+	found := make(chan bool)
+	go func() {
+		_, ok, err := store.Find("token")
+		if err != nil {
+			t.Errorf("find: %v", err)
+		}
+		found <- ok
+	}()
+	select {
+	case <-found:
+		t.Fatal("find ran while the limit was saturated")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A waiting operation gives up when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := store.WithTx(ctx, func(tx *zqlsession.Tx) error { return nil })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("transaction with the limit saturated: got %v, want DeadlineExceeded", err)
+	}
+
+	close(release)
+	if err := <-held; err != nil {
+		t.Fatalf("transaction: %v", err)
+	}
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Error("find: got false, want the session")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("find did not run once the slot was released")
+	}
+}
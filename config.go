@@ -0,0 +1,134 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import "time"
+
+// StoreConfig is a snapshot of a store's effective configuration, after
+// defaults have been applied.
+type StoreConfig struct {
+	Name             string
+	Table            string
+	CleanupInterval  time.Duration
+	CleanupSchedule  bool
+	CleanupBudget    time.Duration
+	AdaptiveCleanup  bool
+	CleanupProgress  bool
+	SharedCleaner    bool
+	AutoMigrate      bool
+	SchemaVersion    bool
+	ExpiryJitter     time.Duration
+	Sequence         bool
+	ExpiryEncoding   string
+	UnixExpiry       bool
+	SplitData        bool
+	UserID           bool
+	TokenNormalizer  bool
+	TokenPrefix      string
+	TouchPolicy      bool
+	Observer         bool
+	AfterCleanup     bool
+	SlowThreshold    time.Duration
+	ArchiveRetention time.Duration
+	MaxSessions      int
+	ConflictPolicy   ConflictPolicy
+	PastExpiryPolicy PastExpiryPolicy
+	PastExpiryGrace  time.Duration
+	AcquireTimeout   time.Duration
+	PoolSize         int
+	MaxConcurrency   int
+	ReadOnly         bool
+	CoveringIndex    bool
+	// UserForeignKey is the users table and column referenced by user_id,
+	// such as "users(id)", or empty if WithUserForeignKey is not used.
+	UserForeignKey   string
+	ExclusiveLocking bool
+	// CacheSize is the page cache size in KiB set by WithCacheSize, or 0
+	// for SQLite's default.
+	CacheSize      int
+	Codec          bool
+	Encryption     bool
+	AccessCounting bool
+	MaxTokenLength int
+	PoliteCleanup  int
+	ErrorCodes     bool
+	Reconnect      bool
+	DataChecksum   bool
+	// ChecksumFallback is set by WithChecksumFallback.
+	ChecksumFallback bool
+	SkipUnchanged    bool
+
+	// WriteBehindInterval and WriteBehindMaxBuffered are zero unless
+	// WithWriteBehind is used.
+	WriteBehind            bool
+	WriteBehindInterval    time.Duration
+	WriteBehindMaxBuffered int
+
+	// CircuitBreakerFailures and CircuitBreakerCooldown are zero unless
+	// WithCircuitBreaker is used.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+}
+
+// Config returns the store's effective configuration. It is intended for
+// debugging and status pages, to confirm a deployment picked up the intended
+// options.
+func (p *SQLitexStore) Config() StoreConfig {
+	c := StoreConfig{
+		Name:             p.name,
+		Table:            p.table,
+		CleanupInterval:  p.cleanupInterval,
+		CleanupSchedule:  p.cleanupSchedule != nil,
+		CleanupBudget:    p.cleanupBudget,
+		AdaptiveCleanup:  p.adaptive != nil,
+		CleanupProgress:  p.cleanupProgress != nil,
+		SharedCleaner:    p.cleaner != nil,
+		AutoMigrate:      p.autoMigrate,
+		SchemaVersion:    p.schemaVersion,
+		ExpiryJitter:     p.expiryJitter,
+		Sequence:         p.sequence,
+		ExpiryEncoding:   p.expiryEncoding.Name,
+		UnixExpiry:       p.unixExpiry(),
+		SplitData:        p.splitData,
+		UserID:           p.userID != nil,
+		TokenNormalizer:  p.normalize != nil,
+		TokenPrefix:      p.tokenPrefix,
+		TouchPolicy:      p.touchPolicy != nil,
+		Observer:         p.observer != nil,
+		AfterCleanup:     p.afterCleanup != nil,
+		SlowThreshold:    p.slowThreshold,
+		ArchiveRetention: p.archiveRetention,
+		MaxSessions:      p.maxSessions,
+		ConflictPolicy:   p.conflictPolicy,
+		PastExpiryPolicy: p.pastExpiryPolicy,
+		PastExpiryGrace:  p.pastExpiryGrace,
+		AcquireTimeout:   p.acquireTimeout,
+		PoolSize:         p.poolSize,
+		MaxConcurrency:   p.maxConcurrency,
+		ReadOnly:         p.readOnly,
+		CoveringIndex:    p.coveringIndex,
+		UserForeignKey:   p.userForeignKey,
+		ExclusiveLocking: p.exclusiveLocking,
+		CacheSize:        p.cacheSize,
+		Codec:            p.codec != nil,
+		Encryption:       p.aead != nil,
+		AccessCounting:   p.access != nil,
+		MaxTokenLength:   p.maxTokenLength,
+		PoliteCleanup:    p.politeBatch,
+		ErrorCodes:       p.errorCodes,
+		Reconnect:        p.reconnect != nil,
+		DataChecksum:     p.dataChecksum,
+		ChecksumFallback: p.checksumFallback,
+		SkipUnchanged:    p.skipUnchanged,
+	}
+	if p.writeBehind != nil {
+		c.WriteBehind = true
+		c.WriteBehindInterval = p.writeBehind.interval
+		c.WriteBehindMaxBuffered = p.writeBehind.maxBuffered
+	}
+	if p.breaker != nil {
+		c.CircuitBreakerFailures = p.breaker.threshold
+		c.CircuitBreakerCooldown = p.breaker.cooldown
+	}
+	return c
+}
@@ -0,0 +1,74 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ErrCorrupt is returned by every store operation once SQLite has reported
+// that the database is corrupt, until WithReconnect recovers the store. The
+// error that first reported corruption wraps both ErrCorrupt and the SQLite
+// error.
+var ErrCorrupt = errors.New("zqlsession: database is corrupt")
+
+// checkCorrupt puts the store into the failed state if *err reports that the
+// database is corrupt. It is deferred by the operations which query the
+// database, so that a corrupt database is noticed wherever it surfaces.
+//
+// A failed store stops cleaning up, logs once and reports an OpCorrupt event
+// to the WithObserver function, rather than repeatedly failing against the
+// corrupt file.
+func (p *SQLitexStore) checkCorrupt(err *error) {
+	p.checkReconnect(p.pool(), *err)
+	if *err == nil || sqlite.ErrCode(*err).ToPrimary() != sqlite.ResultCorrupt {
+		return
+	}
+	cause := *err
+	*err = fmt.Errorf("%w: %w", ErrCorrupt, cause)
+	if p.corrupt.Swap(true) {
+		return
+	}
+	p.logger.Printf("zqlsession: %s: database is corrupt, disabling store: %v",
+		p.name, cause)
+	p.observe(Event{
+		Op:  OpCorrupt,
+		Err: cause,
+	})
+}
+
+// RunIntegrityCheck runs PRAGMA integrity_check on the database, returning the
+// problems it reports, or none if the database is intact. Unlike other
+// methods it may be used once the store has failed with ErrCorrupt, to help
+// diagnose the damage.
+func (p *SQLitexStore) RunIntegrityCheck(ctx context.Context) (_ []string, err error) {
+	defer p.logSlow(OpIntegrityCheck, 0, time.Now())
+	defer p.wrapError(OpIntegrityCheck, &err)
+
+	conn, put, err := p.acquire(ctx, OpIntegrityCheck)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	var problems []string
+	err = sqlitex.ExecuteTransient(conn, "PRAGMA integrity_check",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if s := stmt.ColumnText(0); s != "ok" {
+					problems = append(problems, s)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
@@ -0,0 +1,102 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// corruptDatabase overwrites every page but the first of the database file at
+// path, leaving the schema readable but the tables and indexes damaged.
+func corruptDatabase(t *testing.T, path string) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read database: %v", err)
+	}
+	pageSize := int(binary.BigEndian.Uint16(b[16:18]))
+	copy(b[pageSize:], bytes.Repeat([]byte{0xff}, len(b)-pageSize))
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatalf("write database: %v", err)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	store, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate())
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		token := fmt.Sprintf("token%d", i)
+		if err := store.Commit(token, bytes.Repeat([]byte("x"), 1024), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	store.Shutdown(context.Background())
+	// Closing the last connection checkpoints the WAL into the file.
+	if err := db.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+	corruptDatabase(t, path)
+
+	db, err = sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	var events atomic.Int64
+	var logged bytes.Buffer
+	store, err = zqlsession.NewE(db,
+		zqlsession.WithLogger(log.New(&logged, "", 0)),
+		zqlsession.WithObserver(func(e zqlsession.Event) {
+			if e.Op == zqlsession.OpCorrupt {
+				events.Add(1)
+			}
+		}))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	defer store.Shutdown(context.Background())
+
+	if _, _, err := store.Find("token1"); !errors.Is(err, zqlsession.ErrCorrupt) {
+		t.Fatalf("find: got %v, want ErrCorrupt", err)
+	}
+	// Once failed, the store no longer uses the database.
+	if err := store.Commit("other", []byte("data"), expiry); !errors.Is(err, zqlsession.ErrCorrupt) {
+		t.Errorf("commit: got %v, want ErrCorrupt", err)
+	}
+	if _, err := store.Count(); !errors.Is(err, zqlsession.ErrCorrupt) {
+		t.Errorf("count: got %v, want ErrCorrupt", err)
+	}
+	if n := events.Load(); n != 1 {
+		t.Errorf("got %d corrupt events, want 1", n)
+	}
+	if n := bytes.Count(logged.Bytes(), []byte("database is corrupt")); n != 1 {
+		t.Errorf("logged corruption %d times, want once:\n%s", n, logged.Bytes())
+	}
+
+	problems, err := store.RunIntegrityCheck(context.Background())
+	if err == nil && len(problems) == 0 {
+		t.Error("integrity check: got no problems")
+	}
+}
@@ -0,0 +1,87 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestCounts(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	expiry := time.Now().Add(time.Hour)
+	for _, token := range []string{"a", "b"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	err := store.Import(ctx, []zqlsession.SessionRecord{
+		{Token: "expired", Data: []byte("data"), Expiry: time.Now().Add(-time.Hour)},
+	}, zqlsession.Decoded)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	active, total, err := store.Counts()
+	if err != nil || active != 2 || total != 3 {
+		t.Fatalf("counts: got %d, %d, %v, want 2, 3", active, total, err)
+	}
+}
+
+func TestCountsWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithWriteBehind(time.Hour, 100))
+	// A second store of the same table only sees what has been flushed.
+	plain := newStore(t, db)
+
+	expiry := time.Now().Add(time.Hour)
+	for _, token := range []string{"a", "b", "c"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	err := store.Import(ctx, []zqlsession.SessionRecord{
+		{Token: "expired", Data: []byte("data"), Expiry: time.Now().Add(-time.Hour)},
+	}, zqlsession.Decoded)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	// Buffer a new session, a refresh of an existing one, and deletes of
+	// an active and an expired session.
+	if err := store.Commit("d", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Commit("a", []byte("new"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := store.Delete("expired"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	active, total, err := store.Counts()
+	if err != nil || active != 3 || total != 3 {
+		t.Fatalf("counts: got %d, %d, %v, want 3, 3", active, total, err)
+	}
+	if n, err := store.Count(); err != nil || n != active {
+		t.Errorf("count: got %d, %v, want %d", n, err, active)
+	}
+	if _, found, _ := plain.Find("d"); found {
+		t.Error("counting flushed the buffered writes")
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if active2, total2, err := store.Counts(); err != nil || active2 != active || total2 != total {
+		t.Errorf("counts after flush: got %d, %d, %v, want %d, %d",
+			active2, total2, err, active, total)
+	}
+}
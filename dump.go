@@ -0,0 +1,101 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// RowDump describes a session's stored row for diagnostics, see DumpRow. The
+// token and data are redacted to hashes so that dumps can be shared safely.
+type RowDump struct {
+	// TokenHash is the hex encoded SHA-256 of the normalized token.
+	TokenHash string
+	Expiry    time.Time
+	// Expired reports whether the session had expired when it was dumped.
+	Expired bool
+	DataLen int
+	// DataHash is the hex encoded SHA-256 of the session data.
+	DataHash string
+	// Seq is the session's creation sequence number, which is zero unless
+	// the WithSequence option is used.
+	Seq int64
+	// UserID is empty if the session has no user_id.
+	UserID string
+	// AccessCount is the number of times the session has been read, which
+	// is zero unless the WithAccessCounting option is used.
+	AccessCount int64
+}
+
+// DumpRow returns the stored row for a session token for use when diagnosing
+// a problem with a session. Unlike Find, it also returns expired sessions,
+// and it does not return the session data itself, only its length and hash.
+// The found flag is false if no row exists for the token.
+func (p *SQLitexStore) DumpRow(token string) (_ RowDump, _ bool, err error) {
+	defer p.logSlow(OpDumpRow, len(token), time.Now())
+	defer p.wrapError(OpDumpRow, &err)
+
+	token = p.normalizeToken(token)
+	if token == "" {
+		return RowDump{}, false, nil
+	}
+	if p.tokenTooLong(token) {
+		return RowDump{}, false, ErrTokenTooLong
+	}
+	conn, put, err := p.take(context.Background(), OpDumpRow)
+	if err != nil {
+		return RowDump{}, false, err
+	}
+	defer put(&err)
+
+	// Buffered writes and access counts are flushed so that the dump is
+	// current.
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return RowDump{}, false, err
+		}
+	}
+	if p.access != nil {
+		if err := p.flushAccess(conn); err != nil {
+			return RowDump{}, false, err
+		}
+	}
+	var dump RowDump
+	var found bool
+	err = sqlitex.Execute(conn, p.q.dumpRow,
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				found = true
+				h := sha256.New()
+				if _, err := io.Copy(h, stmt.ColumnReader(1)); err != nil {
+					return err
+				}
+				dump = RowDump{
+					Expiry:   p.decodeExpiry(stmt, 0),
+					DataLen:  stmt.ColumnLen(1),
+					DataHash: hex.EncodeToString(h.Sum(nil)),
+					Seq:      stmt.ColumnInt64(2),
+					UserID:   stmt.ColumnText(3),
+				}
+				if p.access != nil {
+					dump.AccessCount = stmt.ColumnInt64(4)
+				}
+				return nil
+			},
+		})
+	if err != nil || !found {
+		return RowDump{}, false, err
+	}
+	sum := sha256.Sum256([]byte(token))
+	dump.TokenHash = hex.EncodeToString(sum[:])
+	dump.Expired = !time.Now().Before(dump.Expiry)
+	return dump, true, nil
+}
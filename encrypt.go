@@ -0,0 +1,143 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// encryptedMarker starts the stored form of encrypted session data, followed
+// by the nonce and the sealed data. Neither scs's gob nor its JSON codec ever
+// produce data starting with a zero byte.
+const encryptedMarker byte = 0
+
+// ErrNoEncryptionKey is returned by CommitEncrypted when the store was not
+// created with WithEncryptionKey.
+var ErrNoEncryptionKey = errors.New("zqlsession: no encryption key")
+
+// WithEncryptionKey enables CommitEncrypted, which encrypts a session's data
+// with AES-GCM using key, so that only sensitive sessions, such as those of
+// authenticated users, pay the cost of encryption. key must be 16, 24 or 32
+// bytes long, selecting AES-128, AES-192 or AES-256; WithEncryptionKey panics
+// otherwise.
+//
+// Encrypted data is marked by a leading byte, so encrypted and plaintext
+// sessions can share a table and Find decrypts only the sessions which need
+// it. Sessions committed with Commit are stored as plaintext, unless their
+// data happens to start with the marker, in which case they are encrypted so
+// that they read back unchanged. Data is encrypted after the WithCodec codec
+// has encoded it. The session's token is authenticated with the data, so
+// encrypted data copied to another token's row fails to decrypt; for the same
+// reason, encrypted sessions exported Verbatim can only be imported under the
+// same tokens and WithTokenPrefix.
+//
+// Data stored before the key was given which starts with a zero byte cannot
+// be read once it is. A store without the key reads encrypted data as is.
+func WithEncryptionKey(key []byte) Option {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(fmt.Sprintf("zqlsession: invalid encryption key: %v", err))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(fmt.Sprintf("zqlsession: invalid encryption key: %v", err))
+	}
+	return func(p *SQLitexStore) {
+		p.aead = aead
+	}
+}
+
+// CommitEncrypted is like Commit, but stores b encrypted with the key given to
+// WithEncryptionKey. It returns ErrNoEncryptionKey without one.
+func (p *SQLitexStore) CommitEncrypted(token string, b []byte, expiry time.Time) (err error) {
+	defer p.logSlow(OpCommit, len(token), time.Now())
+	defer p.wrapError(OpCommit, &err)
+
+	if p.aead == nil {
+		return ErrNoEncryptionKey
+	}
+	if token == "" {
+		return ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return err
+	}
+	expiry = p.jitter(expiry)
+	if p.writeBehind != nil {
+		if skip {
+			return p.bufferDelete(token)
+		}
+		return p.bufferCommit(token, b, expiry, true)
+	}
+	conn, put, err := p.take(context.Background(), OpCommit)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if skip {
+		return p.delete(conn, token)
+	}
+	return p.commitEncrypted(conn, token, b, expiry)
+}
+
+// commitEncrypted is commit for CommitEncrypted.
+func (p *SQLitexStore) commitEncrypted(conn *sqlite.Conn, token string, b []byte, expiry time.Time) error {
+	stored, err := p.encodeData(b)
+	if err != nil {
+		return err
+	}
+	stored, err = p.encrypt(stored, p.normalizeToken(token))
+	if err != nil {
+		return err
+	}
+	return p.commitStored(conn, token, b, p.addChecksum(stored), expiry)
+}
+
+// encrypt returns the encrypted stored form of data already encoded by the
+// codec, for the session whose stored token is key. The token is
+// authenticated along with the data, so that the ciphertext cannot be copied
+// to another session's row.
+func (p *SQLitexStore) encrypt(stored []byte, key string) ([]byte, error) {
+	n := p.aead.NonceSize()
+	out := make([]byte, 1+n, 1+n+len(stored)+p.aead.Overhead())
+	out[0] = encryptedMarker
+	nonce := out[1:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return p.aead.Seal(out, nonce, stored, []byte(key)), nil
+}
+
+// decrypt returns the codec encoded form of stored data of the session whose
+// stored token is key, decrypting it if it is marked as encrypted. Without an
+// encryption key data is never taken to be encrypted.
+func (p *SQLitexStore) decrypt(stored []byte, key string) ([]byte, error) {
+	if p.aead == nil || len(stored) == 0 || stored[0] != encryptedMarker {
+		return stored, nil
+	}
+	n := p.aead.NonceSize()
+	if len(stored) < 1+n+p.aead.Overhead() {
+		return nil, errors.New("zqlsession: encrypted data is truncated")
+	}
+	b, err := p.aead.Open(nil, stored[1:1+n], stored[1+n:], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("zqlsession: decrypt session data: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,173 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	store := newStore(t, newPool(t), zqlsession.WithEncryptionKey(testKey))
+
+	if err := store.CommitEncrypted("token", []byte("secret"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	got, found, err := store.Find("token")
+	if err != nil || !found || string(got) != "secret" {
+		t.Fatalf("find: got %q, %v, %v, want %q", got, found, err, "secret")
+	}
+}
+
+func TestEncryptedBoundToToken(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithEncryptionKey(testKey))
+
+	expiry := time.Now().Add(time.Hour)
+	if err := store.CommitEncrypted("victim", []byte("secret"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.CommitEncrypted("attacker", []byte("mine"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	execute(t, db, "UPDATE sessions SET data = "+
+		"(SELECT data FROM sessions WHERE token = 'victim') WHERE token = 'attacker'")
+
+	if got, _, err := store.Find("attacker"); err == nil {
+		t.Fatalf("find copied ciphertext: got %q, want an error", got)
+	}
+}
+
+func TestImportVerbatimEncryptedUserID(t *testing.T) {
+	userID := zqlsession.WithUserID(func(b []byte) string {
+		user, _, _ := strings.Cut(string(b), ":")
+		return user
+	})
+	ctx := context.Background()
+	src := newStore(t, newPool(t), zqlsession.WithEncryptionKey(testKey), userID)
+	dst := newStore(t, newPool(t), zqlsession.WithEncryptionKey(testKey), userID)
+
+	if err := src.CommitEncrypted("token", []byte("alice:cart"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	sessions, err := src.Export(ctx, zqlsession.Verbatim)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if err := dst.Import(ctx, sessions, zqlsession.Verbatim); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	dump, found, err := dst.DumpRow("token")
+	if err != nil || !found {
+		t.Fatalf("dump: got %v, %v", found, err)
+	}
+	if dump.UserID != "alice" {
+		t.Errorf("user_id: got %q, want %q", dump.UserID, "alice")
+	}
+	got, _, err := dst.Find("token")
+	if err != nil || string(got) != "alice:cart" {
+		t.Errorf("find: got %q, %v, want %q", got, err, "alice:cart")
+	}
+}
+
+// TestExportImportEncrypted round trips encrypted sessions between two stores
+// with the same key in both data modes.
+func TestExportImportEncrypted(t *testing.T) {
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, mode := range []zqlsession.DataMode{zqlsession.Decoded, zqlsession.Verbatim} {
+		src := newStore(t, newPool(t),
+			zqlsession.WithEncryptionKey(testKey), zqlsession.WithCodec(prefixCodec{}))
+		dst := newStore(t, newPool(t),
+			zqlsession.WithEncryptionKey(testKey), zqlsession.WithCodec(prefixCodec{}))
+		for _, token := range []string{"a", "b", "c"} {
+			if err := src.CommitEncrypted(token, []byte("secret "+token), expiry); err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+		}
+
+		sessions, err := src.Export(ctx, mode)
+		if err != nil {
+			t.Fatalf("export: %v", err)
+		}
+		for _, s := range sessions {
+			if plain := strings.Contains(string(s.Data), "secret"); plain != (mode == zqlsession.Decoded) {
+				t.Errorf("mode %d: %q exported as %q", mode, s.Token, s.Data)
+			}
+		}
+		if err := dst.Import(ctx, sessions, mode); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+		for _, token := range []string{"a", "b", "c"} {
+			got, found, err := dst.Find(token)
+			if err != nil || !found || string(got) != "secret "+token {
+				t.Errorf("mode %d: find %q: got %q, %v, %v, want %q",
+					mode, token, got, found, err, "secret "+token)
+			}
+			dump, _, err := dst.DumpRow(token)
+			if err != nil {
+				t.Fatalf("dump: %v", err)
+			}
+			if !dump.Expiry.Equal(expiry) {
+				t.Errorf("mode %d: %q expiry: got %v, want %v", mode, token, dump.Expiry, expiry)
+			}
+		}
+	}
+}
+
+// TestEncryptedMixed stores encrypted and plaintext sessions in one table,
+// including plaintext which starts with the encrypted marker byte.
+func TestEncryptedMixed(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithEncryptionKey(testKey))
+	plain := newStore(t, db)
+
+	expiry := time.Now().Add(time.Hour)
+	sessions := map[string]struct {
+		data      string
+		encrypted bool
+	}{
+		"anon":   {"browsing", false},
+		"marker": {"\x00looks encrypted", false},
+		"alice":  {"alice:secret", true},
+		"bob":    {"bob:secret", true},
+	}
+	for token, s := range sessions {
+		commit := store.Commit
+		if s.encrypted {
+			commit = store.CommitEncrypted
+		}
+		if err := commit(token, []byte(s.data), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+
+	all, err := store.All()
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	for token, s := range sessions {
+		if got, found, err := store.Find(token); err != nil || !found || string(got) != s.data {
+			t.Errorf("find %q: got %q, %v, %v, want %q", token, got, found, err, s.data)
+		}
+		if got := string(all[token]); got != s.data {
+			t.Errorf("all %q: got %q, want %q", token, got, s.data)
+		}
+		// Without the key, the stored form shows which were encrypted.
+		// Plaintext starting with the marker is encrypted too.
+		stored, _, err := plain.Find(token)
+		if err != nil {
+			t.Fatalf("find %q without the key: %v", token, err)
+		}
+		encrypted := s.encrypted || s.data[0] == 0
+		if (string(stored) != s.data) != encrypted {
+			t.Errorf("%q stored as %q, want encrypted %v", token, stored, encrypted)
+		}
+	}
+}
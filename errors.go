@@ -0,0 +1,97 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"errors"
+	"reflect"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// sqlitePkg is the import path of the sqlite package, whose error types are
+// unexported.
+var sqlitePkg = reflect.TypeOf(sqlite.ResultOK).PkgPath()
+
+// Error is an error reported by SQLite during a store operation, returned in
+// place of the SQLite error when WithErrorCodes is used. Its message is that
+// of the SQLite error.
+type Error struct {
+	// Op is the store operation which failed.
+	Op Op
+	// Err is the error as it would be returned without WithErrorCodes.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Code returns the SQLite result code of the error, such as
+// sqlite.ResultBusy. Use its ToPrimary method to ignore the extended code.
+func (e *Error) Code() sqlite.ResultCode {
+	return sqlite.ErrCode(e.Err)
+}
+
+// WithErrorCodes makes the store's methods return errors reported by SQLite as
+// an *Error, so that callers can use errors.As to branch on the result code,
+// such as retrying on SQLITE_BUSY, without matching error messages. Errors
+// which did not come from SQLite, such as ErrReadOnly or a context's error,
+// are returned unchanged. Errors returned by the Store interface methods to
+// scs are wrapped too, so they reach the handler passed to scs's ErrorFunc.
+func WithErrorCodes() Option {
+	return func(p *SQLitexStore) {
+		p.errorCodes = true
+	}
+}
+
+// wrapError counts the result of op towards the WithCircuitBreaker breaker,
+// and replaces *err with an *Error for op if it was reported by SQLite and the
+// store was created with WithErrorCodes. It is deferred by the exported
+// methods which query the database, so that every operation is counted once.
+func (p *SQLitexStore) wrapError(op Op, err *error) {
+	p.recordResult(*err)
+	p.wrapCode(op, err)
+}
+
+// wrapCode is wrapError without counting the result, for the methods of Tx,
+// whose results are counted with the transaction's by WithTx.
+func (p *SQLitexStore) wrapCode(op Op, err *error) {
+	if !p.errorCodes || *err == nil || !isSQLiteError(*err) {
+		return
+	}
+	var e *Error
+	if errors.As(*err, &e) {
+		return
+	}
+	*err = &Error{Op: op, Err: *err}
+}
+
+// isSQLiteError reports whether err is or wraps an error from the sqlite
+// package. sqlite.ErrCode cannot tell, as it reports SQLITE_ERROR for any
+// other error.
+func isSQLiteError(err error) bool {
+	for err != nil {
+		if errs, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, err := range errs.Unwrap() {
+				if isSQLiteError(err) {
+					return true
+				}
+			}
+			return false
+		}
+		t := reflect.TypeOf(err)
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.PkgPath() == sqlitePkg {
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+	return false
+}
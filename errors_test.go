@@ -0,0 +1,66 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestErrorCodesBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	locker, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer locker.Close()
+	// The store's connections give up on a lock after a few milliseconds.
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{
+		PoolSize: 1,
+		PrepareConn: func(conn *sqlite.Conn) error {
+			return sqlitex.ExecuteTransient(conn, "PRAGMA busy_timeout = 10;", nil)
+		},
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	store := newStore(t, db, zqlsession.WithErrorCodes())
+
+	// Hold the write lock from another connection.
+	conn, err := locker.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	defer locker.Put(conn)
+	end, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	rollback := errors.New("rollback")
+	defer end(&rollback)
+
+	err = store.Commit("token", []byte("data"), time.Now().Add(time.Hour))
+	var e *zqlsession.Error
+	if !errors.As(err, &e) {
+		t.Fatalf("commit: got %v, want a *zqlsession.Error", err)
+	}
+	if e.Code().ToPrimary() != sqlite.ResultBusy {
+		t.Errorf("code: got %v, want %v", e.Code(), sqlite.ResultBusy)
+	}
+	if e.Op != zqlsession.OpCommit {
+		t.Errorf("op: got %q, want %q", e.Op, zqlsession.OpCommit)
+	}
+
+	// Errors which did not come from SQLite are returned unchanged.
+	if err := store.Commit("", []byte("data"), time.Now().Add(time.Hour)); !errors.Is(err, zqlsession.ErrEmptyToken) || errors.As(err, &e) {
+		t.Errorf("commit empty token: got %#v, want ErrEmptyToken", err)
+	}
+}
@@ -0,0 +1,162 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// ExpiryEncoding describes how session expiry times are stored in the expiry
+// column, see WithExpiryEncoding. The stored values must sort in time order, as
+// expired sessions are found by comparing them with Now.
+type ExpiryEncoding struct {
+	// Name identifies the encoding in StoreConfig.
+	Name string
+	// Encode returns the value bound to queries for an expiry time.
+	Encode func(expiry time.Time) any
+	// Decode converts a stored expiry back to a time. v is an int64,
+	// float64, string or []byte depending on the stored column type. The
+	// expiry column created by CreateTable is REAL, so numbers are always
+	// read as float64.
+	Decode func(v any) time.Time
+	// Now is an SQL expression for the current time in the stored form.
+	Now string
+	// Param is an SQL expression converting a parameter, written as %s,
+	// bound with a value from Encode to the stored form.
+	Param string
+}
+
+// The predefined expiry encodings.
+var (
+	// JulianDayExpiry stores expiry times as fractional julianday values
+	// with millisecond precision. It is the default.
+	JulianDayExpiry = ExpiryEncoding{
+		Name: "julianday",
+		Encode: func(expiry time.Time) any {
+			// The text carries no zone offset, which SQLite reads as
+			// UTC, to match julianday('now').
+			return expiry.UTC().Format("2006-01-02T15:04:05.999")
+		},
+		Decode: func(v any) time.Time {
+			// The unix epoch is julian day 2440587.5.
+			ms := math.Round((expiryFloat(v) - 2440587.5) * 86400000)
+			return time.UnixMilli(int64(ms)).UTC()
+		},
+		Now:   "julianday('now')",
+		Param: "julianday(%s)",
+	}
+
+	// UnixExpiry stores expiry times as integer unix seconds, see
+	// WithUnixExpiry.
+	UnixExpiry = ExpiryEncoding{
+		Name: "unix",
+		Encode: func(expiry time.Time) any {
+			// Truncated, so sessions expire up to a second early
+			// rather than late.
+			return expiry.Unix()
+		},
+		Decode: func(v any) time.Time {
+			return time.Unix(int64(expiryFloat(v)), 0).UTC()
+		},
+		Now:   "unixepoch('now')",
+		Param: "%s",
+	}
+
+	// ISO8601Expiry stores expiry times as UTC text in the form
+	// "2006-01-02 15:04:05.000", as written by SQLite's datetime functions
+	// and accepted by the timestamp columns of most other databases.
+	ISO8601Expiry = ExpiryEncoding{
+		Name: "iso8601",
+		Encode: func(expiry time.Time) any {
+			return expiry.UTC().Format(iso8601Layout)
+		},
+		Decode: func(v any) time.Time {
+			var s string
+			switch v := v.(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			}
+			t, _ := time.Parse(iso8601Layout, s)
+			return t
+		},
+		Now:   "strftime('%Y-%m-%d %H:%M:%f', 'now')",
+		Param: "%s",
+	}
+)
+
+// iso8601Layout has a fixed width, so that stored expiry times sort in time
+// order as text.
+const iso8601Layout = "2006-01-02 15:04:05.000"
+
+// WithExpiryEncoding stores expiry times using e rather than as julianday
+// values, for example to match the schema of another scs store while
+// migrating data between them. Existing databases must already use the same
+// encoding, otherwise their sessions appear expired or never expire.
+func WithExpiryEncoding(e ExpiryEncoding) Option {
+	return func(p *SQLitexStore) {
+		p.expiryEncoding = e
+	}
+}
+
+// expiryFloat converts a stored numeric expiry to a float64.
+func expiryFloat(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+// expiryReplacer returns a replacer rewriting the julianday based queries to
+// compare against expiry stored with e.
+func expiryReplacer(e ExpiryEncoding) *strings.Replacer {
+	return strings.NewReplacer(
+		JulianDayExpiry.Now, e.Now,
+		"julianday($1)", e.param("$1"),
+		"julianday($2)", e.param("$2"),
+		"julianday($3)", e.param("$3"),
+	)
+}
+
+// param returns e's Param expression for the parameter named by name.
+func (e ExpiryEncoding) param(name string) string {
+	return strings.Replace(e.Param, "%s", name, 1)
+}
+
+// unixExpiry reports whether the store uses the UnixExpiry encoding.
+func (p *SQLitexStore) unixExpiry() bool {
+	return p.expiryEncoding.Name == UnixExpiry.Name
+}
+
+// encodeExpiry returns the value bound for an expiry time in the store's
+// configured encoding.
+func (p *SQLitexStore) encodeExpiry(expiry time.Time) any {
+	return p.expiryEncoding.Encode(expiry)
+}
+
+// decodeExpiry converts the expiry in column i of stmt, stored in the store's
+// configured encoding, back to a time in UTC.
+func (p *SQLitexStore) decodeExpiry(stmt *sqlite.Stmt, i int) time.Time {
+	var v any
+	switch stmt.ColumnType(i) {
+	case sqlite.TypeInteger:
+		v = stmt.ColumnInt64(i)
+	case sqlite.TypeFloat:
+		v = stmt.ColumnFloat(i)
+	case sqlite.TypeText:
+		v = stmt.ColumnText(i)
+	case sqlite.TypeBlob:
+		b := make([]byte, stmt.ColumnLen(i))
+		stmt.ColumnBytes(i, b)
+		v = b
+	}
+	return p.expiryEncoding.Decode(v).UTC()
+}
@@ -0,0 +1,182 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// expiryEncodings are the stores to run the expiry tests against.
+var expiryEncodings = []struct {
+	name string
+	opts []zqlsession.Option
+}{
+	{"Julian", nil},
+	{"Unix", []zqlsession.Option{zqlsession.WithUnixExpiry()}},
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("load location: %v", err)
+	}
+	return loc
+}
+
+func keys(m map[string][]byte) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestExpiryDST commits sessions expiring either side of the daylight saving
+// transitions of New York, and of midnight UTC, given in local time, and
+// checks they are stored and compared as the same instants.
+func TestExpiryDST(t *testing.T) {
+	ny := loadLocation(t, "America/New_York")
+	boundaries := []struct {
+		name    string
+		instant time.Time
+	}{
+		// 02:00 EST becomes 03:00 EDT.
+		{"SpringForward", time.Date(2030, 3, 10, 7, 0, 0, 0, time.UTC)},
+		// 02:00 EDT becomes 01:00 EST, so 01:30 local happens twice.
+		{"FallBack", time.Date(2030, 11, 3, 6, 0, 0, 0, time.UTC)},
+		{"MidnightUTC", time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, enc := range expiryEncodings {
+		t.Run(enc.name, func(t *testing.T) {
+			store := zqlsessiontest.NewMemoryStore(t, enc.opts...)
+			for _, b := range boundaries {
+				before := b.instant.Add(-time.Second).In(ny)
+				after := b.instant.Add(time.Second).In(ny)
+				if err := store.Commit(b.name+"-before", []byte("data"), before); err != nil {
+					t.Fatalf("commit: %v", err)
+				}
+				if err := store.Commit(b.name+"-after", []byte("data"), after); err != nil {
+					t.Fatalf("commit: %v", err)
+				}
+				for token, want := range map[string]time.Time{
+					b.name + "-before": before,
+					b.name + "-after":  after,
+				} {
+					dump, _, err := store.DumpRow(token)
+					if err != nil {
+						t.Fatalf("dump %q: %v", token, err)
+					}
+					if !dump.Expiry.Equal(want) {
+						t.Errorf("%s: expiry got %v, want %v", token, dump.Expiry, want.UTC())
+					}
+				}
+
+				// Only the session before the boundary expires in
+				// the two seconds up to it, asked for in local time.
+				got, err := store.AllExpiringBetween(b.instant.Add(-2*time.Second).In(ny), b.instant.In(ny))
+				if err != nil {
+					t.Fatalf("expiring between: %v", err)
+				}
+				if want := []string{b.name + "-before"}; !reflect.DeepEqual(keys(got), want) {
+					t.Errorf("%s: expiring before got %q, want %q", b.name, keys(got), want)
+				}
+			}
+		})
+	}
+}
+
+// TestExpiryLocation commits sessions whose expiry is given in several time
+// zones, and checks they expire at the same instant.
+func TestExpiryLocation(t *testing.T) {
+	locations := []*time.Location{
+		time.UTC,
+		loadLocation(t, "America/New_York"),
+		loadLocation(t, "Asia/Kathmandu"),
+		loadLocation(t, "Australia/Lord_Howe"),
+	}
+	for _, enc := range expiryEncodings {
+		t.Run(enc.name, func(t *testing.T) {
+			store := zqlsessiontest.NewMemoryStore(t, enc.opts...)
+			// Unix expiry is whole seconds, rounded down.
+			expiry := time.Now().Truncate(time.Second).Add(2 * time.Second)
+			for _, loc := range locations {
+				if err := store.Commit(loc.String(), []byte("data"), expiry.In(loc)); err != nil {
+					t.Fatalf("commit: %v", err)
+				}
+			}
+			for _, loc := range locations {
+				if _, found, _ := store.Find(loc.String()); !found {
+					t.Errorf("%s: expired early", loc)
+				}
+			}
+			time.Sleep(time.Until(expiry.Add(10 * time.Millisecond)))
+			for _, loc := range locations {
+				if _, found, _ := store.Find(loc.String()); found {
+					t.Errorf("%s: did not expire", loc)
+				}
+			}
+		})
+	}
+}
+
+// TestUnixExpiryEncoding checks that WithExpiryEncoding(UnixExpiry) stores
+// whole unix seconds, as other stores do, and reads them back. The expiry
+// column has REAL affinity, so SQLite keeps them as real numbers.
+func TestUnixExpiryEncoding(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithExpiryEncoding(zqlsession.UnixExpiry))
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := store.Commit("token", []byte("data"), expiry.Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take connection: %v", err)
+	}
+	var stored float64
+	err = sqlitex.ExecuteTransient(conn, "SELECT expiry FROM sessions", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stored = stmt.ColumnFloat(0)
+			return nil
+		},
+	})
+	db.Put(conn)
+	if err != nil {
+		t.Fatalf("select expiry: %v", err)
+	}
+	if stored != float64(expiry.Unix()) {
+		t.Errorf("stored expiry: got %f, want %d", stored, expiry.Unix())
+	}
+
+	dump, _, err := store.DumpRow("token")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if !dump.Expiry.Equal(expiry) {
+		t.Errorf("expiry: got %v, want %v", dump.Expiry, expiry)
+	}
+	if _, found, _ := store.Find("token"); !found {
+		t.Error("find: got false, want the session")
+	}
+
+	// A row written by another store in unix seconds is read as such.
+	execute(t, db, "INSERT INTO sessions (token, data, expiry) VALUES ('old', X'00', $1)",
+		time.Now().Add(-time.Minute).Unix())
+	if _, found, _ := store.Find("old"); found {
+		t.Error("find expired unix row: got true, want false")
+	}
+}
@@ -0,0 +1,48 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// newLogged returns a store of db created with opts, and the buffer its log is
+// written to.
+func newLogged(t *testing.T, db *sqlitex.Pool, opts ...zqlsession.Option) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	opts = append([]zqlsession.Option{zqlsession.WithLogger(log.New(&buf, "", 0))}, opts...)
+	store, err := zqlsession.NewE(db, opts...)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	store.Shutdown(context.Background())
+	return &buf
+}
+
+func TestMissingExpiryIndex(t *testing.T) {
+	db := newPool(t)
+	execute(t, db, strings.Split(zqlsession.Schema, ";")[0])
+	if buf := newLogged(t, db); !strings.Contains(buf.String(), "has no index on expiry") {
+		t.Errorf("got log %q, want a missing index warning", buf)
+	}
+
+	// CreateTable adds the index, after which there is no warning.
+	if buf := newLogged(t, db, zqlsession.WithAutoMigrate()); buf.Len() != 0 {
+		t.Errorf("got log %q with the index, want none", buf)
+	}
+}
+
+func TestMissingExpiryIndexNoTable(t *testing.T) {
+	if buf := newLogged(t, newPool(t)); buf.Len() != 0 {
+		t.Errorf("got log %q without a table, want none", buf)
+	}
+}
@@ -0,0 +1,282 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// DataMode says whether session data passes through the store's codec when
+// sessions are exported and imported, see WithCodec.
+type DataMode int
+
+const (
+	// Decoded data passes through the codec, like the data given to Commit
+	// and returned by Find. Sessions exported in this mode can be imported
+	// into a store with any codec, or none.
+	Decoded DataMode = iota
+
+	// Verbatim data is exactly the bytes stored in the database, still
+	// encoded by the codec. Sessions exported in this mode round trip
+	// losslessly without being decoded and re-encoded, but can only be
+	// imported into a store whose codec can decode them, such as one with
+	// the same compression dictionary.
+	Verbatim
+)
+
+// Export returns every active session, with its data in the given mode, for
+// importing into another store with Import.
+func (p *SQLitexStore) Export(ctx context.Context, mode DataMode) (_ []SessionRecord, err error) {
+	defer p.logSlow(OpExport, 0, time.Now())
+	defer p.wrapError(OpExport, &err)
+
+	conn, put, err := p.take(ctx, OpExport)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	var sessions []SessionRecord
+	err = sqlitex.Execute(conn, p.q.stream,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				token, ok := p.stripPrefix(stmt.ColumnText(0))
+				if !ok {
+					return nil
+				}
+				s := SessionRecord{
+					Token:  token,
+					Expiry: p.decodeExpiry(stmt, 2),
+				}
+				if mode == Verbatim {
+					s.Data = make([]byte, stmt.ColumnLen(1))
+					stmt.ColumnBytes(1, s.Data)
+				} else {
+					data, err := p.columnData(stmt, 1, stmt.ColumnText(0))
+					if err != nil {
+						return err
+					}
+					s.Data = data
+				}
+				sessions = append(sessions, s)
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Import commits sessions, with their data in the given mode, in a single
+// transaction. Existing sessions with the same tokens are overwritten, and
+// other sessions are left alone. If any session fails to commit, or ctx is
+// done first, none are imported. Verbatim data is stored without passing
+// through the codec, but is still decoded for the WithUserID extractor, and
+// with WithDataChecksum data whose checksum does not match, or which has none
+// without WithChecksumFallback, is rejected with ErrChecksumMismatch.
+func (p *SQLitexStore) Import(ctx context.Context, sessions []SessionRecord, mode DataMode) (err error) {
+	defer p.logSlow(OpImport, 0, time.Now())
+	defer p.wrapError(OpImport, &err)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(ctx, OpImport)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	// As with CommitAll, buffered writes are flushed first so that they
+	// cannot later overwrite the imported sessions.
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+	return p.importSessions(ctx, conn, sessions, mode)
+}
+
+func (p *SQLitexStore) importSessions(ctx context.Context, conn *sqlite.Conn, sessions []SessionRecord, mode DataMode) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	for _, s := range sessions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if mode == Verbatim {
+			err = p.commitVerbatim(conn, s)
+		} else {
+			err = p.commit(conn, s.Token, s.Data, s.Expiry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitVerbatim commits a session whose data is already encoded.
+func (p *SQLitexStore) commitVerbatim(conn *sqlite.Conn, s SessionRecord) error {
+	b := s.Data
+	if p.userID != nil {
+		// The extractor is given the data as Find would return it,
+		// which also verifies its checksum.
+		var err error
+		b, err = p.decodeStored(s.Data, p.normalizeToken(s.Token))
+		if err != nil {
+			return err
+		}
+	} else if p.dataChecksum {
+		if _, err := p.verifyChecksum(s.Data); err != nil {
+			return err
+		}
+	}
+	return p.commitStored(conn, s.Token, b, s.Data, s.Expiry)
+}
+
+// exportVersion is the version of the format written by ExportOne. ImportOne
+// reads every version up to it.
+const exportVersion = 1
+
+// ErrSessionNotFound is returned by ExportOne when no session has the token.
+var ErrSessionNotFound = errors.New("zqlsession: session not found")
+
+// exportedSession is a session as written by ExportOne. Data is encoded as
+// base64 by encoding/json.
+type exportedSession struct {
+	Version     int       `json:"version"`
+	Token       string    `json:"token"`
+	Data        []byte    `json:"data"`
+	Expiry      time.Time `json:"expiry"`
+	Seq         int64     `json:"seq,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+	AccessCount int64     `json:"access_count,omitempty"`
+}
+
+// ExportOne returns the session of a token as a self-contained JSON document,
+// for handing a problem session to a developer to load into another store with
+// ImportOne. Unlike Find it also exports an expired session, and it fails with
+// ErrSessionNotFound if there is no session at all. The data is Decoded, so the
+// document can be imported into a store with any codec or encryption key. The
+// document records its format version, which ImportOne checks, along with the
+// session's sequence number, user_id and access count for reference.
+func (p *SQLitexStore) ExportOne(token string) (_ []byte, err error) {
+	defer p.logSlow(OpExportOne, len(token), time.Now())
+	defer p.wrapError(OpExportOne, &err)
+
+	key := p.normalizeToken(token)
+	if key == "" {
+		return nil, ErrSessionNotFound
+	}
+	if p.tokenTooLong(token) {
+		return nil, ErrTokenTooLong
+	}
+	conn, put, err := p.take(context.Background(), OpExportOne)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+	if p.access != nil {
+		if err := p.flushAccess(conn); err != nil {
+			return nil, err
+		}
+	}
+	s, found, err := p.exportOne(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrSessionNotFound
+	}
+	s.Token, _ = p.stripPrefix(key)
+	return json.Marshal(s)
+}
+
+func (p *SQLitexStore) exportOne(conn *sqlite.Conn, key string) (s exportedSession, found bool, err error) {
+	defer p.checkCorrupt(&err)
+
+	err = sqlitex.Execute(conn, p.q.dumpRow,
+		&sqlitex.ExecOptions{
+			Args: []any{key},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				data, err := p.columnData(stmt, 1, key)
+				if err != nil {
+					return err
+				}
+				found = true
+				s = exportedSession{
+					Version: exportVersion,
+					Data:    data,
+					Expiry:  p.decodeExpiry(stmt, 0),
+					Seq:     stmt.ColumnInt64(2),
+					UserID:  stmt.ColumnText(3),
+				}
+				if p.access != nil {
+					s.AccessCount = stmt.ColumnInt64(4)
+				}
+				return nil
+			},
+		})
+	return s, found, err
+}
+
+// ImportOne commits the session in a document written by ExportOne,
+// overwriting any session with the same token. Only the token, data and
+// expiry are imported: the session gets a sequence number, user_id and access
+// count of its own, as for Commit. A session which has expired is imported
+// with its expiry, so Find does not return it. Documents from a newer version
+// of the format are rejected.
+func (p *SQLitexStore) ImportOne(b []byte) (err error) {
+	defer p.logSlow(OpImportOne, 0, time.Now())
+	defer p.wrapError(OpImportOne, &err)
+
+	var s exportedSession
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("zqlsession: import session: %w", err)
+	}
+	if s.Version < 1 || s.Version > exportVersion {
+		return fmt.Errorf("zqlsession: import session: unsupported version %d", s.Version)
+	}
+	if s.Token == "" {
+		return ErrEmptyToken
+	}
+	if p.tokenTooLong(s.Token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(context.Background(), OpImportOne)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+	return p.commit(conn, s.Token, s.Data, s.Expiry)
+}
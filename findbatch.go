@@ -0,0 +1,140 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// findBatchSize is the number of tokens looked up by each statement of
+// FindBatch, which keeps well below SQLite's limit on bound parameters.
+const findBatchSize = 500
+
+// FindResult is the result of looking up one token with FindBatch.
+type FindResult struct {
+	Token string
+	// Data is non-nil whenever Found is true, as with Find.
+	Data []byte
+	// Found is false if the session was not found or has expired.
+	Found bool
+}
+
+// FindBatch looks up the sessions of all the given tokens, returning a result
+// for each token in the same order, including tokens which were not found.
+// Tokens which are repeated are looked up once, and empty or overlong tokens
+// are reported as not found. The sessions are read with one query for every
+// 500 distinct tokens.
+func (p *SQLitexStore) FindBatch(tokens []string) (_ []FindResult, err error) {
+	defer p.logSlow(OpFindBatch, 0, time.Now())
+	defer p.wrapError(OpFindBatch, &err)
+
+	results := make([]FindResult, len(tokens))
+	// indexes holds the positions in results of each stored token still to
+	// be looked up in the database.
+	indexes := make(map[string][]int, len(tokens))
+	keys := make([]string, 0, len(tokens))
+	for i, token := range tokens {
+		results[i].Token = token
+		key := p.normalizeToken(token)
+		if key == "" || p.tokenTooLong(token) {
+			continue
+		}
+		if _, ok := indexes[key]; ok {
+			indexes[key] = append(indexes[key], i)
+			continue
+		}
+		if p.writeBehind != nil {
+			if b, exists, ok := p.findBuffered(token); ok {
+				p.countFind(exists)
+				if exists {
+					p.countAccess(key)
+				}
+				results[i].Data = b
+				results[i].Found = exists
+				continue
+			}
+		}
+		indexes[key] = []int{i}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return results, nil
+	}
+
+	conn, put, err := p.take(context.Background(), OpFindBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if err := p.findBatch(conn, keys, indexes, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// findBatch fills in results for the active sessions of the given stored
+// tokens, findBatchSize tokens at a time.
+func (p *SQLitexStore) findBatch(conn *sqlite.Conn, keys []string, indexes map[string][]int, results []FindResult) (err error) {
+	defer p.checkCorrupt(&err)
+
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > findBatchSize {
+			chunk = chunk[:findBatchSize]
+		}
+		keys = keys[len(chunk):]
+
+		var found int
+		var query strings.Builder
+		query.WriteString(p.q.findTokens)
+		query.WriteString("(")
+		args := make([]any, len(chunk))
+		for i, key := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("$" + strconv.Itoa(i+1))
+			args[i] = key
+		}
+		query.WriteString(")")
+
+		// The query varies with the chunk size, so it is not cached.
+		err = sqlitex.ExecuteTransient(conn, query.String(),
+			&sqlitex.ExecOptions{
+				Args: args,
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					key := stmt.ColumnText(0)
+					b, err := p.columnData(stmt, 1, key)
+					if err != nil {
+						return err
+					}
+					found++
+					p.countAccess(key)
+					for n, i := range indexes[key] {
+						// Repeated tokens get their own copy of the
+						// data.
+						if n > 0 {
+							b = append([]byte(nil), b...)
+						}
+						results[i].Data = b
+						results[i].Found = true
+					}
+					return nil
+				},
+			})
+		if err != nil {
+			return err
+		}
+		for i := range chunk {
+			p.countFind(i < found)
+		}
+	}
+	return nil
+}
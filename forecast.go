@@ -0,0 +1,89 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ExpiryForecast counts the active sessions which will expire within each of
+// the given durations from now, such as to forecast the load of users logging
+// in again. The counts are cumulative: each is the number of sessions expiring
+// before the current time plus the corresponding bucket, so a session counted
+// for one minute is also counted for five. The counts are returned in the
+// order of buckets, and are all found by a single query over the expiry
+// index.
+func (p *SQLitexStore) ExpiryForecast(buckets []time.Duration) (counts []int, err error) {
+	defer p.logSlow(OpExpiryForecast, 0, time.Now())
+	defer p.wrapError(OpExpiryForecast, &err)
+	defer p.checkCorrupt(&err)
+
+	counts = make([]int, len(buckets))
+	if len(buckets) == 0 {
+		return counts, nil
+	}
+	now := time.Now()
+	args := make([]any, 0, len(buckets)+1)
+	var longest time.Duration
+	for _, d := range buckets {
+		args = append(args, p.encodeExpiry(now.Add(d)))
+		if d > longest {
+			longest = d
+		}
+	}
+	// Only sessions expiring within the longest bucket are scanned.
+	args = append(args, p.encodeExpiry(now.Add(longest)))
+
+	conn, put, err := p.take(context.Background(), OpExpiryForecast)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	// The query varies with the number of buckets, so it is not cached.
+	err = sqlitex.ExecuteTransient(conn, p.forecastQuery(len(buckets)),
+		&sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				for i := range counts {
+					counts[i] = stmt.ColumnInt(i)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// forecastQuery returns the query run by ExpiryForecast for n buckets, which
+// sums the sessions expiring before each of $1 to $n, scanning those expiring
+// before $n+1.
+func (p *SQLitexStore) forecastQuery(n int) string {
+	e := p.expiryEncoding
+	var query strings.Builder
+	query.WriteString(p.label)
+	query.WriteString("SELECT ")
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			query.WriteString(", ")
+		}
+		fmt.Fprintf(&query, "COALESCE(SUM(expiry < %s), 0)", e.param(fmt.Sprintf("$%d", i)))
+	}
+	fmt.Fprintf(&query, " FROM %s WHERE %s < expiry AND expiry < %s",
+		p.table, e.Now, e.param(fmt.Sprintf("$%d", n+1)))
+	return query.String()
+}
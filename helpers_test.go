@@ -0,0 +1,64 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// newPool returns a pool of connections to a new database file, which is
+// closed when the test completes. Tests which need to change rows behind the
+// store's back use it rather than zqlsessiontest.NewMemoryStore.
+func newPool(t testing.TB) *sqlitex.Pool {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 4})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("close database: %v", err)
+		}
+	})
+	return db
+}
+
+// newStore returns a store of db created with zqlsession.NewE and opts, with
+// its table created, which is shut down when the test completes.
+func newStore(t testing.TB, db *sqlitex.Pool, opts ...zqlsession.Option) *zqlsession.SQLitexStore {
+	t.Helper()
+
+	opts = append([]zqlsession.Option{zqlsession.WithAutoMigrate()}, opts...)
+	store, err := zqlsession.NewE(db, opts...)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := store.Shutdown(context.Background()); err != nil {
+			t.Errorf("shut down store: %v", err)
+		}
+	})
+	return store
+}
+
+// execute runs query, with args, on a connection from db.
+func execute(t testing.TB, db *sqlitex.Pool, query string, args ...any) {
+	t.Helper()
+
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take connection: %v", err)
+	}
+	defer db.Put(conn)
+
+	if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{Args: args}); err != nil {
+		t.Fatalf("execute %q: %v", query, err)
+	}
+}
@@ -0,0 +1,135 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// idempotencyKeys is the number of recent idempotency keys remembered
+	// by a store.
+	idempotencyKeys = 1024
+
+	// defaultIdempotencyWindow is how long an idempotency key is remembered
+	// when WithIdempotencyWindow is not given.
+	defaultIdempotencyWindow = time.Minute
+)
+
+// CommitIdempotent is like Commit, but skips the commit and returns applied as
+// false if a commit for the same token and idempotency key was already applied
+// recently. This makes a commit which may be delivered more than once, such as
+// by a retrying client, safe to apply.
+//
+// Keys are remembered in memory for the idempotency window (one minute unless
+// set with WithIdempotencyWindow), up to the most recent 1024 keys. Keeping
+// them in memory avoids an extra write per commit, but means deduplication
+// only applies within a single process and is lost on restart. If the commit
+// fails the key is forgotten, so that a retry may apply it.
+func (p *SQLitexStore) CommitIdempotent(token string, b []byte, expiry time.Time, key string) (applied bool, err error) {
+	defer p.logSlow(OpCommitIdempotent, len(token), time.Now())
+	defer p.wrapError(OpCommitIdempotent, &err)
+
+	if token == "" {
+		return false, ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return false, ErrTokenTooLong
+	}
+	if p.readOnly {
+		return false, ErrReadOnly
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return false, err
+	}
+	expiry = p.jitter(expiry)
+	id := p.normalizeToken(token) + "\x00" + key
+	if !p.idempotency.claim(id, time.Now(), p.idempotencyWindow) {
+		return false, nil
+	}
+
+	if p.writeBehind != nil {
+		if skip {
+			err = p.bufferDelete(token)
+		} else {
+			err = p.bufferCommit(token, b, expiry, false)
+		}
+		if err != nil {
+			p.idempotency.release(id)
+			return false, err
+		}
+		return true, nil
+	}
+	conn, put, err := p.take(context.Background(), OpCommitIdempotent)
+	if err != nil {
+		p.idempotency.release(id)
+		return false, err
+	}
+	defer put(&err)
+
+	if err := p.commitOrDelete(conn, token, b, expiry, skip); err != nil {
+		p.idempotency.release(id)
+		return false, err
+	}
+	return true, nil
+}
+
+// idempotencyRing remembers recently claimed keys in a fixed size ring.
+type idempotencyRing struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+	ring []idempotencyEntry
+	next int
+}
+
+type idempotencyEntry struct {
+	key string
+	at  time.Time
+}
+
+// claim records key as seen at now, returning false if it was already seen
+// within window.
+func (r *idempotencyRing) claim(key string, now time.Time, window time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+		r.ring = make([]idempotencyEntry, idempotencyKeys)
+	}
+	if at, ok := r.seen[key]; ok && now.Sub(at) < window {
+		return false
+	}
+
+	// Evict the oldest entry, unless its key has since been claimed again
+	// in a newer slot.
+	old := r.ring[r.next]
+	if at, ok := r.seen[old.key]; ok && at.Equal(old.at) {
+		delete(r.seen, old.key)
+	}
+	r.ring[r.next] = idempotencyEntry{key: key, at: now}
+	r.next = (r.next + 1) % len(r.ring)
+	r.seen[key] = now
+	return true
+}
+
+// release forgets key, so that it may be claimed again.
+func (r *idempotencyRing) release(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.seen, key)
+}
+
+// reset forgets every key.
+func (r *idempotencyRing) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seen = nil
+	r.ring = nil
+	r.next = 0
+}
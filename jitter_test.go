@@ -0,0 +1,50 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestExpiryJitter(t *testing.T) {
+	const jitter = time.Hour
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithExpiryJitter(jitter))
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := store.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	dump, _, err := store.DumpRow("token")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if dump.Expiry.Before(expiry.Add(-time.Second)) || !dump.Expiry.Before(expiry.Add(jitter)) {
+		t.Errorf("expiry: got %v, want within [%v, %v)", dump.Expiry, expiry, expiry.Add(jitter))
+	}
+}
+
+func TestExpiryJitterImport(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithExpiryJitter(time.Hour))
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	sessions := []zqlsession.SessionRecord{{Token: "token", Data: []byte("data"), Expiry: expiry}}
+	for _, mode := range []zqlsession.DataMode{zqlsession.Decoded, zqlsession.Verbatim} {
+		if err := store.Import(ctx, sessions, mode); err != nil {
+			t.Fatalf("import: %v", err)
+		}
+		dump, _, err := store.DumpRow("token")
+		if err != nil {
+			t.Fatalf("dump: %v", err)
+		}
+		// Imported sessions keep their expiry, to the stored precision.
+		if d := dump.Expiry.Sub(expiry); d < -time.Second || d > time.Second {
+			t.Errorf("import mode %v: expiry moved by %v", mode, d)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// deleteMatchingBatchSize is the number of sessions deleted by each
+// transaction of DeleteMatching.
+const deleteMatchingBatchSize = 500
+
+// DeleteMatching deletes every session, active or expired, whose token
+// matches re, returning the number deleted. It is a maintenance tool, for
+// example to purge the sessions issued by a compromised endpoint: SQLite has
+// no regular expressions, so every token in the table is read and matched in
+// Go, and the matches are then deleted in batches, each in its own
+// transaction. With WithTokenPrefix, re is matched against tokens without the
+// prefix and only the store's own sessions are deleted. Writes buffered by
+// WithWriteBehind are flushed first.
+//
+// The scan reads the whole table in one read transaction, so on a large table
+// it is best run off-peak. If ctx is done between batches the sessions deleted
+// so far stay deleted.
+func (p *SQLitexStore) DeleteMatching(ctx context.Context, re *regexp.Regexp) (_ int, err error) {
+	defer p.logSlow(OpDeleteMatching, 0, time.Now())
+	defer p.wrapError(OpDeleteMatching, &err)
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+	conn, put, err := p.take(ctx, OpDeleteMatching)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return 0, err
+		}
+	}
+	var matches []string
+	err = sqlitex.Execute(conn, p.q.allTokens,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				stored := stmt.ColumnText(0)
+				if token, ok := p.stripPrefix(stored); ok && re.MatchString(token) {
+					matches = append(matches, stored)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for len(matches) > 0 {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		chunk := matches
+		if len(chunk) > deleteMatchingBatchSize {
+			chunk = chunk[:deleteMatchingBatchSize]
+		}
+		matches = matches[len(chunk):]
+
+		n, err := p.deleteTokens(conn, chunk)
+		if n > 0 {
+			deleted += n
+			p.lifecycle(OpSessionDeleted, n)
+		}
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// deleteTokens deletes the sessions of the given stored tokens in one
+// transaction.
+func (p *SQLitexStore) deleteTokens(conn *sqlite.Conn, tokens []string) (n int, err error) {
+	defer p.checkCorrupt(&err)
+	defer sqlitex.Save(conn)(&err)
+
+	var query strings.Builder
+	query.WriteString(p.q.deleteTokens)
+	query.WriteString("(")
+	args := make([]any, len(tokens))
+	for i, token := range tokens {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("$" + strconv.Itoa(i+1))
+		args[i] = token
+	}
+	query.WriteString(")")
+
+	// The query varies with the batch size, so it is not cached.
+	err = sqlitex.ExecuteTransient(conn, query.String(),
+		&sqlitex.ExecOptions{
+			Args: args,
+		})
+	if err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
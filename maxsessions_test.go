@@ -0,0 +1,52 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestMaxSessions(t *testing.T) {
+	const max = 10
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithMaxSessions(max))
+
+	// Commit from several goroutines, each session expiring later than the
+	// last, so that the cap must evict the earliest.
+	start := time.Now().Add(time.Hour)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				token := fmt.Sprint("token", w, "-", i)
+				expiry := start.Add(time.Duration(i) * time.Minute)
+				if err := store.Commit(token, []byte("data"), expiry); err != nil {
+					t.Errorf("commit %q: %v", token, err)
+					return
+				}
+				if _, total, err := store.Counts(); err != nil || total > max {
+					t.Errorf("counts: got %d, %v, want at most %d", total, err, max)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if n, err := store.Count(); err != nil || n != max {
+		t.Fatalf("count: got %d, %v, want %d", n, err, max)
+	}
+	// The sessions expiring last survive.
+	for w := 0; w < 4; w++ {
+		if _, found, _ := store.Find(fmt.Sprint("token", w, "-", 24)); !found {
+			t.Errorf("latest session of writer %d was evicted", w)
+		}
+	}
+}
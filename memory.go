@@ -0,0 +1,56 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// memoryPoolSize is the number of connections to the database of a store
+// created by NewMemory.
+const memoryPoolSize = 4
+
+// memoryDBs numbers the databases of stores created by NewMemory, so that
+// each store has a database of its own.
+var memoryDBs atomic.Int64
+
+// NewMemory returns a store backed by a new in-memory database, for tests and
+// ephemeral deployments, with its table already created and a background
+// cleanup running every cleanupInterval, or none if it is 0.
+//
+// Every connection to an in-memory database usually has a database of its
+// own, and the database is freed when its last connection closes. NewMemory
+// opens a pool of 4 connections sharing one database through SQLite's shared
+// cache, under a name unique to the store, so that sessions committed on one
+// connection are seen on the others, while stores created by separate calls
+// never share sessions. The pool is kept open for the life of the store and
+// closed by Shutdown, which discards the database; StopCleanup leaves it open.
+func NewMemory(cleanupInterval time.Duration, opts ...Option) (*SQLitexStore, error) {
+	uri := fmt.Sprintf("file:zqlsession-%d?mode=memory&cache=shared",
+		memoryDBs.Add(1))
+	// These are the pool's default flags with the shared cache. An
+	// in-memory database ignores the WAL flag, keeping its journal in
+	// memory.
+	db, err := sqlitex.NewPool(uri, sqlitex.PoolOptions{
+		Flags: sqlite.OpenReadWrite | sqlite.OpenCreate | sqlite.OpenWAL |
+			sqlite.OpenURI | sqlite.OpenSharedCache,
+		PoolSize: memoryPoolSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]Option{WithAutoMigrate(), WithPoolSize(memoryPoolSize)}, opts...)
+	p, err := newStore(db, cleanupInterval, opts)
+	p.ownsPool = true
+	if err != nil {
+		p.Shutdown(context.Background())
+		return nil, err
+	}
+	return p, nil
+}
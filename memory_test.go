@@ -0,0 +1,63 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+func newMemory(t *testing.T, opts ...zqlsession.Option) *zqlsession.SQLitexStore {
+	t.Helper()
+
+	store, err := zqlsession.NewMemory(0, opts...)
+	if err != nil {
+		t.Fatalf("new memory store: %v", err)
+	}
+	t.Cleanup(func() { store.Shutdown(context.Background()) })
+	return store
+}
+
+func TestNewMemory(t *testing.T) {
+	a := newMemory(t)
+	b := newMemory(t)
+
+	if err := a.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, found, _ := b.Find("token"); found {
+		t.Error("stores created by separate calls share sessions")
+	}
+
+	// Each concurrent Find takes its own connection from the pool, and
+	// every connection sees the session.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, found, err := a.Find("token"); err != nil || !found || string(got) != "data" {
+				t.Errorf("find: got %q, %v, %v, want %q", got, found, err, "data")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNewMemoryShutdown(t *testing.T) {
+	store, err := zqlsession.NewMemory(0)
+	if err != nil {
+		t.Fatalf("new memory store: %v", err)
+	}
+	if err := store.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shut down: %v", err)
+	}
+	if _, _, err := store.Find("token"); !errors.Is(err, zqlsession.ErrClosed) {
+		t.Errorf("find after shutdown: got %v, want ErrClosed", err)
+	}
+}
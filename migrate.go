@@ -0,0 +1,113 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// CurrentSchemaVersion is the version of the schema created by CreateTable, as
+// recorded by WithSchemaVersion. It is increased whenever the schema changes
+// in a way which existing tables must be migrated for.
+const CurrentSchemaVersion = 3
+
+// SchemaVersion returns the schema version recorded in the database's PRAGMA
+// user_version by CreateTable with the WithSchemaVersion option, or 0 if none
+// has been recorded, so that migrations can tell which schema a database is
+// on.
+func (p *SQLitexStore) SchemaVersion(ctx context.Context) (_ int, err error) {
+	defer p.wrapError(OpSchemaVersion, &err)
+
+	conn, put, err := p.take(ctx, OpSchemaVersion)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	return schemaVersion(conn)
+}
+
+func schemaVersion(conn *sqlite.Conn) (int, error) {
+	var version int
+	err := sqlitex.ExecuteTransient(conn, "PRAGMA user_version",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				version = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+	return version, err
+}
+
+// setSchemaVersion records version in user_version, unless a later version is
+// already recorded.
+func setSchemaVersion(conn *sqlite.Conn, version int) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	current, err := schemaVersion(conn)
+	if err != nil || current >= version {
+		return err
+	}
+	return sqlitex.ExecuteTransient(conn, fmt.Sprintf("PRAGMA user_version = %d", version), nil)
+}
+
+// migrateBatchSize is the number of rows converted in each transaction by
+// MigrateExpiryFormat.
+const migrateBatchSize = 1000
+
+// ErrNotUnixExpiry is returned by MigrateExpiryFormat when the store was not
+// created with the WithUnixExpiry option.
+var ErrNotUnixExpiry = errors.New("zqlsession: store does not use unix expiry")
+
+// MigrateExpiryFormat rewrites expiry values stored in the legacy julianday
+// format to integer unix seconds, as used by the WithUnixExpiry option. Rows
+// are converted in batches, each in its own transaction.
+//
+// Legacy rows are detected by value: any julianday up to the year 9999 is far
+// smaller than the unix time of any date after 1973. This makes the migration
+// idempotent and safe to run on an already migrated table. It should be run
+// right after the store is created, before it starts serving requests.
+func (p *SQLitexStore) MigrateExpiryFormat(ctx context.Context) (err error) {
+	defer p.logSlow(OpMigrateExpiryFormat, 0, time.Now())
+	defer p.wrapError(OpMigrateExpiryFormat, &err)
+
+	if !p.unixExpiry() {
+		return ErrNotUnixExpiry
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(ctx, OpMigrateExpiryFormat)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	for {
+		n, err := p.migrateExpiryBatch(conn)
+		if err != nil {
+			return err
+		}
+		if n < migrateBatchSize {
+			return nil
+		}
+	}
+}
+
+func (p *SQLitexStore) migrateExpiryBatch(conn *sqlite.Conn) (n int, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	err = sqlitex.Execute(conn, p.q.migrateExpiry, &sqlitex.ExecOptions{
+		Args: []any{migrateBatchSize},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
@@ -0,0 +1,137 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+func TestMigrateExpiryFormat(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	legacy := newStore(t, db)
+
+	// More than a batch of rows, some of them expired.
+	const n = 1500
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	sessions := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		sessions[fmt.Sprint("token", i)] = []byte(fmt.Sprint("data", i))
+	}
+	if err := legacy.CommitAll(sessions, expiry); err != nil {
+		t.Fatalf("commit all: %v", err)
+	}
+	err := legacy.Import(ctx, []zqlsession.SessionRecord{
+		{Token: "expired", Data: []byte("data"), Expiry: time.Now().Add(-time.Hour)},
+	}, zqlsession.Decoded)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	store := newStore(t, db, zqlsession.WithUnixExpiry())
+	// Before the migration legacy expiry values read as long expired.
+	if _, found, _ := store.Find("token0"); found {
+		t.Fatal("found a legacy session before migrating")
+	}
+	if err := store.MigrateExpiryFormat(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	for token, want := range sessions {
+		b, found, err := store.Find(token)
+		if err != nil || !found || string(b) != string(want) {
+			t.Fatalf("find %q: got %q, %v, %v, want %q", token, b, found, err, want)
+		}
+	}
+	dump, _, err := store.DumpRow("token0")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if !dump.Expiry.Equal(expiry) {
+		t.Errorf("expiry: got %v, want %v", dump.Expiry, expiry)
+	}
+	if _, found, _ := store.Find("expired"); found {
+		t.Error("found an expired session after migrating")
+	}
+
+	// Migrating again changes nothing.
+	if err := store.MigrateExpiryFormat(ctx); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	if again, _, _ := store.DumpRow("token0"); !again.Expiry.Equal(expiry) {
+		t.Errorf("expiry after migrating again: got %v, want %v", again.Expiry, expiry)
+	}
+}
+
+func TestMigrateExpiryFormatJulian(t *testing.T) {
+	store := newStore(t, newPool(t))
+
+	err := store.MigrateExpiryFormat(context.Background())
+	if !errors.Is(err, zqlsession.ErrNotUnixExpiry) {
+		t.Errorf("migrate: got %v, want ErrNotUnixExpiry", err)
+	}
+}
+
+func TestAutoMigrate(t *testing.T) {
+	db := newPool(t)
+	store, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate())
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	defer store.Shutdown(context.Background())
+
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got, _, err := store.Find("token"); err != nil || string(got) != "data" {
+		t.Errorf("find: got %q, %v, want %q", got, err, "data")
+	}
+
+	// Migrating again is harmless.
+	again, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate())
+	if err != nil {
+		t.Fatalf("new store on a migrated database: %v", err)
+	}
+	defer again.Shutdown(context.Background())
+	if _, found, _ := again.Find("token"); !found {
+		t.Error("migrating again lost the session")
+	}
+}
+
+func TestAutoMigrateError(t *testing.T) {
+	db := newPool(t)
+	// A view cannot be indexed, so the schema cannot be created.
+	execute(t, db, "CREATE VIEW sessions AS SELECT 1 AS token;")
+	if _, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate()); err == nil {
+		t.Error("new store: got nil, want the schema error")
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	plain := newStore(t, db)
+	if v, err := plain.SchemaVersion(ctx); err != nil || v != 0 {
+		t.Fatalf("schema version without the option: got %d, %v, want 0", v, err)
+	}
+
+	store := newStore(t, db, zqlsession.WithSchemaVersion())
+	if v, err := store.SchemaVersion(ctx); err != nil || v != zqlsession.CurrentSchemaVersion {
+		t.Errorf("schema version: got %d, %v, want %d", v, err, zqlsession.CurrentSchemaVersion)
+	}
+
+	// A later version, such as from a newer release, is never lowered.
+	execute(t, db, fmt.Sprintf("PRAGMA user_version = %d", zqlsession.CurrentSchemaVersion+1))
+	if err := store.CreateTable(ctx); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	if v, err := store.SchemaVersion(ctx); err != nil || v != zqlsession.CurrentSchemaVersion+1 {
+		t.Errorf("schema version after a later one: got %d, %v, want %d",
+			v, err, zqlsession.CurrentSchemaVersion+1)
+	}
+}
@@ -0,0 +1,162 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Move moves the session for token from the store to dst, keeping its data
+// and expiry, for example to migrate sessions from a legacy table one at a
+// time. It returns false if the session was not found in the store. The data
+// is decoded by the store's codec and committed to dst as Commit would.
+//
+// When both stores use the same pool the session is read, committed to dst
+// and deleted from the store in one transaction, so it is never in both or
+// neither. Otherwise the session is read, committed to dst and then deleted
+// from the store, holding a connection from only one of the pools at a time:
+// if the commit fails nothing is changed, but if the delete fails the error is
+// returned with the session in both stores, and a write to the session in the
+// store between the steps is lost.
+func (p *SQLitexStore) Move(ctx context.Context, dst *SQLitexStore, token string) (_ bool, err error) {
+	defer p.logSlow(OpMove, len(token), time.Now())
+	defer p.wrapError(OpMove, &err)
+
+	if token == "" {
+		return false, nil
+	}
+	if p.tokenTooLong(token) {
+		return false, ErrTokenTooLong
+	}
+	if p.readOnly || dst.readOnly {
+		return false, ErrReadOnly
+	}
+	if p.pool() == dst.pool() {
+		conn, put, err := p.take(ctx, OpMove)
+		if err != nil {
+			return false, err
+		}
+		defer put(&err)
+
+		if p.writeBehind != nil {
+			if err := p.flush(conn); err != nil {
+				return false, err
+			}
+		}
+		return p.moveOn(conn, dst, token)
+	}
+
+	// No connection is held while taking one from the other store's pool,
+	// so that moves in opposite directions cannot deadlock.
+	b, expiry, found, err := p.moveRead(ctx, token)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := dst.moveCommit(ctx, token, b, expiry); err != nil {
+		return false, err
+	}
+	conn, put, err := p.take(ctx, OpMove)
+	if err != nil {
+		return false, err
+	}
+	defer put(&err)
+
+	if err := p.delete(conn, token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// moveRead reads the session Move moves to a store using another pool.
+func (p *SQLitexStore) moveRead(ctx context.Context, token string) (_ []byte, _ time.Time, _ bool, err error) {
+	conn, put, err := p.take(ctx, OpMove)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, time.Time{}, false, err
+		}
+	}
+	return p.findExpiry(conn, token)
+}
+
+// moveCommit commits the session Move moves from a store using another pool.
+func (p *SQLitexStore) moveCommit(ctx context.Context, token string, b []byte, expiry time.Time) (err error) {
+	conn, put, err := p.take(ctx, OpMove)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+	return p.commit(conn, token, b, expiry)
+}
+
+// moveOn moves a session to dst, whose table is in the same database, in one
+// transaction on conn.
+func (p *SQLitexStore) moveOn(conn *sqlite.Conn, dst *SQLitexStore, token string) (_ bool, err error) {
+	// A buffered write to dst could otherwise later overwrite the session.
+	if dst != p && dst.writeBehind != nil {
+		if err := dst.flush(conn); err != nil {
+			return false, err
+		}
+	}
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return false, err
+	}
+	defer endFn(&err)
+
+	b, expiry, found, err := p.findExpiry(conn, token)
+	if err != nil || !found {
+		return false, err
+	}
+	if dst == p {
+		return true, nil
+	}
+	// The session is deleted first, so that a dst sharing the table, such
+	// as one with a different WithTokenPrefix, is not affected.
+	if err := p.delete(conn, token); err != nil {
+		return false, err
+	}
+	if err := dst.commit(conn, token, b, expiry); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// findExpiry returns the data and expiry of an active session.
+func (p *SQLitexStore) findExpiry(conn *sqlite.Conn, token string) (b []byte, expiry time.Time, found bool, err error) {
+	defer p.checkCorrupt(&err)
+
+	token = p.normalizeToken(token)
+	if token == "" {
+		return nil, time.Time{}, false, nil
+	}
+	err = sqlitex.Execute(conn, p.q.findExpiry,
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				found = true
+				expiry = p.decodeExpiry(stmt, 1)
+				b, err = p.columnData(stmt, 0, token)
+				return err
+			},
+		})
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	p.countFind(found)
+	return b, expiry, found, nil
+}
@@ -0,0 +1,99 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	src := zqlsessiontest.NewMemoryStore(t)
+	dst := zqlsessiontest.NewMemoryStore(t)
+
+	if err := src.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	moved, err := src.Move(ctx, dst, "token")
+	if err != nil || !moved {
+		t.Fatalf("move: got %v, %v, want true", moved, err)
+	}
+	if _, found, _ := src.Find("token"); found {
+		t.Error("session is still in the source store")
+	}
+	if b, found, _ := dst.Find("token"); !found || string(b) != "data" {
+		t.Errorf("find in destination: got %q, %v, want %q", b, found, "data")
+	}
+	if moved, err := src.Move(ctx, dst, "missing"); err != nil || moved {
+		t.Errorf("move missing: got %v, %v, want false", moved, err)
+	}
+}
+
+func TestMoveKeepsExpiry(t *testing.T) {
+	ctx := context.Background()
+	src := zqlsessiontest.NewMemoryStore(t)
+	dst := zqlsessiontest.NewMemoryStore(t, zqlsession.WithExpiryJitter(time.Hour))
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := src.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, err := src.Move(ctx, dst, "token"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	dump, _, err := dst.DumpRow("token")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if d := dump.Expiry.Sub(expiry); d < -time.Second || d > time.Second {
+		t.Errorf("expiry moved by %v", d)
+	}
+}
+
+// TestMoveOpposite moves sessions both ways between two stores which run one
+// operation at a time, which deadlocks if a move holds a connection to one
+// store while waiting for the other.
+func TestMoveOpposite(t *testing.T) {
+	const n = 50
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a := newStore(t, newPool(t), zqlsession.WithMaxConcurrency(1))
+	b := newStore(t, newPool(t), zqlsession.WithMaxConcurrency(1))
+
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < n; i++ {
+		if err := a.Commit(fmt.Sprint("a", i), []byte("data"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if err := b.Commit(fmt.Sprint("b", i), []byte("data"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	var wg sync.WaitGroup
+	move := func(src, dst *zqlsession.SQLitexStore, prefix string) {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if _, err := src.Move(ctx, dst, fmt.Sprint(prefix, i)); err != nil {
+				t.Errorf("move: %v", err)
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go move(a, b, "a")
+	go move(b, a, "b")
+	wg.Wait()
+
+	for _, s := range []*zqlsession.SQLitexStore{a, b} {
+		if n2, err := s.Count(); err != nil || n2 != n {
+			t.Errorf("count: got %d, %v, want %d", n2, err, n)
+		}
+	}
+}
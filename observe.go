@@ -0,0 +1,142 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import "time"
+
+// Op identifies the kind of store operation an Event describes.
+type Op string
+
+// The operations reported to observers and in slow operation logs. Most are
+// named after the store method they describe.
+const (
+	OpFind                Op = "find"
+	OpFindAndMaybeTouch   Op = "find_and_maybe_touch"
+	OpTouchBatch          Op = "touch_batch"
+	OpExists              Op = "exists"
+	OpCommit              Op = "commit"
+	OpCommitIdempotent    Op = "commit_idempotent"
+	OpFindVersion         Op = "find_version"
+	OpCommitVersion       Op = "commit_version"
+	OpDelete              Op = "delete"
+	OpDumpRow             Op = "dump_row"
+	OpAll                 Op = "all"
+	OpCount               Op = "count"
+	OpCounts              Op = "counts"
+	OpAllOrderedByCreated Op = "all_ordered_by_created"
+	OpStreamJSON          Op = "stream_json"
+	OpIterate             Op = "iterate"
+	OpExpiringWithin      Op = "expiring_within"
+	OpAllExpiringBetween  Op = "all_expiring_between"
+	OpExpiredSessions     Op = "expired_sessions"
+	OpFindBatch           Op = "find_batch"
+	OpFindByPrefix        Op = "find_by_prefix"
+	OpAllWithTTL          Op = "all_with_ttl"
+	OpExpiryForecast      Op = "expiry_forecast"
+	OpDeleteExpired       Op = "delete_expired"
+	OpDeleteByPrefix      Op = "delete_by_prefix"
+	OpDeleteMatching      Op = "delete_matching"
+	OpTx                  Op = "tx"
+	OpFindOrCommit        Op = "find_or_commit"
+	OpSwap                Op = "swap"
+	OpMove                Op = "move"
+	OpDedupeByUserID      Op = "dedupe_by_user_id"
+	OpSessionCountsByUser Op = "session_counts_by_user"
+	OpIterateByUserID     Op = "iterate_by_user_id"
+	OpMigrateExpiryFormat Op = "migrate_expiry_format"
+	OpReset               Op = "reset"
+	OpReplaceAll          Op = "replace_all"
+	OpExport              Op = "export"
+	OpImport              Op = "import"
+	OpExportOne           Op = "export_one"
+	OpImportOne           Op = "import_one"
+	OpCommitAll           Op = "commit_all"
+	OpIntegrityCheck      Op = "integrity_check"
+	OpFragmentation       Op = "fragmentation"
+	OpCreateTable         Op = "create_table"
+	OpSchemaVersion       Op = "schema_version"
+	OpCheckExpiryIndex    Op = "check_expiry_index"
+	OpFlush               Op = "flush"
+	OpWarm                Op = "warm"
+
+	// OpCleanup is a run of the background cleanup goroutine.
+	OpCleanup Op = "cleanup"
+
+	// OpCorrupt is reported once, with the error from SQLite, when the
+	// store finds that the database is corrupt and stops working. See
+	// ErrCorrupt.
+	OpCorrupt Op = "corrupt"
+)
+
+// The session lifecycle events reported to observers, for counting session
+// churn. Each is reported once a session has been written, with Rows set to
+// the number of sessions affected, even if an enclosing transaction such as
+// WithTx is later rolled back.
+const (
+	// OpSessionCreated is a commit of a token with no active session.
+	OpSessionCreated Op = "session_created"
+	// OpSessionRefreshed is a commit which replaced an active session.
+	OpSessionRefreshed Op = "session_refreshed"
+	// OpSessionDeleted is an explicit delete of an existing session.
+	OpSessionDeleted Op = "session_deleted"
+	// OpSessionsExpired is the removal of expired sessions by
+	// DeleteExpired, whether run by the cleanup goroutine or directly.
+	OpSessionsExpired Op = "sessions_expired"
+)
+
+// Event describes a completed store operation. Events are passed to the
+// function given to WithObserver.
+//
+// An Event is sent for every operation which uses a connection from the pool,
+// once it has finished with the connection, with Wait set to the time spent
+// waiting for the connection and Duration to the time the operation then held
+// it, so that a slow pool can be told apart from slow queries. Err is the
+// error the operation returned, if any. If no connection could be taken, Err
+// is the reason and Wait how long was spent trying.
+type Event struct {
+	// Store is the name of the store, see WithName.
+	Store string
+	Op    Op
+	// Duration is how long the operation took, or for a connection held
+	// by an operation, how long it was held.
+	Duration time.Duration
+	// Wait is how long the operation waited to take a connection from the
+	// pool, including any wait for WithMaxConcurrency.
+	Wait time.Duration
+	// Rows is the number of rows affected, such as how many expired
+	// sessions a cleanup deleted. It is reported even when zero.
+	Rows int
+	Err  error
+}
+
+// WithObserver calls fn with an Event after each observed store operation, for
+// example to record metrics. fn is called synchronously and must be safe for
+// concurrent use, so it should be quick.
+//
+// Observing lifecycle events, such as OpSessionCreated, costs an extra lookup
+// per commit to tell new sessions from refreshed ones.
+func WithObserver(fn func(Event)) Option {
+	return func(p *SQLitexStore) {
+		p.observer = fn
+	}
+}
+
+func (p *SQLitexStore) observe(e Event) {
+	if p.observer == nil {
+		return
+	}
+	e.Store = p.name
+	p.observer(e)
+}
+
+// logSlow logs op if it started longer ago than the WithSlowLog threshold. It
+// is deferred at the start of each operation.
+func (p *SQLitexStore) logSlow(op Op, tokenLen int, start time.Time) {
+	if p.slowThreshold <= 0 {
+		return
+	}
+	if d := time.Since(start); d > p.slowThreshold {
+		p.logger.Printf("zqlsession: %s: slow %s took %v (token length %d)",
+			p.name, op, d, tokenLen)
+	}
+}
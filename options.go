@@ -0,0 +1,415 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Option configures optional behaviour of a SQLitexStore. Options are passed
+// to New or NewWithCleanupInterval.
+type Option func(*SQLitexStore)
+
+// identifierRe matches the table and column names accepted by WithTableName
+// and WithUserForeignKey.
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// WithName labels the store, so that log messages from several stores can be
+// told apart. The name defaults to the table name.
+//
+// The name is also put in a comment at the start of every query the store
+// runs, such as /* store: admin */, so that SQLite's logs, EXPLAIN output and
+// other tools showing the SQL can attribute it to the store.
+func WithName(name string) Option {
+	return func(p *SQLitexStore) {
+		p.name = name
+	}
+}
+
+// WithTableName stores sessions in the named table rather than the default
+// sessions table. Index names are derived from the table name, for example
+// the expiry index of a table named admin is admin_expiry_idx. The name must
+// be a plain SQL identifier made up of letters, digits and underscores;
+// WithTableName panics otherwise.
+func WithTableName(table string) Option {
+	if !identifierRe.MatchString(table) {
+		panic(fmt.Sprintf("zqlsession: invalid table name %q", table))
+	}
+	return func(p *SQLitexStore) {
+		p.table = table
+	}
+}
+
+// WithAutoMigrate creates the store's table and indexes when the store is
+// created, as CreateTable does, so that a new database needs no separate setup
+// step. Use NewE to be told if this fails; the other constructors log the
+// error and return the store anyway.
+func WithAutoMigrate() Option {
+	return func(p *SQLitexStore) {
+		p.autoMigrate = true
+	}
+}
+
+// WithSchemaVersion makes CreateTable record the version of the schema it
+// created, CurrentSchemaVersion, in the database's PRAGMA user_version, for
+// reading back with SchemaVersion. The version is never lowered. As
+// user_version belongs to the whole database, this must not be used if the
+// application keeps its own version there.
+func WithSchemaVersion() Option {
+	return func(p *SQLitexStore) {
+		p.schemaVersion = true
+	}
+}
+
+// WithoutCleanup stops the store from starting a background cleanup goroutine,
+// the same as a cleanup interval of 0 but clearer at the call site, for
+// embedding the store where no goroutines may be left running. Expired
+// sessions are still never returned: Find, All and every other read compare
+// each session's expiry with the current time, whether or not cleanup runs.
+// Their rows stay in the database until DeleteExpired is called, which the
+// application should do from time to time.
+func WithoutCleanup() Option {
+	return func(p *SQLitexStore) {
+		p.withoutCleanup = true
+	}
+}
+
+// WithCleanupSchedule runs the background cleanup at the times returned by next
+// rather than at a fixed interval, for example daily at 3am to keep its writes
+// away from peak traffic. next is called with the current time when the store
+// is created and after each cleanup, and returns the time of the next one. If
+// it returns the zero time no further cleanups are scheduled.
+//
+// The schedule replaces the cleanup interval, even one of 0, and a Cleaner
+// given to NewWithCleaner. It has no effect with WithoutCleanup.
+func WithCleanupSchedule(next func(now time.Time) time.Time) Option {
+	return func(p *SQLitexStore) {
+		p.cleanupSchedule = next
+	}
+}
+
+// WithExpiryJitter adds a random offset in the range [0, d) to the expiry time
+// of every committed session. Spreading out expiry times prevents sessions
+// created in a burst (such as after a deploy) from all expiring at the same
+// moment. A d of 0, the default, disables jitter. Sessions restored by Import,
+// ImportOne or ReplaceAll, or moved by Move, keep their expiry exactly.
+func WithExpiryJitter(d time.Duration) Option {
+	return func(p *SQLitexStore) {
+		if d < 0 {
+			d = 0
+		}
+		p.expiryJitter = d
+	}
+}
+
+// WithSequence records a monotonically increasing sequence number in the seq
+// column of the sessions table when a session is first committed. Updating
+// an existing session keeps its sequence number. Unlike timestamps, the
+// sequence gives sessions a total creation order which cannot tie or go
+// backwards with the wall clock.
+//
+// The sessions table must have a seq column, which is included in tables
+// created by CreateTable.
+func WithSequence() Option {
+	return func(p *SQLitexStore) {
+		p.sequence = true
+	}
+}
+
+// WithUnixExpiry stores expiry times as integer unix seconds rather than
+// julianday values. Sub-second precision is dropped, so sessions may expire up
+// to a second before their expiry time. Existing databases written without
+// this option must be converted with MigrateExpiryFormat before the store is
+// used, otherwise their sessions appear expired. It is the same as
+// WithExpiryEncoding(UnixExpiry).
+func WithUnixExpiry() Option {
+	return func(p *SQLitexStore) {
+		p.expiryEncoding = UnixExpiry
+	}
+}
+
+// WithUserID records which user a session belongs to in the user_id column.
+// The function is called with the session data on every commit and should
+// return the ID of the session's user, or an empty string if the session is
+// not associated with a user (in which case user_id is set to NULL). For
+// example, with scs the data can be decoded with scs.GobCodec to read the key
+// your application stores the authenticated user ID under.
+func WithUserID(fn func(b []byte) string) Option {
+	return func(p *SQLitexStore) {
+		p.userID = fn
+	}
+}
+
+// WithTokenNormalizer applies fn to every token passed to the store before it
+// is stored or queried, for example strings.ToLower to make tokens case
+// insensitive. Changing the normalizer for an existing database can orphan
+// sessions whose stored tokens no longer match their normalized form; they
+// remain until they expire and are cleaned up.
+func WithTokenNormalizer(fn func(token string) string) Option {
+	return func(p *SQLitexStore) {
+		p.normalize = fn
+	}
+}
+
+// WithTokenPrefix namespaces the store's sessions within a table shared with
+// other stores, such as the stores of several applications. The prefix is
+// added to every token before it reaches the database, after any
+// WithTokenNormalizer function, and removed from the tokens returned by
+// methods such as All and Export, which skip the sessions of other
+// namespaces. Reset, ReplaceAll, DeleteByPrefix and DedupeByUserID only delete
+// the store's own sessions, and SessionCountsByUser only counts them. Methods which do not deal in tokens, such as Count and
+// DeleteExpired, still cover the whole table. The prefix counts towards the
+// WithMaxTokenLength limit.
+func WithTokenPrefix(prefix string) Option {
+	return func(p *SQLitexStore) {
+		p.tokenPrefix = prefix
+	}
+}
+
+// WithSplitData keeps session data in a separate table from the token and
+// expiry, so that token lookups and expiry scans only touch small rows. This
+// helps when session data is large. The tables must be created with
+// SchemaSplitData, which CreateTable does when this option is used; the data
+// table is named after the session table with a _data suffix.
+func WithSplitData() Option {
+	return func(p *SQLitexStore) {
+		p.splitData = true
+	}
+}
+
+// WithLogger sets the logger used for the store's log messages, such as
+// cleanup errors. The default is the standard logger of the log package.
+func WithLogger(l *log.Logger) Option {
+	return func(p *SQLitexStore) {
+		p.logger = l
+	}
+}
+
+// WithSlowLog logs a warning, including the operation name and token length,
+// for any store operation which takes longer than threshold. A threshold of 0,
+// the default, disables slow operation logging.
+func WithSlowLog(threshold time.Duration) Option {
+	return func(p *SQLitexStore) {
+		p.slowThreshold = threshold
+	}
+}
+
+// WithIdempotencyWindow sets how long CommitIdempotent remembers an
+// idempotency key. The default is one minute.
+func WithIdempotencyWindow(d time.Duration) Option {
+	return func(p *SQLitexStore) {
+		p.idempotencyWindow = d
+	}
+}
+
+// WithTokenGenerator replaces the generator used by NewToken, for example with
+// a deterministic one in tests. Generated tokens should be unguessable.
+func WithTokenGenerator(fn func() (string, error)) Option {
+	return func(p *SQLitexStore) {
+		p.tokenGenerator = fn
+	}
+}
+
+// WithExpiredArchive moves expired sessions into an archive table during
+// cleanup rather than dropping them, so that they can be inspected later, for
+// example to find out why a user was logged out. Archived sessions are kept
+// for retention and then purged. The archive table is named after the session
+// table with an _archive suffix and is created by CreateTable, see
+// SchemaArchive. A retention of 0, the default, disables archiving.
+func WithExpiredArchive(retention time.Duration) Option {
+	return func(p *SQLitexStore) {
+		p.archiveRetention = retention
+	}
+}
+
+// WithMaxSessions caps the total number of sessions in the store at n. When a
+// commit takes the store over the cap, the sessions with the earliest expiry
+// are deleted to make room, in the same transaction as the commit so the cap
+// is never overshot. This bounds storage when an attacker creates sessions
+// faster than they expire. An n of 0, the default, means no cap.
+//
+// Enforcing the cap counts the sessions table on every commit, so it is best
+// suited to modestly sized stores.
+func WithMaxSessions(n int) Option {
+	return func(p *SQLitexStore) {
+		p.maxSessions = n
+	}
+}
+
+// WithWriteBehind buffers Commit and Delete in memory and writes them to the
+// database in a single transaction every interval, or once maxBuffered tokens
+// have buffered writes, whichever is first. Rapid writes to the same token are
+// coalesced into one. This greatly reduces the number of transactions for
+// bursty, write heavy workloads. An interval of 0 flushes only when the buffer
+// is full, and a maxBuffered of 0 flushes only on the interval.
+//
+// Find consults the buffer before the database, so a process always sees its
+// own writes. All, Count, AllWithTTL and AllExpiringBetween apply the buffered
+// writes over the sessions read from the database, and the other methods
+// which read many sessions, such as Export, flush the buffer first, as do
+// WithTx and the writes of the On methods. DeleteExpired only sees writes
+// which have been flushed.
+//
+// Buffered writes are not durable: writes made since the last flush are lost
+// if the process exits without calling Shutdown, which flushes the buffer, or
+// Flush. A failed flush is logged and retried on the next flush.
+func WithWriteBehind(interval time.Duration, maxBuffered int) Option {
+	return func(p *SQLitexStore) {
+		p.writeBehind = &writeBehind{
+			interval:    interval,
+			maxBuffered: maxBuffered,
+		}
+	}
+}
+
+// WithAcquireTimeout limits how long an operation waits to take a connection
+// from the pool to d, after which it fails with ErrPoolTimeout. This bounds
+// the wait when the pool is saturated, separately from any deadline on the
+// operation's context, which still applies to running the query. A d of 0,
+// the default, waits until the operation's context is done.
+func WithAcquireTimeout(d time.Duration) Option {
+	return func(p *SQLitexStore) {
+		p.acquireTimeout = d
+	}
+}
+
+// WithAfterCleanup calls fn at the end of every run of the background cleanup
+// goroutine, with the number of expired sessions deleted, how long the run
+// took and its error, if any. fn runs inline on the cleanup goroutine, so the
+// next run is delayed until it returns and it should hand off any slow work,
+// such as a vacuum, to another goroutine.
+func WithAfterCleanup(fn func(deleted int, d time.Duration, err error)) Option {
+	return func(p *SQLitexStore) {
+		p.afterCleanup = fn
+	}
+}
+
+// WithPoolSize tells the store the size of its connection pool, which
+// sqlitex.Pool does not expose. It is only used to check the configuration:
+// the constructor logs a warning if the pool has a single connection while
+// the background cleanup or write-behind goroutine is enabled, as the
+// goroutine would then stall requests whenever it runs.
+func WithPoolSize(n int) Option {
+	return func(p *SQLitexStore) {
+		p.poolSize = n
+	}
+}
+
+// WithMaxConcurrency limits the store to running n operations at once. Further
+// operations wait for a running one to finish, or give up with their
+// context's error, before taking a connection from the pool. This smooths out
+// latency under a burst of requests, rather than having them all queue on the
+// pool. The background cleanup counts towards the limit, but the flushes made
+// by the WithWriteBehind goroutine do not. An n of 0, the default, sets no
+// limit.
+func WithMaxConcurrency(n int) Option {
+	return func(p *SQLitexStore) {
+		p.maxConcurrency = n
+	}
+}
+
+// WithTouchPolicy sets the sliding expiry policy used by FindAndMaybeTouch.
+// The policy is called with a session's current expiry and the current time,
+// and returns the session's new expiry and whether to write it. Returning
+// false avoids a write when extending the session would not be worthwhile,
+// such as until half of its lifetime has elapsed.
+func WithTouchPolicy(policy func(current, now time.Time) (newExpiry time.Time, shouldTouch bool)) Option {
+	return func(p *SQLitexStore) {
+		p.touchPolicy = policy
+	}
+}
+
+// WithReadOnly makes the store read-only, for use with a database which is
+// attached read-only such as a reporting replica. Methods which modify the
+// store, such as Commit, Delete and DeleteExpired, return ErrReadOnly rather
+// than failing with an SQLite error, and the background cleanup and
+// write-behind goroutines are not started.
+func WithReadOnly() Option {
+	return func(p *SQLitexStore) {
+		p.readOnly = true
+	}
+}
+
+// WithCoveringIndex adds an index on the token and expiry columns to the
+// schema created by CreateTable, see SchemaCoveringIndex, and has Exists use
+// it. Exists can then be answered from the index alone, which avoids reading
+// past large session data to reach the expiry column. The index must exist
+// before the store is used. Cleanup is unaffected, as it already uses the
+// expiry index and deleting a session always reads its row.
+func WithCoveringIndex() Option {
+	return func(p *SQLitexStore) {
+		p.coveringIndex = true
+	}
+}
+
+// WithUserForeignKey makes the user_id column created by CreateTable a foreign
+// key referencing column pk of the users table, with ON DELETE CASCADE, so
+// that deleting a user also deletes their sessions. The store enables the
+// foreign_keys pragma on every connection it takes from the pool. SQLite only
+// enforces foreign keys on connections with the pragma enabled, so the
+// connection that deletes users must have it too, which is most easily done
+// with sqlitex.PoolOptions.PrepareConn. It panics if either identifier is
+// invalid. An existing table is not altered.
+func WithUserForeignKey(users, pk string) Option {
+	if !identifierRe.MatchString(users) {
+		panic(fmt.Sprintf("zqlsession: invalid table name %q", users))
+	}
+	if !identifierRe.MatchString(pk) {
+		panic(fmt.Sprintf("zqlsession: invalid column name %q", pk))
+	}
+	return func(p *SQLitexStore) {
+		p.userForeignKey = users + "(" + pk + ")"
+	}
+}
+
+// WithExclusiveLocking sets the locking_mode pragma to EXCLUSIVE on every
+// connection the store takes from the pool, so that SQLite keeps its file
+// locks once acquired instead of taking and releasing them for every
+// transaction. This speeds up writes for an application which is the only
+// user of its database.
+//
+// Once a connection has taken the lock no other process can read or write the
+// database file until the connection is closed, and neither can other
+// connections in the same process, which wait on the lock until they time out
+// with SQLITE_BUSY. The pool should therefore have a single connection, and
+// this should only be used for a database the store has entirely to itself.
+func WithExclusiveLocking() Option {
+	return func(p *SQLitexStore) {
+		p.exclusiveLocking = true
+	}
+}
+
+// WithCacheSize sets the cache_size pragma on every connection the store takes
+// from the pool to kib kibibytes, in place of SQLite's default of 2000 KiB. A
+// larger page cache keeps more of the sessions table in memory, at the cost of
+// up to kib of memory per connection.
+func WithCacheSize(kib int) Option {
+	return func(p *SQLitexStore) {
+		p.cacheSize = kib
+	}
+}
+
+// WithCodec encodes session data with c before it is stored and decodes it
+// after it is read, for example to compress it. The user_id extractor given to
+// WithUserID still sees the unencoded data. Rows are not re-encoded when the
+// codec changes, so c should be able to decode data written without it, see
+// Codec.
+func WithCodec(c Codec) Option {
+	return func(p *SQLitexStore) {
+		p.codec = c
+	}
+}
+
+// WithMaxTokenLength rejects tokens longer than n bytes with ErrTokenTooLong
+// before they reach the database, so that an attacker sending enormous cookie
+// values cannot bloat the token index or slow down lookups. Find, FindOn and
+// Tx.Find report such a token as not found instead, without a query. The
+// default limit is 256 bytes, and an n of 0 removes the limit.
+func WithMaxTokenLength(n int) Option {
+	return func(p *SQLitexStore) {
+		p.maxTokenLength = n
+	}
+}
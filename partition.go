@@ -0,0 +1,282 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// partitionLayout formats the expiry day in the name of a partition table.
+const partitionLayout = "20060102"
+
+// QueryPartitions selects the names of the partition tables of a
+// PartitionedStore, oldest first.
+const QueryPartitions = "SELECT name FROM sqlite_master WHERE type = 'table' " +
+	"AND name GLOB 'sessions_[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]' ORDER BY name"
+
+// SchemaPartition creates a partition table of a PartitionedStore, with %s
+// standing for its name. Partitions need no expiry index, as expired sessions
+// are removed by dropping whole partitions.
+const SchemaPartition = `CREATE TABLE IF NOT EXISTS %s (
+	token TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry REAL NOT NULL
+)`
+
+// PartitionedStore is a session store for very many short-lived sessions,
+// which keeps the sessions expiring on each day, in UTC, in their own table,
+// such as sessions_20240601. Once a day has passed all of its sessions have
+// expired, and cleanup removes them by dropping the day's table, which is far
+// cheaper than deleting them row by row from one large table.
+//
+// A PartitionedStore only implements the scs Store and IterableStore
+// interfaces; the options and other methods of SQLitexStore are not
+// supported. Every lookup checks each day which has not yet passed, so it
+// suits sessions which live for days rather than months.
+type PartitionedStore struct {
+	db     *sqlitex.Pool
+	logger *log.Logger
+
+	stopOnce    sync.Once
+	stopCleanup chan struct{}
+}
+
+// NewPartitioned returns a PartitionedStore using db, whose partition tables
+// are created as sessions are committed. Expired partitions are dropped by a
+// background goroutine every cleanupInterval, which should be well under a
+// day; an interval of 0 disables it.
+func NewPartitioned(db *sqlitex.Pool, cleanupInterval time.Duration) *PartitionedStore {
+	p := &PartitionedStore{
+		db:     db,
+		logger: log.Default(),
+	}
+	if cleanupInterval > 0 {
+		p.stopCleanup = make(chan struct{})
+		go p.startCleanup(cleanupInterval)
+	}
+	return p
+}
+
+// Find returns the data for a given session token. If the session token is
+// not found or is expired, the returned exists flag will be set to false.
+func (p *PartitionedStore) Find(token string) (b []byte, exists bool, err error) {
+	if token == "" {
+		return nil, false, nil
+	}
+	conn, err := p.db.Take(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	defer p.db.Put(conn)
+
+	live, _, err := partitions(conn, time.Now())
+	if err != nil || len(live) == 0 {
+		return nil, false, err
+	}
+	var query strings.Builder
+	for i, table := range live {
+		if i > 0 {
+			query.WriteString(" UNION ALL ")
+		}
+		query.WriteString("SELECT data FROM " + table +
+			" WHERE token = $1 AND julianday('now') < expiry")
+	}
+	// The query varies with the partitions, so it is not cached.
+	err = sqlitex.ExecuteTransient(conn, query.String(),
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				b = make([]byte, stmt.ColumnLen(0))
+				stmt.ColumnBytes(0, b)
+				exists = true
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	return b, exists, nil
+}
+
+// Commit adds a session token and data with the given expiry time to the
+// partition of its expiry day, moving the session from any other partition.
+func (p *PartitionedStore) Commit(token string, b []byte, expiry time.Time) (err error) {
+	if token == "" {
+		return ErrEmptyToken
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	conn, err := p.db.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer p.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	target := partitionName(expiry)
+	err = sqlitex.ExecuteTransient(conn, strings.Replace(SchemaPartition, "%s", target, 1), nil)
+	if err != nil {
+		return err
+	}
+	live, _, err := partitions(conn, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, table := range live {
+		if table == target {
+			continue
+		}
+		err = sqlitex.Execute(conn, "DELETE FROM "+table+" WHERE token = $1",
+			&sqlitex.ExecOptions{
+				Args: []any{token},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return sqlitex.Execute(conn, "INSERT INTO "+target+" (token, data, expiry) "+
+		"VALUES ($1, $2, julianday($3)) "+
+		"ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry",
+		&sqlitex.ExecOptions{
+			Args: []any{token, b, JulianDayExpiry.Encode(expiry)},
+		})
+}
+
+// Delete removes a session token and corresponding data from every partition.
+func (p *PartitionedStore) Delete(token string) (err error) {
+	if token == "" {
+		return nil
+	}
+	conn, err := p.db.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer p.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	live, expired, err := partitions(conn, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, table := range append(expired, live...) {
+		err = sqlitex.Execute(conn, "DELETE FROM "+table+" WHERE token = $1",
+			&sqlitex.ExecOptions{
+				Args: []any{token},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// All returns a map containing the token and data for all active sessions.
+func (p *PartitionedStore) All() (map[string][]byte, error) {
+	conn, err := p.db.Take(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer p.db.Put(conn)
+
+	sessions := make(map[string][]byte)
+	live, _, err := partitions(conn, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range live {
+		err = sqlitex.Execute(conn, "SELECT token, data FROM "+table+
+			" WHERE julianday('now') < expiry",
+			&sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					b := make([]byte, stmt.ColumnLen(1))
+					stmt.ColumnBytes(1, b)
+					sessions[stmt.ColumnText(0)] = b
+					return nil
+				},
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// DropExpiredPartitions drops the partition tables of days which have passed,
+// whose sessions have all expired, returning the number dropped. It is run by
+// the cleanup goroutine.
+func (p *PartitionedStore) DropExpiredPartitions(ctx context.Context) (int, error) {
+	conn, err := p.db.Take(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer p.db.Put(conn)
+
+	_, expired, err := partitions(conn, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i, table := range expired {
+		if err := sqlitex.ExecuteTransient(conn, "DROP TABLE IF EXISTS "+table, nil); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// StopCleanup terminates the background cleanup goroutine, if any.
+func (p *PartitionedStore) StopCleanup() {
+	p.stopOnce.Do(func() {
+		if p.stopCleanup != nil {
+			close(p.stopCleanup)
+		}
+	})
+}
+
+func (p *PartitionedStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := p.DropExpiredPartitions(context.Background()); err != nil {
+				p.logger.Printf("zqlsession: partitions: %v", err)
+			}
+		case <-p.stopCleanup:
+			return
+		}
+	}
+}
+
+// partitionName returns the name of the partition table for sessions
+// expiring at expiry.
+func partitionName(expiry time.Time) string {
+	return "sessions_" + expiry.UTC().Format(partitionLayout)
+}
+
+// partitions returns the names of the partition tables, split into those
+// which may hold active sessions at now and those of days which have passed.
+func partitions(conn *sqlite.Conn, now time.Time) (live, expired []string, err error) {
+	today := partitionName(now)
+	err = sqlitex.Execute(conn, QueryPartitions,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				// The names sort by day, as the day has a fixed
+				// width.
+				if name := stmt.ColumnText(0); name < today {
+					expired = append(expired, name)
+				} else {
+					live = append(live, name)
+				}
+				return nil
+			},
+		})
+	return live, expired, err
+}
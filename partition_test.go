@@ -0,0 +1,84 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+func TestPartitioned(t *testing.T) {
+	db := newPool(t)
+	store := zqlsession.NewPartitioned(db, 0)
+	defer store.StopCleanup()
+
+	now := time.Now()
+	if err := store.Commit("token", []byte("today"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// Committing with a later expiry day moves the session.
+	if err := store.Commit("token", []byte("later"), now.Add(72*time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got, found, err := store.Find("token"); err != nil || !found || string(got) != "later" {
+		t.Errorf("find: got %q, %v, %v, want %q", got, found, err, "later")
+	}
+	if err := store.Commit("old", []byte("data"), now.Add(-48*time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, found, _ := store.Find("old"); found {
+		t.Error("find in a passed partition: got true, want false")
+	}
+
+	if n, err := store.DropExpiredPartitions(context.Background()); err != nil || n != 1 {
+		t.Errorf("drop expired partitions: got %d, %v, want 1", n, err)
+	}
+	if _, found, _ := store.Find("token"); !found {
+		t.Error("dropping expired partitions lost an active session")
+	}
+}
+
+// BenchmarkPartitionedCleanup compares removing a day of expired sessions by
+// dropping its partition with deleting them from a single table.
+func BenchmarkPartitionedCleanup(b *testing.B) {
+	const n = 10000
+	yesterday := time.Now().Add(-24 * time.Hour).UTC()
+	insert := func(table string) string {
+		return "WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < " +
+			fmt.Sprint(n) + ") INSERT INTO " + table + " (token, data, expiry) " +
+			"SELECT 'token' || i, zeroblob(256), julianday('" +
+			yesterday.Format("2006-01-02 15:04:05") + "') FROM seq"
+	}
+
+	b.Run("Single", func(b *testing.B) {
+		db := newPool(b)
+		store := newStore(b, db, zqlsession.WithoutCleanup())
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			execute(b, db, insert("sessions"))
+			b.StartTimer()
+			if _, err := store.DeleteExpired(context.Background()); err != nil {
+				b.Fatalf("delete expired: %v", err)
+			}
+		}
+	})
+	b.Run("Partitioned", func(b *testing.B) {
+		db := newPool(b)
+		store := zqlsession.NewPartitioned(db, 0)
+		table := "sessions_" + yesterday.Format("20060102")
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			execute(b, db, strings.Replace(zqlsession.SchemaPartition, "%s", table, 1))
+			execute(b, db, insert(table))
+			b.StartTimer()
+			if _, err := store.DropExpiredPartitions(context.Background()); err != nil {
+				b.Fatalf("drop expired partitions: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,66 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"errors"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// PastExpiryPolicy says what happens to a commit whose expiry time has already
+// passed, see WithPastExpiry.
+type PastExpiryPolicy int
+
+const (
+	// RejectPastExpiry fails the commit with ErrExpiryInPast, to surface
+	// the bug which produced it. It is the default.
+	RejectPastExpiry PastExpiryPolicy = iota
+	// SkipPastExpiry stores nothing for the commit. As the session it
+	// describes is already dead, any existing session for the token is
+	// deleted instead.
+	SkipPastExpiry
+)
+
+// ErrExpiryInPast is returned by commits whose expiry time has already
+// passed, unless the SkipPastExpiry policy is used.
+var ErrExpiryInPast = errors.New("zqlsession: expiry time is in the past")
+
+// WithPastExpiry sets the policy for commits whose expiry time is more than
+// grace in the past, which would otherwise write a row only cleanup can
+// remove. A small grace tolerates clock skew between the application servers
+// sharing a database. Without this option such commits are rejected with no
+// grace.
+//
+// The policy applies to Commit, CommitOn, CommitIdempotent, CommitVersion,
+// Swap, Tx.Commit and FindOrCommit, which returns defaultData without
+// creating the session when it is skipped. Imported sessions and buffered
+// writes being flushed are not checked.
+func WithPastExpiry(policy PastExpiryPolicy, grace time.Duration) Option {
+	return func(p *SQLitexStore) {
+		p.pastExpiryPolicy = policy
+		p.pastExpiryGrace = grace
+	}
+}
+
+// pastExpiry reports whether a commit with expiry must be skipped, or returns
+// ErrExpiryInPast if it must be rejected.
+func (p *SQLitexStore) pastExpiry(expiry time.Time) (skip bool, err error) {
+	if !expiry.Before(time.Now().Add(-p.pastExpiryGrace)) {
+		return false, nil
+	}
+	if p.pastExpiryPolicy == SkipPastExpiry {
+		return true, nil
+	}
+	return false, ErrExpiryInPast
+}
+
+// commitOrDelete commits a session, or deletes the token's session instead if
+// its commit was skipped by the SkipPastExpiry policy.
+func (p *SQLitexStore) commitOrDelete(conn *sqlite.Conn, token string, b []byte, expiry time.Time, skip bool) error {
+	if skip {
+		return p.delete(conn, token)
+	}
+	return p.commit(conn, token, b, expiry)
+}
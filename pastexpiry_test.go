@@ -0,0 +1,56 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestPastExpiryRejected(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	err := store.Commit("token", []byte("data"), time.Now().Add(-time.Minute))
+	if !errors.Is(err, zqlsession.ErrExpiryInPast) {
+		t.Fatalf("commit: got %v, want ErrExpiryInPast", err)
+	}
+	if _, found, err := store.DumpRow("token"); err != nil || found {
+		t.Fatalf("dump: got %v, %v, want no row", found, err)
+	}
+}
+
+func TestPastExpirySkipped(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t,
+		zqlsession.WithPastExpiry(zqlsession.SkipPastExpiry, 0))
+
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Commit("token", []byte("data"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("commit past expiry: %v", err)
+	}
+	// The skipped commit deletes the session it would have replaced.
+	if _, found, err := store.DumpRow("token"); err != nil || found {
+		t.Fatalf("dump: got %v, %v, want no row", found, err)
+	}
+}
+
+func TestPastExpiryGrace(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t,
+		zqlsession.WithPastExpiry(zqlsession.RejectPastExpiry, time.Minute))
+
+	if err := store.Commit("skewed", []byte("data"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("commit within grace: %v", err)
+	}
+	if _, found, err := store.DumpRow("skewed"); err != nil || !found {
+		t.Fatalf("dump: got %v, %v, want a row", found, err)
+	}
+	err := store.Commit("late", []byte("data"), time.Now().Add(-time.Hour))
+	if !errors.Is(err, zqlsession.ErrExpiryInPast) {
+		t.Fatalf("commit past grace: got %v, want ErrExpiryInPast", err)
+	}
+}
@@ -0,0 +1,116 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// politeYieldInterval is how often polite cleanup checks whether the
+// operations it yielded to have got their connections.
+const politeYieldInterval = 5 * time.Millisecond
+
+// WithPoliteCleanup makes cleanup give way to the store's other operations,
+// so that a long cleanup never keeps a request waiting for a connection.
+// Expired sessions are deleted in batches of up to batch sessions, each on a
+// freshly taken connection, and before each batch cleanup waits until no
+// other operation of the store is waiting for a connection from the pool or
+// for a WithMaxConcurrency slot. Under sustained contention cleanup is delayed
+// until the store is idle.
+//
+// Sessions expired by a polite cleanup are deleted in several transactions
+// rather than one. Cleanup with WithExpiredArchive still moves expired
+// sessions in a single transaction. A batch of 0, the default, deletes all
+// expired sessions with a single statement.
+func WithPoliteCleanup(batch int) Option {
+	return func(p *SQLitexStore) {
+		p.politeBatch = batch
+	}
+}
+
+// startWaiting counts an operation other than cleanup as waiting for a
+// connection, for polite cleanup to give way to. The returned function must be
+// called once it has stopped waiting.
+func (p *SQLitexStore) startWaiting(op Op) func() {
+	if p.politeBatch <= 0 || op == OpDeleteExpired {
+		return func() {}
+	}
+	p.waiting.Add(1)
+	return func() {
+		p.waiting.Add(-1)
+	}
+}
+
+// deleteExpiredBatches deletes expired sessions in batches of up to batch
+// sessions until none are left, returning the number deleted by the batches
+// which completed. With polite set it yields to waiting operations before each
+// batch, for WithPoliteCleanup. If deadline is not zero no batch is started
+// after it, except the first.
+func (p *SQLitexStore) deleteExpiredBatches(ctx context.Context, batch int, polite bool, deadline time.Time) (int, error) {
+	var expired int
+	if p.cleanupProgress != nil {
+		var err error
+		expired, err = p.countExpired(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	for first := true; ; first = false {
+		if !first && !deadline.IsZero() && !time.Now().Before(deadline) {
+			return n, nil
+		}
+		if polite {
+			if err := p.yield(ctx); err != nil {
+				return n, err
+			}
+		}
+		deleted, err := p.deleteExpiredBatch(ctx, batch)
+		n += deleted
+		if p.cleanupProgress != nil && deleted > 0 {
+			p.reportProgress(n, expired)
+		}
+		if err != nil || deleted < batch {
+			return n, err
+		}
+	}
+}
+
+// deleteExpiredBatch deletes a single batch of up to batch expired sessions.
+func (p *SQLitexStore) deleteExpiredBatch(ctx context.Context, batch int) (_ int, err error) {
+	conn, put, err := p.take(ctx, OpDeleteExpired)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	err = sqlitex.Execute(conn, p.q.deleteExpiredBatch,
+		&sqlitex.ExecOptions{
+			Args: []any{batch},
+		})
+	if err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
+
+// yield waits until no other operation of the store is waiting for a
+// connection, or ctx is done.
+func (p *SQLitexStore) yield(ctx context.Context) error {
+	if p.waiting.Load() == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(politeYieldInterval)
+	defer ticker.Stop()
+	for p.waiting.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// TestPoliteCleanup runs a long cleanup on a pool of one connection, and
+// checks that lookups made meanwhile get the connection between its batches
+// rather than waiting for it to finish.
+func TestPoliteCleanup(t *testing.T) {
+	const n, reads = 20000, 50
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	store := newStore(t, db, zqlsession.WithoutCleanup(), zqlsession.WithPoliteCleanup(100))
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	execute(t, db, "WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < $1) "+
+		"INSERT INTO sessions (token, data, expiry) "+
+		"SELECT 'expired' || i, zeroblob(256), julianday('now', '-1 hour') FROM seq", n)
+
+	cleaned := make(chan time.Duration)
+	start := time.Now()
+	go func() {
+		if _, err := store.DeleteExpired(context.Background()); err != nil {
+			t.Errorf("delete expired: %v", err)
+		}
+		cleaned <- time.Since(start)
+	}()
+
+	var slowest time.Duration
+	for i := 0; i < reads; i++ {
+		readStart := time.Now()
+		if _, found, err := store.Find("token"); err != nil || !found {
+			t.Fatalf("find: got %v, %v, want the session", found, err)
+		}
+		if d := time.Since(readStart); d > slowest {
+			slowest = d
+		}
+		// Spread the lookups over the cleanup.
+		time.Sleep(2 * time.Millisecond)
+	}
+	cleanup := <-cleaned
+	if slowest > cleanup/4 {
+		t.Errorf("slowest find took %v during a cleanup of %v", slowest, cleanup)
+	}
+	if remaining := countRows(t, db, "sessions"); remaining != 1 {
+		t.Errorf("got %d rows after cleanup, want 1", remaining)
+	}
+}
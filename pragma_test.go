@@ -0,0 +1,59 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// newSinglePool returns a pool of one connection to a new database file, as
+// WithExclusiveLocking requires, which is closed when the test completes.
+func newSinglePool(t testing.TB) *sqlitex.Pool {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPragmas(t *testing.T) {
+	zqlsessiontest.RunConformance(t, newStore(t, newSinglePool(t),
+		zqlsession.WithExclusiveLocking(), zqlsession.WithCacheSize(8192)))
+}
+
+// BenchmarkCommitLocking compares the throughput of commits with the default
+// locking mode and with WithExclusiveLocking.
+func BenchmarkCommitLocking(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		opts []zqlsession.Option
+	}{
+		{"Normal", nil},
+		{"Exclusive", []zqlsession.Option{zqlsession.WithExclusiveLocking()}},
+		{"ExclusiveCacheSize", []zqlsession.Option{
+			zqlsession.WithExclusiveLocking(), zqlsession.WithCacheSize(16384)}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			store := newStore(b, newSinglePool(b), append(bm.opts, zqlsession.WithoutCleanup())...)
+			data := []byte("data")
+			expiry := time.Now().Add(time.Hour)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := store.Commit(fmt.Sprint("token", i), data, expiry); err != nil {
+					b.Fatalf("commit: %v", err)
+				}
+			}
+		})
+	}
+}
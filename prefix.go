@@ -0,0 +1,144 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// maxPrefixMatches is the most tokens FindByPrefix returns, so that a short
+// prefix cannot dump the whole table.
+const maxPrefixMatches = 100
+
+// ErrEmptyPrefix is returned by DeleteByPrefix when given an empty prefix by a
+// store without WithTokenPrefix, which would delete every session.
+var ErrEmptyPrefix = errors.New("zqlsession: empty token prefix")
+
+// FindByPrefix returns the tokens of active sessions which start with prefix,
+// in order, for tracking down a session from a truncated token such as one
+// found in a log. At most 100 tokens are returned. The tokens are found with a
+// range scan of the primary key rather than LIKE, so the lookup is cheap.
+func (p *SQLitexStore) FindByPrefix(prefix string) (_ []string, err error) {
+	defer p.logSlow(OpFindByPrefix, len(prefix), time.Now())
+	defer p.wrapError(OpFindByPrefix, &err)
+
+	prefix = p.scopePrefix(prefix)
+	conn, put, err := p.take(context.Background(), OpFindByPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	var tokens []string
+	err = sqlitex.Execute(conn, p.q.findByPrefix,
+		&sqlitex.ExecOptions{
+			Args: []any{prefix, prefixUpperBound(prefix), maxPrefixMatches},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if token, ok := p.stripPrefix(stmt.ColumnText(0)); ok {
+					tokens = append(tokens, token)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// DeleteByPrefix deletes every session, active or expired, whose token starts
+// with prefix, returning the number deleted. With WithTokenPrefix, prefix is
+// taken within the store's namespace, so an empty prefix deletes all of the
+// store's sessions and none of any other's. Without it an empty prefix is
+// rejected with ErrEmptyPrefix rather than deleting the whole table; use Reset
+// for that. Writes buffered by WithWriteBehind are flushed first, so that they
+// are deleted too.
+func (p *SQLitexStore) DeleteByPrefix(ctx context.Context, prefix string) (_ int, err error) {
+	defer p.logSlow(OpDeleteByPrefix, len(prefix), time.Now())
+	defer p.wrapError(OpDeleteByPrefix, &err)
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+	prefix = p.scopePrefix(prefix)
+	if prefix == "" {
+		return 0, ErrEmptyPrefix
+	}
+	conn, put, err := p.take(ctx, OpDeleteByPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return 0, err
+		}
+	}
+	n, err := p.deleteByPrefix(conn, prefix)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		p.lifecycle(OpSessionDeleted, n)
+	}
+	return n, nil
+}
+
+func (p *SQLitexStore) deleteByPrefix(conn *sqlite.Conn, prefix string) (n int, err error) {
+	defer p.checkCorrupt(&err)
+
+	err = sqlitex.Execute(conn, p.q.deleteByPrefix,
+		&sqlitex.ExecOptions{
+			Args: []any{prefix, prefixUpperBound(prefix)},
+		})
+	if err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
+
+// scopePrefix returns the normalized form of a token prefix, within the
+// store's namespace if WithTokenPrefix is used.
+func (p *SQLitexStore) scopePrefix(prefix string) string {
+	if prefix == "" {
+		return p.tokenPrefix
+	}
+	return p.normalizeToken(prefix)
+}
+
+// stripPrefix removes the WithTokenPrefix namespace from a token read from the
+// database, reporting false if the token belongs to another namespace.
+func (p *SQLitexStore) stripPrefix(token string) (string, bool) {
+	if p.tokenPrefix == "" {
+		return token, true
+	}
+	return strings.CutPrefix(token, p.tokenPrefix)
+}
+
+// prefixUpperBound returns the smallest string greater than every string
+// starting with prefix, comparing bytewise as SQLite does. If there is no such
+// string, because prefix is empty or made only of 0xff bytes, it returns an
+// empty blob instead, which SQLite orders after all text.
+func prefixUpperBound(prefix string) any {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return []byte{}
+}
@@ -0,0 +1,184 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestFindByPrefix(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	expiry := time.Now().Add(time.Hour)
+	for _, token := range []string{"abc1", "abc2", "abd", "b"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	tokens, err := store.FindByPrefix("abc")
+	if err != nil {
+		t.Fatalf("find by prefix: %v", err)
+	}
+	if want := []string{"abc1", "abc2"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("find by prefix: got %q, want %q", tokens, want)
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	expiry := time.Now().Add(time.Hour)
+	for _, token := range []string{"user1:a", "user1:b", "user2:a"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	n, err := store.DeleteByPrefix(ctx, "user1:")
+	if err != nil || n != 2 {
+		t.Fatalf("delete by prefix: got %d, %v, want 2", n, err)
+	}
+	if _, found, _ := store.Find("user2:a"); !found {
+		t.Error("session outside the prefix was deleted")
+	}
+}
+
+func TestDeleteByEmptyPrefix(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, err := store.DeleteByPrefix(ctx, ""); !errors.Is(err, zqlsession.ErrEmptyPrefix) {
+		t.Fatalf("delete by empty prefix: got %v, want ErrEmptyPrefix", err)
+	}
+	if _, found, _ := store.Find("token"); !found {
+		t.Error("session was deleted")
+	}
+}
+
+func TestDeleteByEmptyPrefixNamespaced(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	a := newStore(t, db, zqlsession.WithTokenPrefix("a:"))
+	b := newStore(t, db, zqlsession.WithTokenPrefix("b:"))
+
+	expiry := time.Now().Add(time.Hour)
+	if err := a.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := b.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// Within a namespace an empty prefix deletes only that namespace.
+	n, err := a.DeleteByPrefix(ctx, "")
+	if err != nil || n != 1 {
+		t.Fatalf("delete by empty prefix: got %d, %v, want 1", n, err)
+	}
+	if _, found, _ := b.Find("token"); !found {
+		t.Error("session in another namespace was deleted")
+	}
+}
+
+func TestTokenPrefix(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	plain := newStore(t, db)
+	a := newStore(t, db, zqlsession.WithTokenPrefix("a:"))
+	b := newStore(t, db, zqlsession.WithTokenPrefix("b:"))
+
+	expiry := time.Now().Add(time.Hour)
+	for _, token := range []string{"token1", "token2"} {
+		if err := a.Commit(token, []byte("a"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	if err := b.Commit("token1", []byte("b"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	// Each app sees only its own sessions, under their unprefixed tokens.
+	if got, _, _ := b.Find("token1"); string(got) != "b" {
+		t.Errorf("find in b: got %q, want %q", got, "b")
+	}
+	for _, token := range []string{"token2", "a:token2"} {
+		if _, found, _ := b.Find(token); found {
+			t.Errorf("find %q in b: found a's session", token)
+		}
+	}
+	if _, found, _ := plain.Find("a:token2"); !found {
+		t.Error("find a:token2 without a prefix: got false, want the stored token")
+	}
+	all, err := a.All()
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	if want := []string{"token1", "token2"}; !reflect.DeepEqual(keys(all), want) {
+		t.Errorf("all in a: got %q, want %q", keys(all), want)
+	}
+
+	if n, err := a.DeleteByPrefix(ctx, "token"); err != nil || n != 2 {
+		t.Fatalf("delete by prefix: got %d, %v, want 2", n, err)
+	}
+	if _, found, _ := b.Find("token1"); !found {
+		t.Error("delete by prefix in a deleted b's session")
+	}
+}
+
+func TestTokenPrefixUsers(t *testing.T) {
+	db := newPool(t)
+	a := newStore(t, db, zqlsession.WithTokenPrefix("a:"), zqlsession.WithUserID(userOf))
+	b := newStore(t, db, zqlsession.WithTokenPrefix("b:"), zqlsession.WithUserID(userOf))
+
+	now := time.Now()
+	for i, token := range []string{"token1", "token2"} {
+		expiry := now.Add(time.Duration(i+1) * time.Hour)
+		if err := a.Commit(token, []byte("alice:a"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	if err := b.Commit("token1", []byte("alice:b"), now.Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	counts, err := b.SessionCountsByUser()
+	if err != nil {
+		t.Fatalf("session counts by user: %v", err)
+	}
+	if want := map[string]int{"alice": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("session counts by user in b: got %v, want %v", counts, want)
+	}
+	above, err := a.SessionCountsByUserAbove(1)
+	if err != nil {
+		t.Fatalf("session counts by user above: %v", err)
+	}
+	if want := map[string]int{"alice": 2}; !reflect.DeepEqual(above, want) {
+		t.Errorf("session counts by user above in a: got %v, want %v", above, want)
+	}
+
+	// Deduplicating alice's sessions in b leaves a's alone, and in a only
+	// a's older session is deleted.
+	if n, err := b.DedupeByUserID(1); err != nil || n != 0 {
+		t.Fatalf("dedupe in b: got %d, %v, want 0", n, err)
+	}
+	if n, err := a.DedupeByUserID(1); err != nil || n != 1 {
+		t.Fatalf("dedupe in a: got %d, %v, want 1", n, err)
+	}
+	if _, found, _ := a.Find("token1"); found {
+		t.Error("dedupe in a kept its older session")
+	}
+	if _, found, _ := a.Find("token2"); !found {
+		t.Error("dedupe in a deleted its newest session")
+	}
+	if _, found, _ := b.Find("token1"); !found {
+		t.Error("dedupe in a deleted b's session")
+	}
+}
@@ -0,0 +1,56 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// BenchmarkPrepareConn measures the per-operation cost of the connection
+// settings made by prepareConn, with the settings made once per connection as
+// the store does, and made again on every operation.
+func BenchmarkPrepareConn(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		opts    []Option
+		noDedup bool
+	}{
+		{"None", nil, false},
+		{"Dedup", []Option{WithCacheSize(8192)}, false},
+		{"NoDedup", []Option{WithCacheSize(8192)}, true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "sessions.db")
+			db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+			if err != nil {
+				b.Fatalf("open database: %v", err)
+			}
+			defer db.Close()
+			p, err := NewE(db, append(bm.opts, WithAutoMigrate(), WithoutCleanup())...)
+			if err != nil {
+				b.Fatalf("new store: %v", err)
+			}
+			defer p.Shutdown(context.Background())
+			if err := p.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+				b.Fatalf("commit: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bm.noDedup {
+					p.preparedMu.Lock()
+					p.prepared = nil
+					p.preparedMu.Unlock()
+				}
+				if _, _, err := p.Find("token"); err != nil {
+					b.Fatalf("find: %v", err)
+				}
+			}
+		})
+	}
+}
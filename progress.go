@@ -0,0 +1,57 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// WithCleanupProgress calls fn after each batch of expired sessions is
+// deleted, with the number deleted so far by the cleanup and an estimate of
+// how many are left, so that operators can watch cleanup work through a large
+// backlog, such as after downtime. The estimate is the number of sessions
+// which had expired when the cleanup started, less those deleted since; it
+// does not include sessions which expire while the cleanup runs.
+//
+// Only cleanups which delete in batches report progress: those of
+// WithPoliteCleanup and WithCleanupTimeBudget, including calls to
+// DeleteExpired with WithPoliteCleanup. Counting the expired sessions at the
+// start of each such cleanup costs a query. fn runs inline between batches, so
+// it should be quick.
+func WithCleanupProgress(fn func(deletedSoFar, estimatedRemaining int)) Option {
+	return func(p *SQLitexStore) {
+		p.cleanupProgress = fn
+	}
+}
+
+// reportProgress calls the WithCleanupProgress callback once n of the expired
+// sessions counted at the start of the cleanup have been deleted.
+func (p *SQLitexStore) reportProgress(n, expired int) {
+	remaining := expired - n
+	if remaining < 0 {
+		remaining = 0
+	}
+	p.cleanupProgress(n, remaining)
+}
+
+// countExpired returns the number of expired sessions not yet deleted.
+func (p *SQLitexStore) countExpired(ctx context.Context) (_ int, err error) {
+	conn, put, err := p.take(ctx, OpDeleteExpired)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	var n int
+	err = sqlitex.Execute(conn, p.q.countExpired,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+	return n, err
+}
@@ -0,0 +1,491 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultTable is the name of the table used when WithTableName is not given.
+const defaultTable = "sessions"
+
+// The SQL statements run by the store, for the default sessions table. They
+// are exported so that external tooling, such as query loggers or plan
+// analysis, can reference the exact text of each statement. Stores created
+// with WithTableName use the same statements with the table name, and the
+// index names derived from it, substituted.
+const (
+	// Schema creates the sessions table and its indexes if they do not
+	// already exist. It is run by CreateTable.
+	Schema = `CREATE TABLE IF NOT EXISTS sessions (
+	token TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry REAL NOT NULL,
+	seq INTEGER NOT NULL DEFAULT 0,
+	version INTEGER NOT NULL DEFAULT 0,
+	access_count INTEGER NOT NULL DEFAULT 0,
+	data_hash BLOB,
+	user_id TEXT
+);
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
+CREATE INDEX IF NOT EXISTS sessions_seq_idx ON sessions(seq);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);`
+
+	// SchemaSplitData is the schema used with the WithSplitData option. The
+	// data of each session is kept in a separate sessions_data table so that
+	// lookups and expiry scans only touch the small rows of the sessions
+	// table. A trigger deletes the data of deleted sessions.
+	SchemaSplitData = `CREATE TABLE IF NOT EXISTS sessions (
+	token TEXT PRIMARY KEY,
+	data_id INTEGER NOT NULL,
+	expiry REAL NOT NULL,
+	seq INTEGER NOT NULL DEFAULT 0,
+	version INTEGER NOT NULL DEFAULT 0,
+	access_count INTEGER NOT NULL DEFAULT 0,
+	data_hash BLOB,
+	user_id TEXT
+);
+CREATE TABLE IF NOT EXISTS sessions_data (
+	data_id INTEGER PRIMARY KEY,
+	data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
+CREATE INDEX IF NOT EXISTS sessions_seq_idx ON sessions(seq);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);
+CREATE TRIGGER IF NOT EXISTS sessions_data_delete AFTER DELETE ON sessions
+BEGIN
+	DELETE FROM sessions_data WHERE data_id = old.data_id;
+END;`
+
+	// SchemaArchive creates the archive table used by the
+	// WithExpiredArchive option. CreateTable runs it when that option is
+	// used.
+	SchemaArchive = `CREATE TABLE IF NOT EXISTS sessions_archive (
+	token TEXT NOT NULL,
+	data BLOB NOT NULL,
+	expiry REAL NOT NULL,
+	archived_at REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_archive_archived_at_idx ON sessions_archive(archived_at);`
+
+	// SchemaCoveringIndex creates an index on the token and expiry of
+	// sessions, so that queries which only check whether a session exists
+	// never read its row. CreateTable runs it when the WithCoveringIndex
+	// option is used.
+	SchemaCoveringIndex = "CREATE INDEX IF NOT EXISTS sessions_token_expiry_idx ON sessions(token, expiry);"
+
+	// QueryExpiryIndex reports whether table $1 exists, and if so whether
+	// it has an index leading with the expiry column.
+	QueryExpiryIndex = "SELECT EXISTS (SELECT 1 FROM pragma_table_info($1)), " +
+		"EXISTS (SELECT 1 FROM pragma_index_list($1) AS l, pragma_index_info(l.name) AS i " +
+		"WHERE i.seqno = 0 AND i.name = 'expiry')"
+
+	// QueryFind selects the data of an active session by token.
+	QueryFind = "SELECT data FROM sessions WHERE token = $1 AND julianday('now') < expiry"
+
+	// QueryExists selects whether an active session exists by token.
+	QueryExists = "SELECT 1 FROM sessions WHERE token = $1 AND julianday('now') < expiry"
+
+	// QueryExistsCovering is QueryExists for the WithCoveringIndex option.
+	// The index must be named, as SQLite otherwise prefers the primary key
+	// index, which does not include the expiry.
+	QueryExistsCovering = "SELECT 1 FROM sessions INDEXED BY sessions_token_expiry_idx WHERE token = $1 AND julianday('now') < expiry"
+
+	// QueryIsActive selects whether the session of a token, active or
+	// expired, is active. It selects no row if the token has no session.
+	QueryIsActive = "SELECT julianday('now') < expiry FROM sessions WHERE token = $1"
+
+	// QueryFindVersion selects the data and version of an active session
+	// by token.
+	QueryFindVersion = "SELECT data, version FROM sessions WHERE token = $1 AND julianday('now') < expiry"
+
+	// QueryFindExpiry selects the data and expiry of an active session by
+	// token.
+	QueryFindExpiry = "SELECT data, expiry FROM sessions WHERE token = $1 AND julianday('now') < expiry"
+
+	// QueryTouch sets the expiry of a session by token.
+	QueryTouch = "UPDATE sessions SET expiry = julianday($1) WHERE token = $2"
+
+	// QueryTouchBatch sets the expiry of active sessions by token. It is
+	// followed by a parenthesized list of the tokens, as $2, $3 and so on.
+	QueryTouchBatch = "UPDATE sessions SET expiry = julianday($1) WHERE julianday('now') < expiry AND token IN "
+
+	// QueryDumpRow selects the stored columns of a session by token,
+	// whether or not it has expired.
+	QueryDumpRow = "SELECT expiry, data, seq, user_id FROM sessions WHERE token = $1"
+
+	// QueryDumpRowAccess is QueryDumpRow which also selects the access
+	// count, for the WithAccessCounting option.
+	QueryDumpRowAccess = "SELECT expiry, data, seq, user_id, access_count FROM sessions WHERE token = $1"
+
+	// QueryAddAccessCount adds $1 to the access count of session $2.
+	QueryAddAccessCount = "UPDATE sessions SET access_count = access_count + $1 WHERE token = $2"
+
+	// QueryCommit inserts or updates a session. It is an upsert rather than
+	// REPLACE so that access_count is kept when an existing session is
+	// updated. The data_hash of the old data is cleared.
+	QueryCommit = "INSERT INTO sessions (token, data, expiry) VALUES ($1, $2, julianday($3)) " +
+		"ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry, data_hash = NULL"
+
+	// QueryCommitSequence inserts or updates a session when the WithSequence
+	// option is used. It is an upsert rather than REPLACE so that seq is kept
+	// when an existing session is updated.
+	QueryCommitSequence = "INSERT INTO sessions (token, data, expiry, seq) " +
+		"VALUES ($1, $2, julianday($3), (SELECT COALESCE(MAX(seq), 0) + 1 FROM sessions)) " +
+		"ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry"
+
+	// QueryCommitVersion and QueryCommitSequenceVersion are QueryCommit
+	// and QueryCommitSequence for the RejectOnConflict policy. They are
+	// upserts which count the commits to a session in its version.
+	QueryCommitVersion = "INSERT INTO sessions (token, data, expiry, version) " +
+		"VALUES ($1, $2, julianday($3), 1) " +
+		"ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry, version = version + 1"
+	QueryCommitSequenceVersion = "INSERT INTO sessions (token, data, expiry, seq, version) " +
+		"VALUES ($1, $2, julianday($3), (SELECT COALESCE(MAX(seq), 0) + 1 FROM sessions), 1) " +
+		"ON CONFLICT (token) DO UPDATE SET data = excluded.data, expiry = excluded.expiry, version = version + 1"
+
+	// QueryTouchUnchanged sets the expiry of active session $2 to $1 if
+	// its data_hash is $3, for the WithSkipUnchangedData option.
+	QueryTouchUnchanged = "UPDATE sessions SET expiry = julianday($1) WHERE token = $2 AND data_hash = $3 AND julianday('now') < expiry"
+
+	// QuerySetDataHash sets the data_hash of session $2 to $1, for the
+	// WithSkipUnchangedData option.
+	QuerySetDataHash = "UPDATE sessions SET data_hash = $1 WHERE token = $2"
+
+	// QuerySetUserID sets the user_id of a session, run after QueryCommit
+	// when the WithUserID option is used.
+	QuerySetUserID = "UPDATE sessions SET user_id = $1 WHERE token = $2"
+
+	// QueryDataID selects the data_id of a session, used with the
+	// WithSplitData option.
+	QueryDataID = "SELECT data_id FROM sessions WHERE token = $1"
+
+	// QueryInsertData inserts the data of a new session, used with the
+	// WithSplitData option.
+	QueryInsertData = "INSERT INTO sessions_data (data) VALUES ($1)"
+
+	// QueryUpdateData updates the data of an existing session, used with
+	// the WithSplitData option.
+	QueryUpdateData = "UPDATE sessions_data SET data = $1 WHERE data_id = $2"
+
+	// QueryEvictOldest deletes the sessions with the earliest expiry, other
+	// than session $1, until at most $2 remain. It is run after QueryCommit
+	// when the WithMaxSessions option is used.
+	QueryEvictOldest = "DELETE FROM sessions WHERE token IN " +
+		"(SELECT token FROM sessions WHERE token != $1 ORDER BY expiry " +
+		"LIMIT MAX((SELECT COUNT(*) FROM sessions) - $2, 0))"
+
+	// QueryDelete deletes a session by token.
+	QueryDelete = "DELETE FROM sessions WHERE token = $1"
+
+	// QueryAll selects the token and data of all active sessions.
+	QueryAll = "SELECT token, data FROM sessions WHERE julianday('now') < expiry"
+
+	// QueryCount counts the active sessions.
+	QueryCount = "SELECT COUNT(*) FROM sessions WHERE julianday('now') < expiry"
+
+	// QueryCountExpired counts the expired sessions which have not been
+	// deleted yet.
+	QueryCountExpired = "SELECT COUNT(*) FROM sessions WHERE julianday('now') >= expiry"
+
+	// QueryCounts counts the active sessions and all sessions, including
+	// expired ones which have not been deleted yet.
+	QueryCounts = "SELECT SUM(CASE WHEN julianday('now') < expiry THEN 1 ELSE 0 END), COUNT(*) FROM sessions"
+
+	// QueryStream selects the token, data and expiry of all active sessions.
+	QueryStream = "SELECT token, data, expiry FROM sessions WHERE julianday('now') < expiry"
+
+	// QueryAllExpiry selects the token and expiry of all active sessions.
+	QueryAllExpiry = "SELECT token, expiry FROM sessions WHERE julianday('now') < expiry"
+
+	// QueryAllOrderedByCreated selects the tokens of all active sessions in
+	// creation order.
+	QueryAllOrderedByCreated = "SELECT token FROM sessions WHERE julianday('now') < expiry ORDER BY seq"
+
+	// QueryFindByPrefix selects, in order, at most $3 tokens of active
+	// sessions from $1 up to but excluding $2.
+	QueryFindByPrefix = "SELECT token FROM sessions WHERE julianday('now') < expiry AND token >= $1 AND token < $2 ORDER BY token LIMIT $3"
+
+	// QueryDeleteByPrefix deletes the sessions from $1 up to but excluding
+	// $2.
+	QueryDeleteByPrefix = "DELETE FROM sessions WHERE token >= $1 AND token < $2"
+
+	// QueryAllTokens selects the token of every session, active or
+	// expired.
+	QueryAllTokens = "SELECT token FROM sessions"
+
+	// QueryFindTokens selects the token and data of active sessions by
+	// token, and is completed with a parenthesised list of tokens.
+	QueryFindTokens = "SELECT token, data FROM sessions WHERE julianday('now') < expiry AND token IN "
+
+	// QueryDeleteTokens deletes sessions by token, and is completed with a
+	// parenthesised list of tokens.
+	QueryDeleteTokens = "DELETE FROM sessions WHERE token IN "
+
+	// QueryExpiringWithin selects the tokens of active sessions expiring
+	// before $1, soonest first.
+	QueryExpiringWithin = "SELECT token FROM sessions WHERE julianday('now') < expiry AND expiry <= julianday($1) ORDER BY expiry"
+
+	// QueryExpiredSessions selects up to $3 tokens from $1 to before $2 of
+	// sessions which have expired but not been deleted, longest expired
+	// first.
+	QueryExpiredSessions = "SELECT token FROM sessions WHERE expiry <= julianday('now') " +
+		"AND token >= $1 AND token < $2 ORDER BY expiry LIMIT $3"
+
+	// QueryWarmTable reads every row of the sessions table, and
+	// QueryWarmIndex every entry of its primary key index.
+	QueryWarmTable = "SELECT sum(length(token)), sum(expiry) FROM sessions"
+	QueryWarmIndex = "SELECT count(*) FROM sessions WHERE token >= ''"
+
+	// QueryAllExpiringBetween selects the token and data of active
+	// sessions expiring from $1 up to but excluding $2.
+	QueryAllExpiringBetween = "SELECT token, data FROM sessions WHERE julianday('now') < expiry AND expiry >= julianday($1) AND expiry < julianday($2)"
+
+	// QueryDeleteExpired deletes all expired sessions.
+	QueryDeleteExpired = "DELETE FROM sessions WHERE expiry < julianday('now')"
+
+	// QueryDeleteExpiredBatch deletes up to $1 expired sessions.
+	QueryDeleteExpiredBatch = "DELETE FROM sessions " +
+		"WHERE rowid IN (SELECT rowid FROM sessions WHERE expiry < julianday('now') LIMIT $1)"
+
+	// QueryDeleteAll deletes every session.
+	QueryDeleteAll = "DELETE FROM sessions"
+
+	// QueryUserIDs selects every distinct user_id of the sessions from $1
+	// up to but excluding $2.
+	QueryUserIDs = "SELECT DISTINCT user_id FROM sessions WHERE user_id IS NOT NULL " +
+		"AND token >= $1 AND token < $2"
+
+	// QueryDedupeUserID deletes all but the $4 newest sessions of user $1
+	// from $2 up to but excluding $3, newest being by expiry.
+	QueryDedupeUserID = "DELETE FROM sessions WHERE user_id = $1 AND token >= $2 AND token < $3 " +
+		"AND token NOT IN (SELECT token FROM sessions WHERE user_id = $1 " +
+		"AND token >= $2 AND token < $3 ORDER BY expiry DESC LIMIT $4)"
+
+	// QueryDedupeUserIDSequence is QueryDedupeUserID with newest being by
+	// creation order, used with the WithSequence option.
+	QueryDedupeUserIDSequence = "DELETE FROM sessions WHERE user_id = $1 AND token >= $2 AND token < $3 " +
+		"AND token NOT IN (SELECT token FROM sessions WHERE user_id = $1 " +
+		"AND token >= $2 AND token < $3 ORDER BY seq DESC LIMIT $4)"
+
+	// QueryIterateByUserID selects the token and data of the active
+	// sessions of user $1.
+	QueryIterateByUserID = "SELECT token, data FROM sessions WHERE user_id = $1 AND julianday('now') < expiry"
+
+	// QuerySessionCountsByUser counts the active sessions of each user from
+	// $1 up to but excluding $2.
+	QuerySessionCountsByUser = "SELECT user_id, COUNT(*) FROM sessions " +
+		"WHERE julianday('now') < expiry AND user_id IS NOT NULL " +
+		"AND token >= $1 AND token < $2 GROUP BY user_id"
+
+	// QuerySessionCountsByUserAbove is QuerySessionCountsByUser limited to
+	// users with more than $3 active sessions.
+	QuerySessionCountsByUserAbove = QuerySessionCountsByUser + " HAVING COUNT(*) > $3"
+
+	// QueryArchiveExpired copies sessions which expired before $1 to the
+	// archive table.
+	QueryArchiveExpired = "INSERT INTO sessions_archive (token, data, expiry, archived_at) " +
+		"SELECT token, data, expiry, julianday($1) FROM sessions WHERE expiry < julianday($1)"
+
+	// QueryDeleteExpiredBefore deletes sessions which expired before $1. It
+	// is used after QueryArchiveExpired with the same cutoff, rather than
+	// QueryDeleteExpired, so that no session can expire between the two.
+	QueryDeleteExpiredBefore = "DELETE FROM sessions WHERE expiry < julianday($1)"
+
+	// QueryPurgeArchive deletes sessions archived before $1.
+	QueryPurgeArchive = "DELETE FROM sessions_archive WHERE archived_at < julianday($1)"
+
+	// QueryDeleteArchive deletes every archived session.
+	QueryDeleteArchive = "DELETE FROM sessions_archive"
+
+	// QueryDeleteArchiveByPrefix deletes the archived sessions from $1 up
+	// to but excluding $2.
+	QueryDeleteArchiveByPrefix = "DELETE FROM sessions_archive WHERE token >= $1 AND token < $2"
+
+	// QueryMigrateExpiry converts up to $1 expiry values from julianday to
+	// unix seconds. Julianday values are recognised as being below 1e8.
+	QueryMigrateExpiry = "UPDATE sessions SET expiry = CAST(ROUND((expiry - 2440587.5) * 86400) AS INTEGER) " +
+		"WHERE rowid IN (SELECT rowid FROM sessions WHERE expiry < 100000000 LIMIT $1)"
+)
+
+// splitDataReadReplacer rewrites queries which select data to join the
+// sessions_data table, for the WithSplitData option.
+var splitDataReadReplacer = strings.NewReplacer(
+	"FROM sessions WHERE", "FROM sessions JOIN sessions_data USING (data_id) WHERE",
+)
+
+// splitDataWriteReplacer rewrites the commit queries to store a data_id
+// rather than the data itself, for the WithSplitData option.
+var splitDataWriteReplacer = strings.NewReplacer(
+	"(token, data, expiry", "(token, data_id, expiry",
+	"data = excluded.data", "data_id = excluded.data_id",
+)
+
+// tableNameRe matches the default table name, and identifiers derived from it
+// such as index names, in the exported queries.
+var tableNameRe = regexp.MustCompile(`\bsessions`)
+
+// queries is the effective SQL for a store, derived from the exported
+// queries and the store's options.
+type queries struct {
+	schema              string
+	expiryIndex         string
+	find                string
+	exists              string
+	isActive            string
+	findExpiry          string
+	touch               string
+	touchBatch          string
+	dumpRow             string
+	addAccessCount      string
+	commit              string
+	commitSequence      string
+	findVersion         string
+	dataID              string
+	insertData          string
+	updateData          string
+	setUserID           string
+	touchUnchanged      string
+	setDataHash         string
+	evictOldest         string
+	delete              string
+	all                 string
+	allOrderedByCreated string
+	stream              string
+	allExpiry           string
+	count               string
+	counts              string
+	countExpired        string
+	expiringWithin      string
+	expiringBetween     string
+	expiredSessions     string
+	findByPrefix        string
+	deleteByPrefix      string
+	allTokens           string
+	findTokens          string
+	deleteTokens        string
+	warmTable           string
+	warmIndex           string
+	deleteExpired       string
+	deleteExpiredBatch  string
+	deleteAll           string
+	migrateExpiry       string
+	userIDs             string
+	dedupeUserID        string
+	iterateByUserID     string
+	countsByUser        string
+	countsByUserAbove   string
+	schemaArchive       string
+	archiveExpired      string
+	deleteExpiredBefore string
+	purgeArchive        string
+	deleteArchive       string
+	deleteArchivePrefix string
+}
+
+func newQueries(p *SQLitexStore) queries {
+	dedupeUserID := QueryDedupeUserID
+	if p.sequence {
+		dedupeUserID = QueryDedupeUserIDSequence
+	}
+	schema := Schema
+	if p.splitData {
+		schema = SchemaSplitData
+	}
+	commit, commitSequence := QueryCommit, QueryCommitSequence
+	if p.conflictPolicy == RejectOnConflict {
+		commit, commitSequence = QueryCommitVersion, QueryCommitSequenceVersion
+	}
+	exists := QueryExists
+	dumpRow := QueryDumpRow
+	if p.access != nil {
+		dumpRow = QueryDumpRowAccess
+	}
+	if p.coveringIndex {
+		schema += "\n" + SchemaCoveringIndex
+		exists = QueryExistsCovering
+	}
+	expiry := expiryReplacer(p.expiryEncoding)
+	rewrite := func(query string) string {
+		query = expiry.Replace(query)
+		if p.table != defaultTable {
+			query = tableNameRe.ReplaceAllLiteralString(query, p.table)
+		}
+		return p.label + query
+	}
+	read := func(query string) string {
+		if p.splitData {
+			query = splitDataReadReplacer.Replace(query)
+		}
+		return rewrite(query)
+	}
+	write := func(query string) string {
+		if p.splitData {
+			query = splitDataWriteReplacer.Replace(query)
+		}
+		return rewrite(query)
+	}
+	schema = rewrite(schema)
+	if p.userForeignKey != "" {
+		// This is added after rewriting, so that the users table is not
+		// renamed along with the sessions table.
+		schema = strings.Replace(schema, "\tuser_id TEXT\n",
+			"\tuser_id TEXT REFERENCES "+p.userForeignKey+" ON DELETE CASCADE\n", 1)
+	}
+	return queries{
+		schema:              schema,
+		expiryIndex:         rewrite(QueryExpiryIndex),
+		find:                read(QueryFind),
+		exists:              rewrite(exists),
+		isActive:            rewrite(QueryIsActive),
+		findExpiry:          read(QueryFindExpiry),
+		touch:               rewrite(QueryTouch),
+		touchBatch:          rewrite(QueryTouchBatch),
+		dumpRow:             read(dumpRow),
+		addAccessCount:      rewrite(QueryAddAccessCount),
+		commit:              write(commit),
+		commitSequence:      write(commitSequence),
+		findVersion:         read(QueryFindVersion),
+		dataID:              rewrite(QueryDataID),
+		insertData:          rewrite(QueryInsertData),
+		updateData:          rewrite(QueryUpdateData),
+		setUserID:           rewrite(QuerySetUserID),
+		touchUnchanged:      rewrite(QueryTouchUnchanged),
+		setDataHash:         rewrite(QuerySetDataHash),
+		evictOldest:         rewrite(QueryEvictOldest),
+		delete:              rewrite(QueryDelete),
+		all:                 read(QueryAll),
+		stream:              read(QueryStream),
+		allExpiry:           rewrite(QueryAllExpiry),
+		count:               rewrite(QueryCount),
+		counts:              rewrite(QueryCounts),
+		countExpired:        rewrite(QueryCountExpired),
+		allOrderedByCreated: rewrite(QueryAllOrderedByCreated),
+		expiringWithin:      rewrite(QueryExpiringWithin),
+		expiringBetween:     read(QueryAllExpiringBetween),
+		expiredSessions:     rewrite(QueryExpiredSessions),
+		findByPrefix:        rewrite(QueryFindByPrefix),
+		deleteByPrefix:      rewrite(QueryDeleteByPrefix),
+		allTokens:           rewrite(QueryAllTokens),
+		findTokens:          read(QueryFindTokens),
+		deleteTokens:        rewrite(QueryDeleteTokens),
+		warmTable:           rewrite(QueryWarmTable),
+		warmIndex:           rewrite(QueryWarmIndex),
+		deleteExpired:       rewrite(QueryDeleteExpired),
+		deleteExpiredBatch:  rewrite(QueryDeleteExpiredBatch),
+		deleteAll:           rewrite(QueryDeleteAll),
+		migrateExpiry:       rewrite(QueryMigrateExpiry),
+		userIDs:             rewrite(QueryUserIDs),
+		dedupeUserID:        rewrite(dedupeUserID),
+		iterateByUserID:     read(QueryIterateByUserID),
+		countsByUser:        rewrite(QuerySessionCountsByUser),
+		countsByUserAbove:   rewrite(QuerySessionCountsByUserAbove),
+		schemaArchive:       rewrite(SchemaArchive),
+		archiveExpired:      read(QueryArchiveExpired),
+		deleteExpiredBefore: rewrite(QueryDeleteExpiredBefore),
+		purgeArchive:        rewrite(QueryPurgeArchive),
+		deleteArchive:       rewrite(QueryDeleteArchive),
+		deleteArchivePrefix: rewrite(QueryDeleteArchiveByPrefix),
+	}
+}
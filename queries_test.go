@@ -0,0 +1,143 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"strings"
+	"testing"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// queries are the exported statements, by name.
+var queries = []struct {
+	name  string
+	query string
+}{
+	{"QueryExpiryIndex", zqlsession.QueryExpiryIndex},
+	{"QueryFind", zqlsession.QueryFind},
+	{"QueryExists", zqlsession.QueryExists},
+	{"QueryExistsCovering", zqlsession.QueryExistsCovering},
+	{"QueryIsActive", zqlsession.QueryIsActive},
+	{"QueryFindVersion", zqlsession.QueryFindVersion},
+	{"QueryFindExpiry", zqlsession.QueryFindExpiry},
+	{"QueryTouch", zqlsession.QueryTouch},
+	{"QueryTouchBatch", zqlsession.QueryTouchBatch},
+	{"QueryDumpRow", zqlsession.QueryDumpRow},
+	{"QueryDumpRowAccess", zqlsession.QueryDumpRowAccess},
+	{"QueryAddAccessCount", zqlsession.QueryAddAccessCount},
+	{"QueryCommit", zqlsession.QueryCommit},
+	{"QueryCommitSequence", zqlsession.QueryCommitSequence},
+	{"QueryCommitVersion", zqlsession.QueryCommitVersion},
+	{"QueryCommitSequenceVersion", zqlsession.QueryCommitSequenceVersion},
+	{"QueryTouchUnchanged", zqlsession.QueryTouchUnchanged},
+	{"QuerySetDataHash", zqlsession.QuerySetDataHash},
+	{"QuerySetUserID", zqlsession.QuerySetUserID},
+	{"QueryDataID", zqlsession.QueryDataID},
+	{"QueryInsertData", zqlsession.QueryInsertData},
+	{"QueryUpdateData", zqlsession.QueryUpdateData},
+	{"QueryEvictOldest", zqlsession.QueryEvictOldest},
+	{"QueryDelete", zqlsession.QueryDelete},
+	{"QueryAll", zqlsession.QueryAll},
+	{"QueryCount", zqlsession.QueryCount},
+	{"QueryCountExpired", zqlsession.QueryCountExpired},
+	{"QueryCounts", zqlsession.QueryCounts},
+	{"QueryStream", zqlsession.QueryStream},
+	{"QueryAllExpiry", zqlsession.QueryAllExpiry},
+	{"QueryAllOrderedByCreated", zqlsession.QueryAllOrderedByCreated},
+	{"QueryFindByPrefix", zqlsession.QueryFindByPrefix},
+	{"QueryDeleteByPrefix", zqlsession.QueryDeleteByPrefix},
+	{"QueryAllTokens", zqlsession.QueryAllTokens},
+	{"QueryFindTokens", zqlsession.QueryFindTokens},
+	{"QueryDeleteTokens", zqlsession.QueryDeleteTokens},
+	{"QueryExpiringWithin", zqlsession.QueryExpiringWithin},
+	{"QueryExpiredSessions", zqlsession.QueryExpiredSessions},
+	{"QueryWarmTable", zqlsession.QueryWarmTable},
+	{"QueryWarmIndex", zqlsession.QueryWarmIndex},
+	{"QueryAllExpiringBetween", zqlsession.QueryAllExpiringBetween},
+	{"QueryDeleteExpired", zqlsession.QueryDeleteExpired},
+	{"QueryDeleteExpiredBatch", zqlsession.QueryDeleteExpiredBatch},
+	{"QueryDeleteAll", zqlsession.QueryDeleteAll},
+	{"QueryUserIDs", zqlsession.QueryUserIDs},
+	{"QueryDedupeUserID", zqlsession.QueryDedupeUserID},
+	{"QueryDedupeUserIDSequence", zqlsession.QueryDedupeUserIDSequence},
+	{"QueryIterateByUserID", zqlsession.QueryIterateByUserID},
+	{"QuerySessionCountsByUser", zqlsession.QuerySessionCountsByUser},
+	{"QuerySessionCountsByUserAbove", zqlsession.QuerySessionCountsByUserAbove},
+	{"QueryArchiveExpired", zqlsession.QueryArchiveExpired},
+	{"QueryDeleteExpiredBefore", zqlsession.QueryDeleteExpiredBefore},
+	{"QueryPurgeArchive", zqlsession.QueryPurgeArchive},
+	{"QueryDeleteArchive", zqlsession.QueryDeleteArchive},
+	{"QueryDeleteArchiveByPrefix", zqlsession.QueryDeleteArchiveByPrefix},
+	{"QueryMigrateExpiry", zqlsession.QueryMigrateExpiry},
+}
+
+// TestQueriesPrepare checks that every exported statement is valid against
+// the exported schemas. Statements ending in IN are completed with a list of
+// tokens, as the store does.
+func TestQueriesPrepare(t *testing.T) {
+	open := func(schema string) *sqlite.Conn {
+		conn, err := sqlite.OpenConn(":memory:")
+		if err != nil {
+			t.Fatalf("open database: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		if err := sqlitex.ExecuteScript(conn, schema, nil); err != nil {
+			t.Fatalf("create schema: %v", err)
+		}
+		return conn
+	}
+	conn := open(zqlsession.Schema + "\n" + zqlsession.SchemaArchive + "\n" +
+		zqlsession.SchemaCoveringIndex)
+	split := open(zqlsession.SchemaSplitData)
+	for _, q := range queries {
+		query := q.query
+		if strings.HasSuffix(query, " IN ") {
+			query += "($2, $3)"
+		}
+		c := conn
+		if strings.Contains(query, "data_id") || strings.Contains(query, "sessions_data") {
+			c = split
+		}
+		stmt, _, err := c.PrepareTransient(query)
+		if err != nil {
+			t.Errorf("%s: %v", q.name, err)
+			continue
+		}
+		stmt.Finalize()
+	}
+}
+
+func TestQueryPlans(t *testing.T) {
+	for _, query := range []string{
+		zqlsession.QueryFind,
+		zqlsession.QueryExists,
+		zqlsession.QueryFindExpiry,
+		zqlsession.QueryTouch,
+		zqlsession.QueryDumpRow,
+		zqlsession.QueryCommit,
+		zqlsession.QueryDelete,
+		zqlsession.QueryCountExpired,
+		zqlsession.QueryExpiringWithin,
+		zqlsession.QueryFindByPrefix,
+		zqlsession.QueryDeleteByPrefix,
+		zqlsession.QueryDeleteExpired,
+		zqlsession.QueryDeleteExpiredBatch,
+		zqlsession.QueryAllOrderedByCreated,
+		zqlsession.QueryIterateByUserID,
+	} {
+		zqlsessiontest.AssertUsesIndex(t, query)
+	}
+}
+
+func TestQueryPlansCovering(t *testing.T) {
+	for _, query := range []string{
+		zqlsession.QueryExistsCovering,
+		zqlsession.QueryCountExpired,
+	} {
+		zqlsessiontest.AssertIndexOnly(t, query)
+	}
+}
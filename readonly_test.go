@@ -0,0 +1,46 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+func TestReadOnly(t *testing.T) {
+	db := newPool(t)
+	writer := newStore(t, db)
+	if err := writer.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	reader, err := zqlsession.NewE(db, zqlsession.WithReadOnly())
+	if err != nil {
+		t.Fatalf("new read-only store: %v", err)
+	}
+	defer reader.Shutdown(context.Background())
+
+	err = reader.Commit("other", []byte("data"), time.Now().Add(time.Hour))
+	if !errors.Is(err, zqlsession.ErrReadOnly) {
+		t.Errorf("commit: got %v, want ErrReadOnly", err)
+	}
+	if err := reader.Delete("token"); !errors.Is(err, zqlsession.ErrReadOnly) {
+		t.Errorf("delete: got %v, want ErrReadOnly", err)
+	}
+	if _, err := reader.DeleteExpired(context.Background()); !errors.Is(err, zqlsession.ErrReadOnly) {
+		t.Errorf("delete expired: got %v, want ErrReadOnly", err)
+	}
+
+	if b, found, err := reader.Find("token"); err != nil || !found || string(b) != "data" {
+		t.Errorf("find: got %q, %v, %v, want %q", b, found, err, "data")
+	}
+	if n, err := reader.Count(); err != nil || n != 1 {
+		t.Errorf("count: got %d, %v, want 1", n, err)
+	}
+	if _, found, _ := writer.Find("other"); found {
+		t.Error("the rejected commit was stored")
+	}
+}
@@ -0,0 +1,191 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// reconnectInterval is the least time between two attempts to replace the
+// pool, so that a database which stays unusable does not have a new pool
+// opened for every failing operation.
+const reconnectInterval = time.Second
+
+// WithReconnect makes the store replace its pool with one returned by factory
+// when an operation fails in a way which suggests the pool's connections can
+// no longer be used: the pool having been closed, the database no longer
+// opening, or SQLite reporting that the database file was moved or replaced
+// underneath it. SQLite does not notice every replacement, and connections it
+// has not noticed keep using the old file. This lets a long-running process
+// recover once the database has been restored, without restarting. The
+// operation which failed still returns its error, as it may not be safe to
+// retry; later operations use the new pool. Attempts are at least 1 second
+// apart, and an error from factory is logged and retried on a later failure.
+//
+// Swapping the pool is not atomic with respect to operations already running:
+// they finish on the old pool, against the old database if it is still open,
+// and a transaction cannot span the swap. Connections passed to the On methods
+// are the caller's, and are not replaced. Writes buffered by WithWriteBehind
+// and counts buffered by WithAccessCounting are flushed to the new database.
+// The store closes the pools it replaces which factory returned, once their
+// connections have all been returned, but never the pool it was created with,
+// which remains the caller's to close.
+//
+// A store which has failed with ErrCorrupt also tries to recover: an
+// operation started once the store has failed, at most once a second, opens a
+// new pool and runs PRAGMA quick_check on it. If the database passes the check,
+// for example because the corrupt file was restored from a backup, the new
+// pool replaces the old one and the store is back in use, cleanup included;
+// otherwise the new pool is closed and the operation fails with ErrCorrupt.
+func WithReconnect(factory func() (*sqlitex.Pool, error)) Option {
+	return func(p *SQLitexStore) {
+		p.reconnect = &reconnector{factory: factory}
+	}
+}
+
+// reconnector is the state of WithReconnect.
+type reconnector struct {
+	factory func() (*sqlitex.Pool, error)
+
+	mu       sync.Mutex
+	last     time.Time
+	replaced []*sqlitex.Pool
+}
+
+// pool returns the store's current pool.
+func (p *SQLitexStore) pool() *sqlitex.Pool {
+	return p.db.Load()
+}
+
+// checkReconnect replaces the pool with a new one from the WithReconnect
+// factory if err, from an operation using db, suggests db is unusable.
+func (p *SQLitexStore) checkReconnect(db *sqlitex.Pool, err error) {
+	if p.reconnect == nil || !isStalePool(err) {
+		return
+	}
+	r := p.reconnect
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another operation may already have replaced db.
+	if p.pool() != db || time.Since(r.last) < reconnectInterval {
+		return
+	}
+	r.last = time.Now()
+	fresh, ferr := r.factory()
+	if ferr != nil {
+		p.logger.Printf("zqlsession: %s: reconnect: %v", p.name, ferr)
+		return
+	}
+	p.swapPool(db, fresh)
+	p.logger.Printf("zqlsession: %s: replaced database pool after: %v", p.name, err)
+}
+
+// recoverCorrupt tries to bring a store which has failed with ErrCorrupt back
+// into use with a new pool from the WithReconnect factory, reporting whether
+// the store is usable.
+func (p *SQLitexStore) recoverCorrupt(ctx context.Context) bool {
+	if p.reconnect == nil {
+		return false
+	}
+	r := p.reconnect
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another operation may already have recovered the store.
+	if !p.corrupt.Load() {
+		return true
+	}
+	if time.Since(r.last) < reconnectInterval {
+		return false
+	}
+	r.last = time.Now()
+	fresh, err := r.factory()
+	if err != nil {
+		p.logger.Printf("zqlsession: %s: reconnect: %v", p.name, err)
+		return false
+	}
+	if err := quickCheck(ctx, fresh); err != nil {
+		p.logger.Printf("zqlsession: %s: reconnect: %v", p.name, err)
+		fresh.Close()
+		return false
+	}
+	p.swapPool(p.pool(), fresh)
+	p.corrupt.Store(false)
+	p.logger.Printf("zqlsession: %s: database passed quick_check on a new pool, re-enabling store",
+		p.name)
+	return true
+}
+
+// quickCheck runs PRAGMA quick_check on a connection from db, returning an
+// error if it finds the database damaged.
+func quickCheck(ctx context.Context, db *sqlitex.Pool) error {
+	conn, err := db.Take(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Put(conn)
+
+	var problem string
+	err = sqlitex.ExecuteTransient(conn, "PRAGMA quick_check",
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if s := stmt.ColumnText(0); s != "ok" && problem == "" {
+					problem = s
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return fmt.Errorf("quick_check: %w", err)
+	}
+	if problem != "" {
+		return fmt.Errorf("quick_check: %s", problem)
+	}
+	return nil
+}
+
+// swapPool makes fresh the store's pool in place of db, closing db if it was
+// returned by the WithReconnect factory. r.mu must be held.
+func (p *SQLitexStore) swapPool(db, fresh *sqlitex.Pool) {
+	r := p.reconnect
+	p.db.Store(fresh)
+
+	p.preparedMu.Lock()
+	p.prepared = nil
+	p.preparedMu.Unlock()
+
+	for i, old := range r.replaced {
+		if old == db {
+			r.replaced = append(r.replaced[:i], r.replaced[i+1:]...)
+			// Close blocks until every connection has been put back.
+			go old.Close()
+			break
+		}
+	}
+	r.replaced = append(r.replaced, fresh)
+}
+
+// isStalePool reports whether err suggests that the pool's connections can no
+// longer be used.
+func isStalePool(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch code := sqlite.ErrCode(err); {
+	case code == sqlite.ResultReadOnlyDBMoved:
+		return true
+	case code.ToPrimary() == sqlite.ResultCantOpen,
+		code.ToPrimary() == sqlite.ResultNotADB:
+		return true
+	}
+	// The pool reports being closed with an error of its own.
+	return strings.Contains(err.Error(), "pool closed")
+}
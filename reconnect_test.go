@@ -0,0 +1,173 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// TestReconnect closes the store's pool underneath it, and checks that the
+// failure has the store replace it with one from the factory.
+func TestReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 2})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	var opened []*sqlitex.Pool
+	factory := func() (*sqlitex.Pool, error) {
+		fresh, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 2})
+		if err == nil {
+			opened = append(opened, fresh)
+			t.Cleanup(func() { fresh.Close() })
+		}
+		return fresh, err
+	}
+	var logged bytes.Buffer
+	store := newStore(t, db,
+		zqlsession.WithReconnect(factory), zqlsession.WithLogger(log.New(&logged, "", 0)))
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+	// The operation which finds the pool closed still fails.
+	if _, _, err := store.Find("token"); err == nil {
+		t.Fatal("find on a closed pool: got nil, want an error")
+	}
+	if len(opened) != 1 {
+		t.Fatalf("factory called %d times, want 1", len(opened))
+	}
+	if got, found, err := store.Find("token"); err != nil || !found || string(got) != "data" {
+		t.Errorf("find after reconnecting: got %q, %v, %v, want %q", got, found, err, "data")
+	}
+	if !bytes.Contains(logged.Bytes(), []byte("replaced database pool")) {
+		t.Errorf("got log %q, want the pool replacement logged", logged.Bytes())
+	}
+}
+
+func TestReconnectWithout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 2})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	store := newStore(t, db)
+	db.Close()
+	for i := 0; i < 2; i++ {
+		if _, _, err := store.Find("token"); err == nil {
+			t.Errorf("find %d on a closed pool: got nil, want an error", i)
+		}
+	}
+}
+
+// TestReconnectCorrupt checks that a store which has failed with ErrCorrupt
+// stays failed while the file is corrupt, and is back in use once it has been
+// restored.
+func TestReconnectCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	store := newStore(t, db)
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		token := fmt.Sprintf("token%d", i)
+		if err := store.Commit(token, bytes.Repeat([]byte("x"), 1024), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	store.Shutdown(context.Background())
+	if err := db.Close(); err != nil {
+		t.Fatalf("close database: %v", err)
+	}
+	backup, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read database: %v", err)
+	}
+	corruptDatabase(t, path)
+
+	db, err = sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	// The store closes a new pool which fails the check, so only the last
+	// is left for the test to close.
+	var last *sqlitex.Pool
+	t.Cleanup(func() {
+		if last != nil {
+			last.Close()
+		}
+	})
+	factory := func() (*sqlitex.Pool, error) {
+		fresh, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+		if err == nil {
+			last = fresh
+		}
+		return fresh, err
+	}
+	var logged bytes.Buffer
+	store, err = zqlsession.NewE(db,
+		zqlsession.WithReconnect(factory), zqlsession.WithLogger(log.New(&logged, "", 0)))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	defer store.Shutdown(context.Background())
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := store.Find("token1"); !errors.Is(err, zqlsession.ErrCorrupt) {
+			t.Fatalf("find %d in a corrupt database: got %v, want ErrCorrupt", i, err)
+		}
+	}
+	if !bytes.Contains(logged.Bytes(), []byte("reconnect: quick_check")) {
+		t.Errorf("got log %q, want the failed recovery logged", logged.Bytes())
+	}
+
+	// Restore the backup as an operator would, in place of the corrupt
+	// file and its WAL.
+	restored := path + ".restored"
+	if err := os.WriteFile(restored, backup, 0o644); err != nil {
+		t.Fatalf("write backup: %v", err)
+	}
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+	if err := os.Rename(restored, path); err != nil {
+		t.Fatalf("restore backup: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, found, err := store.Find("token1")
+		if err == nil {
+			if !found || len(b) != 1024 {
+				t.Errorf("find after restoring: got %d bytes, %v, want the session", len(b), found)
+			}
+			break
+		}
+		if !errors.Is(err, zqlsession.ErrCorrupt) || time.Now().After(deadline) {
+			t.Fatalf("find after restoring: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := store.Commit("token1", []byte("data"), expiry); err != nil {
+		t.Errorf("commit after restoring: %v", err)
+	}
+	if !bytes.Contains(logged.Bytes(), []byte("re-enabling store")) {
+		t.Errorf("got log %q, want the recovery logged", logged.Bytes())
+	}
+}
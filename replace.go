@@ -0,0 +1,66 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// SessionRecord is a session's token, data and expiry.
+type SessionRecord struct {
+	Token  string
+	Data   []byte
+	Expiry time.Time
+}
+
+// ReplaceAll atomically replaces every session in the store with sessions,
+// for example to restore a backup. The existing sessions are deleted and the
+// new ones committed in a single transaction, so other connections see either
+// the old set or the new set, never a mix or an empty table. If any session
+// fails to commit, or ctx is done first, nothing is changed. Writes buffered
+// by WithWriteBehind are discarded.
+func (p *SQLitexStore) ReplaceAll(ctx context.Context, sessions []SessionRecord) (err error) {
+	defer p.logSlow(OpReplaceAll, 0, time.Now())
+	defer p.wrapError(OpReplaceAll, &err)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(ctx, OpReplaceAll)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if w := p.writeBehind; w != nil {
+		w.flushMu.Lock()
+		defer w.flushMu.Unlock()
+
+		w.mu.Lock()
+		w.pending = make(map[string]bufferedWrite)
+		w.mu.Unlock()
+	}
+	return p.replaceAll(ctx, conn, sessions)
+}
+
+func (p *SQLitexStore) replaceAll(ctx context.Context, conn *sqlite.Conn, sessions []SessionRecord) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	err = p.deleteSessions(conn)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.commit(conn, s.Token, s.Data, s.Expiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
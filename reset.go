@@ -0,0 +1,87 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Reset deletes every session, including expired and archived sessions, and
+// forgets the in-memory state kept about them: buffered writes and access
+// counts, idempotency keys, the Stats counters and the CompressionStats
+// totals. This returns the store to the state of a freshly created one, for
+// reusing one store across test cases. The background cleanup goroutine keeps
+// running, and the state of the circuit breaker and of adaptive cleanup, which
+// describe the database rather than its sessions, is kept.
+func (p *SQLitexStore) Reset(ctx context.Context) (err error) {
+	defer p.logSlow(OpReset, 0, time.Now())
+	defer p.wrapError(OpReset, &err)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(ctx, OpReset)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if w := p.writeBehind; w != nil {
+		// Holding flushMu keeps a flush from writing buffered sessions
+		// back after they have been deleted.
+		w.flushMu.Lock()
+		defer w.flushMu.Unlock()
+
+		w.mu.Lock()
+		w.pending = make(map[string]bufferedWrite)
+		w.mu.Unlock()
+	}
+	if a := p.access; a != nil {
+		a.flushMu.Lock()
+		defer a.flushMu.Unlock()
+
+		a.mu.Lock()
+		a.pending = make(map[string]int64)
+		a.mu.Unlock()
+	}
+	p.idempotency.reset()
+
+	if err := p.deleteAll(conn); err != nil {
+		return err
+	}
+	// The counters are kept if the sessions could not be deleted.
+	p.ResetStats()
+	p.originalBytes.Store(0)
+	p.storedBytes.Store(0)
+	return nil
+}
+
+func (p *SQLitexStore) deleteAll(conn *sqlite.Conn) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	err = p.deleteSessions(conn)
+	if err != nil || p.archiveRetention <= 0 {
+		return err
+	}
+	if p.tokenPrefix != "" {
+		return sqlitex.Execute(conn, p.q.deleteArchivePrefix,
+			&sqlitex.ExecOptions{
+				Args: []any{p.tokenPrefix, prefixUpperBound(p.tokenPrefix)},
+			})
+	}
+	return sqlitex.Execute(conn, p.q.deleteArchive, nil)
+}
+
+// deleteSessions deletes every session, or only those in the store's
+// namespace if WithTokenPrefix is used.
+func (p *SQLitexStore) deleteSessions(conn *sqlite.Conn) error {
+	if p.tokenPrefix != "" {
+		_, err := p.deleteByPrefix(conn, p.tokenPrefix)
+		return err
+	}
+	return sqlitex.Execute(conn, p.q.deleteAll, nil)
+}
@@ -0,0 +1,77 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+// prefixCodec is a Codec which stores data with a one byte prefix.
+type prefixCodec struct{}
+
+func (prefixCodec) Encode(b []byte) ([]byte, error) {
+	return append([]byte{'#'}, b...), nil
+}
+
+func (prefixCodec) Decode(b []byte) ([]byte, error) {
+	return b[1:], nil
+}
+
+func TestReset(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t,
+		zqlsession.WithCodec(prefixCodec{}),
+		zqlsession.WithWriteBehind(time.Hour, 100),
+		zqlsession.WithAccessCounting())
+
+	expiry := time.Now().Add(time.Hour)
+	if err := store.Commit("flushed", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if err := store.Commit("buffered", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if _, _, err := store.Find("flushed"); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	applied, err := store.CommitIdempotent("token", []byte("data"), expiry, "key")
+	if err != nil || !applied {
+		t.Fatalf("commit idempotent: got %v, %v, want true", applied, err)
+	}
+
+	if err := store.Reset(ctx); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if n, err := store.Count(); err != nil || n != 0 {
+		t.Errorf("count: got %d, %v, want 0", n, err)
+	}
+	if s := store.Stats(); s != (zqlsession.Stats{}) {
+		t.Errorf("stats: got %+v, want zero", s)
+	}
+	if original, stored, _ := store.CompressionStats(); original != 0 || stored != 0 {
+		t.Errorf("compression stats: got %d, %d, want 0, 0", original, stored)
+	}
+	// A recreated session does not inherit its buffered access count.
+	if err := store.Commit("flushed", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if dump, _, err := store.DumpRow("flushed"); err != nil || dump.AccessCount != 0 {
+		t.Errorf("access count: got %d, %v, want 0", dump.AccessCount, err)
+	}
+	// Idempotency keys are forgotten.
+	applied, err = store.CommitIdempotent("token", []byte("data"), expiry, "key")
+	if err != nil || !applied {
+		t.Errorf("commit idempotent after reset: got %v, %v, want true", applied, err)
+	}
+}
@@ -0,0 +1,60 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestSequence(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithSequence())
+	expiry := time.Now().Add(time.Hour)
+
+	seq := func(token string) int64 {
+		t.Helper()
+		dump, _, err := store.DumpRow(token)
+		if err != nil {
+			t.Fatalf("dump %q: %v", token, err)
+		}
+		return dump.Seq
+	}
+	for _, token := range []string{"c", "a", "b"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	if !(seq("c") < seq("a") && seq("a") < seq("b")) {
+		t.Errorf("seq does not increase: c %d, a %d, b %d", seq("c"), seq("a"), seq("b"))
+	}
+
+	// A re-commit keeps the sequence number.
+	before := seq("c")
+	if err := store.Commit("c", []byte("new"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if got := seq("c"); got != before {
+		t.Errorf("seq after re-commit: got %d, want %d", got, before)
+	}
+
+	tokens, err := store.AllOrderedByCreated()
+	if err != nil {
+		t.Fatalf("all ordered by created: %v", err)
+	}
+	if want := []string{"c", "a", "b"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("all ordered by created: got %q, want %q", tokens, want)
+	}
+}
+
+func TestSequenceDisabled(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	if _, err := store.AllOrderedByCreated(); !errors.Is(err, zqlsession.ErrNoSequence) {
+		t.Errorf("all ordered by created: got %v, want ErrNoSequence", err)
+	}
+}
@@ -0,0 +1,44 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// WithSkipUnchangedData makes a commit whose data is the same as the active
+// session's only update the expiry, as Touch does, rather than rewriting the
+// data, which cuts the writes of scs re-committing large sessions it has not
+// modified. Each commit stores a SHA-256 hash of the stored data in the
+// data_hash column, and compares the new data's hash with it to tell whether
+// the data is unchanged. Data committed with CommitEncrypted is always
+// rewritten, as it is encrypted differently each time.
+//
+// The data_hash is kept up to date only by stores with this option, so every
+// store writing to the table should use it, or a store with the option may
+// skip writing data which another store has changed since. Tables created
+// before the data_hash column was added to Schema need it added before this
+// option is used:
+//
+//	ALTER TABLE sessions ADD COLUMN data_hash BLOB;
+func WithSkipUnchangedData() Option {
+	return func(p *SQLitexStore) {
+		p.skipUnchanged = true
+	}
+}
+
+// touchUnchanged sets the expiry of the active session of token, if its data
+// has the given hash, reporting whether it did.
+func (p *SQLitexStore) touchUnchanged(conn *sqlite.Conn, token string, hash []byte, expiry time.Time) (bool, error) {
+	err := sqlitex.Execute(conn, p.q.touchUnchanged,
+		&sqlitex.ExecOptions{
+			Args: []any{p.encodeExpiry(expiry), token, hash},
+		})
+	if err != nil {
+		return false, err
+	}
+	return conn.Changes() > 0, nil
+}
@@ -0,0 +1,82 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// addWriteMarker counts every write of session data to the sessions table of
+// db in the data_writes table.
+func addWriteMarker(t *testing.T, db *sqlitex.Pool) {
+	t.Helper()
+
+	execute(t, db, "CREATE TABLE data_writes (token TEXT);")
+	execute(t, db, "CREATE TRIGGER sessions_insert AFTER INSERT ON sessions "+
+		"BEGIN INSERT INTO data_writes VALUES (new.token); END;")
+	execute(t, db, "CREATE TRIGGER sessions_update AFTER UPDATE OF data ON sessions "+
+		"BEGIN INSERT INTO data_writes VALUES (new.token); END;")
+}
+
+func TestSkipUnchangedData(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		opts   []zqlsession.Option
+		writes int
+	}{
+		{"Skip", []zqlsession.Option{zqlsession.WithSkipUnchangedData()}, 2},
+		{"Rewrite", nil, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newPool(t)
+			store := newStore(t, db, tt.opts...)
+			addWriteMarker(t, db)
+
+			expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+			if err := store.Commit("token", []byte("data"), expiry); err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			later := expiry.Add(time.Hour)
+			if err := store.Commit("token", []byte("data"), later); err != nil {
+				t.Fatalf("commit unchanged: %v", err)
+			}
+			dump, _, err := store.DumpRow("token")
+			if err != nil {
+				t.Fatalf("dump: %v", err)
+			}
+			if !dump.Expiry.Equal(later) {
+				t.Errorf("expiry: got %v, want %v", dump.Expiry, later)
+			}
+			if err := store.Commit("token", []byte("changed"), later); err != nil {
+				t.Fatalf("commit changed: %v", err)
+			}
+			if got, _, _ := store.Find("token"); string(got) != "changed" {
+				t.Errorf("find: got %q, want %q", got, "changed")
+			}
+			if n := countRows(t, db, "data_writes"); n != tt.writes {
+				t.Errorf("data written %d times, want %d", n, tt.writes)
+			}
+		})
+	}
+}
+
+func TestSkipUnchangedDataEncrypted(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db,
+		zqlsession.WithSkipUnchangedData(), zqlsession.WithEncryptionKey(testKey))
+	addWriteMarker(t, db)
+
+	expiry := time.Now().Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := store.CommitEncrypted("token", []byte("secret"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	if n := countRows(t, db, "data_writes"); n != 2 {
+		t.Errorf("data written %d times, want encrypted data always rewritten", n)
+	}
+}
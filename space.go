@@ -0,0 +1,51 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Fragmentation returns the number of free pages in the database file and
+// its total number of pages, as reported by PRAGMA freelist_count and PRAGMA
+// page_count. Free pages are left behind by deleted sessions until the
+// database is vacuumed, so their share of the total indicates how much space
+// a VACUUM would reclaim. Note that the counts cover the whole database file,
+// not only the sessions table.
+func (p *SQLitexStore) Fragmentation(ctx context.Context) (freePages, totalPages int, err error) {
+	defer p.logSlow(OpFragmentation, 0, time.Now())
+	defer p.wrapError(OpFragmentation, &err)
+
+	conn, put, err := p.take(ctx, OpFragmentation)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer put(&err)
+
+	freePages, err = pragmaInt(conn, "PRAGMA freelist_count")
+	if err != nil {
+		return 0, 0, err
+	}
+	totalPages, err = pragmaInt(conn, "PRAGMA page_count")
+	if err != nil {
+		return 0, 0, err
+	}
+	return freePages, totalPages, nil
+}
+
+// pragmaInt runs a pragma which returns a single integer.
+func pragmaInt(conn *sqlite.Conn, pragma string) (int, error) {
+	var n int
+	err := sqlitex.ExecuteTransient(conn, pragma,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+	return n, err
+}
@@ -0,0 +1,70 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestSplitData(t *testing.T) {
+	zqlsessiontest.RunConformance(t, zqlsessiontest.NewMemoryStore(t, zqlsession.WithSplitData()))
+}
+
+// BenchmarkSplitData compares lookups and expiry scans of sessions with large
+// data in a single table and with WithSplitData. Scan deletes expired
+// sessions and counts the rest, which read only the session table.
+func BenchmarkSplitData(b *testing.B) {
+	const n = 1000
+	data := bytes.Repeat([]byte("x"), 16<<10)
+	for _, bm := range []struct {
+		name string
+		opts []zqlsession.Option
+	}{
+		{"Single", nil},
+		{"Split", []zqlsession.Option{zqlsession.WithSplitData()}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			store := newStore(b, newPool(b), append(bm.opts, zqlsession.WithoutCleanup())...)
+			expiry := time.Now().Add(time.Hour)
+			sessions := make(map[string][]byte, n)
+			for i := 0; i < n; i++ {
+				sessions[fmt.Sprint("token", i)] = data
+			}
+			if err := store.CommitAll(sessions, expiry); err != nil {
+				b.Fatalf("commit all: %v", err)
+			}
+
+			b.Run("Exists", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := store.Exists(fmt.Sprint("token", i%n)); err != nil {
+						b.Fatalf("exists: %v", err)
+					}
+				}
+			})
+			b.Run("Find", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, _, err := store.Find(fmt.Sprint("token", i%n)); err != nil {
+						b.Fatalf("find: %v", err)
+					}
+				}
+			})
+			b.Run("Scan", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := store.DeleteExpired(context.Background()); err != nil {
+						b.Fatalf("delete expired: %v", err)
+					}
+					if _, err := store.Count(); err != nil {
+						b.Fatalf("count: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+// Stats counts the session lookups and lifecycle events of a store. The
+// counts are cumulative since the store was created or ResetStats or Reset was
+// last called.
+type Stats struct {
+	// Finds is the number of lookups by token, such as by Find, and Hits
+	// is how many of them found an active session.
+	Finds int64
+	Hits  int64
+	// Commits is the number of sessions written to the database, whether
+	// new or refreshed.
+	Commits int64
+	// Deleted and Expired count sessions as for the OpSessionDeleted and
+	// OpSessionsExpired events.
+	Deleted int64
+	Expired int64
+}
+
+// Stats returns a snapshot of the store's counters. The counters are read
+// together, so the snapshot is consistent even while operations are running.
+func (p *SQLitexStore) Stats() Stats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	return p.stats
+}
+
+// ResetStats sets the store's counters back to zero, returning their values
+// just before the reset. With periodic calls this gives the counts for each
+// interval, without losing any operation counted in between.
+func (p *SQLitexStore) ResetStats() Stats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+
+	s := p.stats
+	p.stats = Stats{}
+	return s
+}
+
+// countFind counts a lookup by token.
+func (p *SQLitexStore) countFind(found bool) {
+	p.statsMu.Lock()
+	p.stats.Finds++
+	if found {
+		p.stats.Hits++
+	}
+	p.statsMu.Unlock()
+}
+
+// lifecycle counts a session lifecycle event and reports it to the observer.
+func (p *SQLitexStore) lifecycle(op Op, rows int) {
+	p.statsMu.Lock()
+	switch op {
+	case OpSessionCreated, OpSessionRefreshed:
+		p.stats.Commits += int64(rows)
+	case OpSessionDeleted:
+		p.stats.Deleted += int64(rows)
+	case OpSessionsExpired:
+		p.stats.Expired += int64(rows)
+	}
+	p.statsMu.Unlock()
+
+	p.observe(Event{Op: op, Rows: rows})
+}
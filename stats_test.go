@@ -0,0 +1,63 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+// TestStatsConcurrent reads and resets the counters while lookups which all
+// hit are running, so that a torn snapshot would show fewer hits than finds.
+func TestStatsConcurrent(t *testing.T) {
+	const workers, finds = 4, 200
+	store := zqlsessiontest.NewMemoryStore(t)
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	store.ResetStats()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < finds; j++ {
+				if _, _, err := store.Find("token"); err != nil {
+					t.Errorf("find: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var total int64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if s := store.Stats(); s.Hits != s.Finds {
+			t.Fatalf("torn snapshot: %d finds but %d hits", s.Finds, s.Hits)
+		}
+		s := store.ResetStats()
+		if s.Hits != s.Finds {
+			t.Fatalf("torn reset: %d finds but %d hits", s.Finds, s.Hits)
+		}
+		total += s.Finds
+	}
+	// No lookup is lost between resets.
+	total += store.Stats().Finds
+	if want := int64(workers * finds); total != want {
+		t.Errorf("counted %d finds across resets, want %d", total, want)
+	}
+}
@@ -0,0 +1,153 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// streamFlushRows is how many sessions StreamJSON writes between flushes.
+const streamFlushRows = 100
+
+// streamedSession is a session as written by StreamJSON. Data is encoded as
+// base64 by encoding/json.
+type streamedSession struct {
+	Token  string    `json:"token"`
+	Data   []byte    `json:"data"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// StreamJSON writes every active session to w as newline-delimited JSON
+// objects with token, data and expiry fields, where data is base64 encoded.
+// Sessions are written as they are read, so memory use does not grow with the
+// number of sessions. If w has a Flush method, such as an http.ResponseWriter
+// implementing http.Flusher, it is flushed periodically so that readers see
+// sessions as they arrive.
+//
+// The stream stops with ctx's error once ctx is done, for example when the
+// client of an HTTP handler disconnects. A read transaction is held open for
+// the whole stream, so a slow writer delays WAL checkpoints.
+func (p *SQLitexStore) StreamJSON(ctx context.Context, w io.Writer) (err error) {
+	defer p.logSlow(OpStreamJSON, 0, time.Now())
+	defer p.wrapError(OpStreamJSON, &err)
+
+	conn, put, err := p.take(ctx, OpStreamJSON)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+
+	flusher, _ := w.(interface{ Flush() })
+	enc := json.NewEncoder(w)
+	var n int
+	err = sqlitex.Execute(conn, p.q.stream,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				token, ok := p.stripPrefix(stmt.ColumnText(0))
+				if !ok {
+					return nil
+				}
+				data, err := p.columnData(stmt, 1, stmt.ColumnText(0))
+				if err != nil {
+					return err
+				}
+				s := streamedSession{
+					Token:  token,
+					Data:   data,
+					Expiry: p.decodeExpiry(stmt, 2),
+				}
+				if err := enc.Encode(s); err != nil {
+					return err
+				}
+				n++
+				if flusher != nil && n%streamFlushRows == 0 {
+					flusher.Flush()
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Iterate calls fn with the token and data of every active session, without
+// loading them all into memory. fn receives its own copy of the data. If fn
+// returns an error the iteration stops and Iterate returns that error.
+//
+// The sessions are read within a single read transaction, so however slow fn
+// is, the iteration sees a consistent snapshot of the table as it was when the
+// first session was read: sessions committed or deleted by other goroutines
+// meanwhile are not seen, and no session is skipped or seen twice because
+// another was changed. A session which expires during the iteration may or may
+// not be included. In WAL mode, the default for an sqlitex.Pool, writers carry
+// on while the snapshot is held, but the WAL cannot be checkpointed past it;
+// in other journal modes writers wait until the iteration ends.
+//
+// fn should be quick and must not use the store, which could wait forever on
+// a pool of one connection.
+func (p *SQLitexStore) Iterate(ctx context.Context, fn func(token string, data []byte) error) (err error) {
+	defer p.logSlow(OpIterate, 0, time.Now())
+	defer p.wrapError(OpIterate, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(ctx, OpIterate)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+
+	return p.iterate(ctx, conn, p.q.stream, nil, fn)
+}
+
+// iterate calls fn with the token and data of each session selected by query,
+// which must select them as its first two columns, within a read transaction.
+func (p *SQLitexStore) iterate(ctx context.Context, conn *sqlite.Conn, query string, args []any, fn func(token string, data []byte) error) (err error) {
+	// The savepoint is rolled back rather than released when fn fails,
+	// which is harmless as nothing is written.
+	defer sqlitex.Save(conn)(&err)
+
+	return sqlitex.Execute(conn, query,
+		&sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				token, ok := p.stripPrefix(stmt.ColumnText(0))
+				if !ok {
+					return nil
+				}
+				data, err := p.columnData(stmt, 1, stmt.ColumnText(0))
+				if err != nil {
+					return err
+				}
+				return fn(token, data)
+			},
+		})
+}
@@ -0,0 +1,79 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestIterateSnapshot changes the table from another goroutine during a slow
+// iteration, and checks the iteration sees the table as it was.
+func TestIterateSnapshot(t *testing.T) {
+	const n = 100
+	db := newPool(t)
+	store := newStore(t, db)
+	writer := newStore(t, db)
+	expiry := time.Now().Add(time.Hour)
+	want := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		token := fmt.Sprintf("token%03d", i)
+		want[token] = "old"
+		if err := store.Commit(token, []byte("old"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+
+	seen := make(map[string]string, n)
+	err := store.Iterate(context.Background(), func(token string, data []byte) error {
+		if _, ok := seen[token]; ok {
+			t.Errorf("%q seen twice", token)
+		}
+		seen[token] = string(data)
+		if len(seen) != 1 {
+			return nil
+		}
+		// Rewrite every session, which moves their rows, delete half of
+		// them and add more, while the iteration is under way.
+		done := make(chan error)
+		go func() {
+			for i := 0; i < n; i++ {
+				token := fmt.Sprintf("token%03d", i)
+				if err := writer.Commit(token, []byte("new"), expiry); err != nil {
+					done <- err
+					return
+				}
+				if i%2 == 0 {
+					if err := writer.Delete(token); err != nil {
+						done <- err
+						return
+					}
+				}
+				if err := writer.Commit(fmt.Sprint("added", i), []byte("new"), expiry); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+		return <-done
+	})
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	if len(seen) != len(want) {
+		t.Errorf("saw %d sessions, want %d", len(seen), len(want))
+	}
+	for token, data := range want {
+		if seen[token] != data {
+			t.Errorf("%q: got %q, want %q from the snapshot", token, seen[token], data)
+		}
+	}
+
+	// Once the iteration is over the changes are seen.
+	if n, err := store.Count(); err != nil || n != 150 {
+		t.Errorf("count after the iteration: got %d, %v, want 150", n, err)
+	}
+}
@@ -0,0 +1,30 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// tokenBytes is the number of random bytes in a token from NewToken.
+const tokenBytes = 32
+
+// NewToken returns a new session token, for creating sessions outside of scs
+// such as in admin tools. By default tokens are 32 bytes from crypto/rand,
+// encoded as unpadded base64url. A different generator can be set with
+// WithTokenGenerator.
+func (p *SQLitexStore) NewToken() (string, error) {
+	if p.tokenGenerator != nil {
+		return p.tokenGenerator()
+	}
+	return randomToken()
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
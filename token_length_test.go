@@ -0,0 +1,91 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestMaxTokenLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	store := newStore(t, db, zqlsession.WithAcquireTimeout(time.Second))
+
+	// With the only connection held, an operation which reached the
+	// database would time out rather than being rejected.
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	defer db.Put(conn)
+
+	token := strings.Repeat("x", 1<<20)
+	start := time.Now()
+	if b, found, err := store.Find(token); err != nil || found || b != nil {
+		t.Errorf("find: got %q, %v, %v, want not found", b, found, err)
+	}
+	if b, found, err := store.FindOn(conn, token); err != nil || found || b != nil {
+		t.Errorf("find on: got %q, %v, %v, want not found", b, found, err)
+	}
+	if _, err := store.Exists(token); !errors.Is(err, zqlsession.ErrTokenTooLong) {
+		t.Errorf("exists: got %v, want ErrTokenTooLong", err)
+	}
+	if err := store.Commit(token, []byte("data"), time.Now().Add(time.Hour)); !errors.Is(err, zqlsession.ErrTokenTooLong) {
+		t.Errorf("commit: got %v, want ErrTokenTooLong", err)
+	}
+	if err := store.Delete(token); !errors.Is(err, zqlsession.ErrTokenTooLong) {
+		t.Errorf("delete: got %v, want ErrTokenTooLong", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("rejecting the token took %v", d)
+	}
+}
+
+func TestMaxTokenLengthOption(t *testing.T) {
+	def := zqlsessiontest.NewMemoryStore(t)
+	short := zqlsessiontest.NewMemoryStore(t, zqlsession.WithMaxTokenLength(8))
+	unlimited := zqlsessiontest.NewMemoryStore(t, zqlsession.WithMaxTokenLength(0))
+	expiry := time.Now().Add(time.Hour)
+
+	if err := def.Commit(strings.Repeat("x", 256), []byte("data"), expiry); err != nil {
+		t.Errorf("commit at the default limit: %v", err)
+	}
+	if err := def.Commit(strings.Repeat("x", 257), []byte("data"), expiry); !errors.Is(err, zqlsession.ErrTokenTooLong) {
+		t.Errorf("commit past the default limit: got %v, want ErrTokenTooLong", err)
+	}
+	if err := short.Commit("12345678", []byte("data"), expiry); err != nil {
+		t.Errorf("commit at the limit: %v", err)
+	}
+	if err := short.Commit("123456789", []byte("data"), expiry); !errors.Is(err, zqlsession.ErrTokenTooLong) {
+		t.Errorf("commit past the limit: got %v, want ErrTokenTooLong", err)
+	}
+	err := short.WithTx(context.Background(), func(tx *zqlsession.Tx) error {
+		if _, found, err := tx.Find("123456789"); err != nil || found {
+			t.Errorf("tx find past the limit: got %v, %v, want not found", found, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("with tx: %v", err)
+	}
+	token := strings.Repeat("x", 4096)
+	if err := unlimited.Commit(token, []byte("data"), expiry); err != nil {
+		t.Fatalf("commit without a limit: %v", err)
+	}
+	if _, found, err := unlimited.Find(token); err != nil || !found {
+		t.Errorf("find without a limit: got %v, %v, want the session", found, err)
+	}
+}
@@ -0,0 +1,46 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestNewToken(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	a, err := store.NewToken()
+	if err != nil {
+		t.Fatalf("new token: %v", err)
+	}
+	b, err := store.NewToken()
+	if err != nil {
+		t.Fatalf("new token: %v", err)
+	}
+	if a == b {
+		t.Errorf("new token returned %q twice", a)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(a)
+	if err != nil || len(raw) != 32 {
+		t.Errorf("token %q: got %d bytes, %v, want 32 bytes of base64url", a, len(raw), err)
+	}
+}
+
+func TestTokenGenerator(t *testing.T) {
+	var n int
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithTokenGenerator(func() (string, error) {
+		n++
+		return fmt.Sprint("token", n), nil
+	}))
+
+	for _, want := range []string{"token1", "token2"} {
+		if got, err := store.NewToken(); err != nil || got != want {
+			t.Errorf("new token: got %q, %v, want %q", got, err, want)
+		}
+	}
+}
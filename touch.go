@@ -0,0 +1,199 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// FindAndMaybeTouch is like Find, but also consults the WithTouchPolicy
+// function with the session's current expiry, and extends the session to the
+// new expiry it returns if it decides the session should be touched. The
+// lookup and the touch happen in one transaction. Without a touch policy, or
+// when the store is read-only, it behaves exactly like Find.
+func (p *SQLitexStore) FindAndMaybeTouch(token string) (_ []byte, _ bool, err error) {
+	if p.touchPolicy == nil || p.readOnly {
+		return p.Find(token)
+	}
+	defer p.logSlow(OpFindAndMaybeTouch, len(token), time.Now())
+	defer p.wrapError(OpFindAndMaybeTouch, &err)
+
+	if token == "" {
+		return nil, false, nil
+	}
+	if p.tokenTooLong(token) {
+		return nil, false, ErrTokenTooLong
+	}
+	if p.writeBehind != nil {
+		if bw, ok := p.writeBehind.lookup(p.normalizeToken(token)); ok {
+			return p.touchBuffered(bw)
+		}
+	}
+	conn, put, err := p.take(context.Background(), OpFindAndMaybeTouch)
+	if err != nil {
+		return nil, false, err
+	}
+	defer put(&err)
+
+	return p.findAndMaybeTouch(conn, token)
+}
+
+func (p *SQLitexStore) findAndMaybeTouch(conn *sqlite.Conn, token string) (b []byte, found bool, err error) {
+	token = p.normalizeToken(token)
+	if token == "" {
+		return nil, false, nil
+	}
+	defer sqlitex.Save(conn)(&err)
+
+	var expiry time.Time
+	err = sqlitex.Execute(conn, p.q.findExpiry,
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				found = true
+				expiry = p.decodeExpiry(stmt, 1)
+				b, err = p.columnData(stmt, 0, token)
+				return err
+			},
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	p.countFind(found)
+	if !found {
+		return nil, false, nil
+	}
+	p.countAccess(token)
+
+	newExpiry, touch := p.touchPolicy(expiry, time.Now())
+	if !touch {
+		return b, true, nil
+	}
+	err = sqlitex.Execute(conn, p.q.touch,
+		&sqlitex.ExecOptions{
+			Args: []any{p.encodeExpiry(newExpiry), token},
+		})
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// touchBuffered applies the touch policy to a session with a buffered write,
+// buffering the extended expiry in turn.
+func (p *SQLitexStore) touchBuffered(bw bufferedWrite) ([]byte, bool, error) {
+	if bw.deleted || !time.Now().Before(bw.expiry) {
+		p.countFind(false)
+		return nil, false, nil
+	}
+	p.countFind(true)
+	p.countAccess(p.normalizeToken(bw.token))
+	b := make([]byte, len(bw.data))
+	copy(b, bw.data)
+	newExpiry, touch := p.touchPolicy(bw.expiry, time.Now())
+	if !touch {
+		return b, true, nil
+	}
+	if err := p.bufferCommit(bw.token, bw.data, newExpiry, bw.encrypted); err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// touchBatchSize is the number of tokens updated by each statement of
+// TouchBatch, which keeps well below SQLite's limit on bound parameters.
+const touchBatchSize = 500
+
+// TouchBatch sets the expiry of the sessions of all the given tokens in one
+// transaction, returning the number of sessions updated. Tokens without an
+// active session are skipped, so an expired session is not brought back; it
+// must be committed again instead.
+func (p *SQLitexStore) TouchBatch(tokens []string, expiry time.Time) (n int, err error) {
+	defer p.logSlow(OpTouchBatch, 0, time.Now())
+	defer p.wrapError(OpTouchBatch, &err)
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+	seen := make(map[string]bool, len(tokens))
+	keys := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		key := p.normalizeToken(token)
+		if key == "" || p.tokenTooLong(key) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if p.writeBehind != nil {
+			if bw, ok := p.writeBehind.lookup(key); ok {
+				if bw.deleted || !time.Now().Before(bw.expiry) {
+					continue
+				}
+				if err := p.bufferCommit(bw.token, bw.data, expiry, bw.encrypted); err != nil {
+					return n, err
+				}
+				n++
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return n, nil
+	}
+
+	conn, put, err := p.take(context.Background(), OpTouchBatch)
+	if err != nil {
+		return n, err
+	}
+	defer put(&err)
+
+	touched, err := p.touchBatch(conn, keys, expiry)
+	return n + touched, err
+}
+
+// touchBatch sets the expiry of the active sessions of the given normalized
+// tokens, touchBatchSize tokens at a time.
+func (p *SQLitexStore) touchBatch(conn *sqlite.Conn, tokens []string, expiry time.Time) (n int, err error) {
+	defer p.checkCorrupt(&err)
+	defer sqlitex.Save(conn)(&err)
+
+	encoded := p.encodeExpiry(expiry)
+	for len(tokens) > 0 {
+		chunk := tokens
+		if len(chunk) > touchBatchSize {
+			chunk = chunk[:touchBatchSize]
+		}
+		tokens = tokens[len(chunk):]
+
+		var query strings.Builder
+		query.WriteString(p.q.touchBatch)
+		query.WriteString("(")
+		args := make([]any, 0, len(chunk)+1)
+		args = append(args, encoded)
+		for i, token := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("$" + strconv.Itoa(i+2))
+			args = append(args, token)
+		}
+		query.WriteString(")")
+
+		// The query varies with the chunk size, so it is not cached.
+		err = sqlitex.ExecuteTransient(conn, query.String(),
+			&sqlitex.ExecOptions{
+				Args: args,
+			})
+		if err != nil {
+			return 0, err
+		}
+		n += conn.Changes()
+	}
+	return n, nil
+}
@@ -0,0 +1,89 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestFindAndMaybeTouch(t *testing.T) {
+	extended := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithTouchPolicy(
+		func(current, now time.Time) (time.Time, bool) {
+			return extended, current.Before(now.Add(time.Hour))
+		}))
+
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	b, found, err := store.FindAndMaybeTouch("token")
+	if err != nil || !found || string(b) != "data" {
+		t.Fatalf("find and touch: got %q, %v, %v, want %q", b, found, err, "data")
+	}
+	dump, _, err := store.DumpRow("token")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if d := dump.Expiry.Sub(extended); d < -time.Second || d > time.Second {
+		t.Errorf("expiry: got %v, want %v", dump.Expiry, extended)
+	}
+}
+
+func TestFindAndMaybeTouchWithoutPolicy(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	expiry := time.Now().Add(time.Minute)
+	if err := store.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	b, found, err := store.FindAndMaybeTouch("token")
+	if err != nil || !found || string(b) != "data" {
+		t.Fatalf("find: got %q, %v, %v, want %q", b, found, err, "data")
+	}
+	if _, found, err := store.FindAndMaybeTouch("missing"); err != nil || found {
+		t.Errorf("find missing: got %v, %v, want false", found, err)
+	}
+}
+
+// TestFindAndMaybeTouchHalfway uses a policy which only extends sessions past
+// half of their lifetime, so that most reads do not write.
+func TestFindAndMaybeTouchHalfway(t *testing.T) {
+	const lifetime = time.Hour
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithTouchPolicy(
+		func(current, now time.Time) (time.Time, bool) {
+			return now.Add(lifetime), current.Sub(now) < lifetime/2
+		}))
+
+	fresh := time.Now().Add(lifetime - time.Minute).Truncate(time.Second)
+	stale := time.Now().Add(lifetime/2 - time.Minute).Truncate(time.Second)
+	if err := store.Commit("fresh", []byte("data"), fresh); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Commit("stale", []byte("data"), stale); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	for _, token := range []string{"fresh", "stale"} {
+		if _, found, err := store.FindAndMaybeTouch(token); err != nil || !found {
+			t.Fatalf("find and touch %q: got %v, %v, want the session", token, found, err)
+		}
+	}
+
+	dump, _, err := store.DumpRow("fresh")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if !dump.Expiry.Equal(fresh) {
+		t.Errorf("fresh expiry: got %v, want it unchanged at %v", dump.Expiry, fresh)
+	}
+	dump, _, err = store.DumpRow("stale")
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if d := time.Until(dump.Expiry) - lifetime; d < -time.Minute || d > 0 {
+		t.Errorf("stale expiry: got %v, want it extended by %v", dump.Expiry, lifetime)
+	}
+}
@@ -0,0 +1,274 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Tx is a set of session operations running on a single connection inside a
+// transaction started by WithTx. A Tx must not be used after the function
+// passed to WithTx has returned.
+type Tx struct {
+	store *SQLitexStore
+	conn  *sqlite.Conn
+}
+
+// WithTx runs fn inside a transaction on a single connection taken from the
+// pool. If fn returns nil the transaction is committed, otherwise (or if fn
+// panics) every change made through the Tx is rolled back.
+//
+// This allows read-modify-write operations on a session, such as only
+// updating a session when its current data meets some condition, to be done
+// atomically.
+//
+// The transaction is started with BEGIN IMMEDIATE, which takes the database's
+// write lock up front. A DEFERRED transaction only takes it at the first
+// write, and if another connection has written in the meantime the upgrade
+// fails with SQLITE_BUSY however long the busy timeout, so two concurrent
+// read-modify-write transactions could not both succeed. With IMMEDIATE the
+// second waits for the first to finish instead. The cost is that transactions
+// which only read are serialized with writers too, so reads which need no
+// transaction should use the store's own methods. Read-only stores, see
+// WithReadOnly, use a DEFERRED transaction.
+//
+// Writes buffered by WithWriteBehind are flushed before the transaction
+// starts, so that it sees them and they cannot later overwrite its writes.
+func (p *SQLitexStore) WithTx(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	defer p.logSlow(OpTx, 0, time.Now())
+	defer p.wrapError(OpTx, &err)
+
+	conn, put, err := p.take(ctx, OpTx)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil && !p.readOnly {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+	var endFn func(*error)
+	if p.readOnly {
+		endFn = sqlitex.Save(conn)
+	} else {
+		endFn, err = sqlitex.ImmediateTransaction(conn)
+		if err != nil {
+			return err
+		}
+	}
+	defer endFn(&err)
+	return fn(&Tx{store: p, conn: conn})
+}
+
+// Find returns the data for a given session token within the transaction. If
+// the session token is not found or is expired, the returned exists flag will
+// be set to false.
+func (tx *Tx) Find(token string) (_ []byte, _ bool, err error) {
+	defer tx.store.wrapCode(OpFind, &err)
+
+	return tx.store.find(tx.conn, token)
+}
+
+// Commit adds a session token and data within the transaction with the given
+// expiry time. If the session token already exists, then the data and expiry
+// time are updated.
+func (tx *Tx) Commit(token string, b []byte, expiry time.Time) (err error) {
+	defer tx.store.wrapCode(OpCommit, &err)
+
+	skip, err := tx.store.pastExpiry(expiry)
+	if err != nil {
+		return err
+	}
+	expiry = tx.store.jitter(expiry)
+	return tx.store.commitOrDelete(tx.conn, token, b, expiry, skip)
+}
+
+// Delete removes a session token and corresponding data within the
+// transaction.
+func (tx *Tx) Delete(token string) (err error) {
+	defer tx.store.wrapCode(OpDelete, &err)
+
+	return tx.store.delete(tx.conn, token)
+}
+
+// FindOrCommit returns the data of the session with the given token if it
+// exists and has not expired. Otherwise it commits defaultData with the given
+// expiry and returns that, with created set to true. The lookup and commit run
+// in a single IMMEDIATE transaction, so when two callers race to create the
+// same token only one creates it and the other is returned its data.
+func (p *SQLitexStore) FindOrCommit(token string, defaultData []byte, expiry time.Time) (data []byte, created bool, err error) {
+	defer p.logSlow(OpFindOrCommit, len(token), time.Now())
+	defer p.wrapError(OpFindOrCommit, &err)
+
+	if token == "" {
+		return nil, false, ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return nil, false, ErrTokenTooLong
+	}
+	if p.readOnly {
+		return nil, false, ErrReadOnly
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return nil, false, err
+	}
+	expiry = p.jitter(expiry)
+	conn, put, err := p.take(context.Background(), OpFindOrCommit)
+	if err != nil {
+		return nil, false, err
+	}
+	defer put(&err)
+
+	// As with Swap, buffered writes are flushed first, so that a buffered
+	// session is found and a buffered write cannot later overwrite the
+	// committed default.
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, false, err
+		}
+	}
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return nil, false, err
+	}
+	defer endFn(&err)
+
+	data, found, err := p.find(conn, token)
+	if err != nil {
+		return nil, false, err
+	}
+	if found {
+		return data, false, nil
+	}
+	if skip {
+		return defaultData, false, nil
+	}
+	if err := p.commit(conn, token, defaultData, expiry); err != nil {
+		return nil, false, err
+	}
+	return defaultData, true, nil
+}
+
+// Swap commits b with the given expiry and returns the data it replaced, for
+// example to log how a session changed. existed is false if the token had no
+// session, or only an expired one. The lookup and commit run in a single
+// IMMEDIATE transaction, so no other write can come between them.
+func (p *SQLitexStore) Swap(token string, b []byte, expiry time.Time) (previous []byte, existed bool, err error) {
+	defer p.logSlow(OpSwap, len(token), time.Now())
+	defer p.wrapError(OpSwap, &err)
+
+	if token == "" {
+		return nil, false, ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return nil, false, ErrTokenTooLong
+	}
+	if p.readOnly {
+		return nil, false, ErrReadOnly
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return nil, false, err
+	}
+	expiry = p.jitter(expiry)
+	conn, put, err := p.take(context.Background(), OpSwap)
+	if err != nil {
+		return nil, false, err
+	}
+	defer put(&err)
+
+	// Buffered writes are flushed first, so that the previous data is the
+	// latest and a buffered write cannot later overwrite b.
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, false, err
+		}
+	}
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return nil, false, err
+	}
+	defer endFn(&err)
+
+	previous, existed, err = p.find(conn, token)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := p.commitOrDelete(conn, token, b, expiry, skip); err != nil {
+		return nil, false, err
+	}
+	return previous, existed, nil
+}
+
+// FindOn is like Find, but runs on conn rather than a connection from the
+// store's pool. This lets session reads take part in a transaction the caller
+// already has open on conn, for example one which also touches application
+// tables. The caller owns conn and its transaction lifecycle; conn must be
+// connected to the database holding the store's table. A write to token
+// buffered by WithWriteBehind is returned as Find returns it.
+func (p *SQLitexStore) FindOn(conn *sqlite.Conn, token string) (_ []byte, _ bool, err error) {
+	defer p.logSlow(OpFind, len(token), time.Now())
+	defer p.wrapError(OpFind, &err)
+
+	if p.closed.Load() {
+		return nil, false, ErrClosed
+	}
+	if p.writeBehind != nil {
+		if b, exists, ok := p.findBuffered(token); ok {
+			return b, exists, nil
+		}
+	}
+	return p.find(conn, token)
+}
+
+// CommitOn is like Commit, but runs on conn rather than a connection from the
+// store's pool, so that the session write commits or rolls back together with
+// the caller's transaction on conn. The caller owns conn and its transaction
+// lifecycle. A write to token buffered by WithWriteBehind is written on conn
+// first, so that it cannot later overwrite b, and commits or rolls back with
+// the caller's transaction too.
+func (p *SQLitexStore) CommitOn(conn *sqlite.Conn, token string, b []byte, expiry time.Time) (err error) {
+	defer p.logSlow(OpCommit, len(token), time.Now())
+	defer p.wrapError(OpCommit, &err)
+
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return err
+	}
+	expiry = p.jitter(expiry)
+	if p.writeBehind != nil {
+		if err := p.flushToken(conn, token); err != nil {
+			return err
+		}
+	}
+	return p.commitOrDelete(conn, token, b, expiry, skip)
+}
+
+// DeleteOn is like Delete, but runs on conn rather than a connection from the
+// store's pool. The caller owns conn and its transaction lifecycle. As with
+// CommitOn, a write to token buffered by WithWriteBehind is written on conn
+// first.
+func (p *SQLitexStore) DeleteOn(conn *sqlite.Conn, token string) (err error) {
+	defer p.logSlow(OpDelete, len(token), time.Now())
+	defer p.wrapError(OpDelete, &err)
+
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	if p.writeBehind != nil {
+		if err := p.flushToken(conn, token); err != nil {
+			return err
+		}
+	}
+	return p.delete(conn, token)
+}
@@ -0,0 +1,276 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestWithTxConditionalUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t)
+	expiry := time.Now().Add(time.Hour)
+
+	if err := store.Commit("token", []byte("cart:1"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// Only update the session while it still holds the data it was read
+	// with, so concurrent updates are not lost.
+	update := func(from, to string) error {
+		return store.WithTx(ctx, func(tx *zqlsession.Tx) error {
+			b, found, err := tx.Find("token")
+			if err != nil || !found || string(b) != from {
+				return err
+			}
+			return tx.Commit("token", []byte(to), expiry)
+		})
+	}
+	if err := update("cart:1", "cart:2"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := update("cart:1", "cart:3"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if b, _, _ := store.Find("token"); string(b) != "cart:2" {
+		t.Errorf("find: got %q, want %q", b, "cart:2")
+	}
+
+	// Concurrent increments in transactions are serialized, so none is
+	// lost.
+	const n = 20
+	if err := store.Commit("counter", []byte{0}, expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.WithTx(ctx, func(tx *zqlsession.Tx) error {
+				b, _, err := tx.Find("counter")
+				if err != nil {
+					return err
+				}
+				return tx.Commit("counter", []byte{b[0] + 1}, expiry)
+			})
+			if err != nil {
+				t.Errorf("increment: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if b, _, _ := store.Find("counter"); len(b) != 1 || b[0] != n {
+		t.Errorf("counter: got %v, want [%d]", b, n)
+	}
+}
+
+// TestWithTxTwoWriters runs read-modify-write transactions from two stores,
+// each with a pool of its own, on one database file, as two processes would.
+// A DEFERRED transaction would fail with SQLITE_BUSY when upgrading to a
+// write after the other store wrote.
+func TestWithTxTwoWriters(t *testing.T) {
+	const writers, increments = 4, 25
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	var stores []*zqlsession.SQLitexStore
+	for i := 0; i < 2; i++ {
+		db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: writers})
+		if err != nil {
+			t.Fatalf("open database: %v", err)
+		}
+		defer db.Close()
+		stores = append(stores, newStore(t, db))
+	}
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	if err := stores[0].Commit("counter", []byte{0}, expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		store := stores[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				err := store.WithTx(ctx, func(tx *zqlsession.Tx) error {
+					b, _, err := tx.Find("counter")
+					if err != nil {
+						return err
+					}
+					return tx.Commit("counter", []byte{b[0] + 1}, expiry)
+				})
+				if err != nil {
+					t.Errorf("increment: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("writers deadlocked")
+	}
+	if b, _, _ := stores[1].Find("counter"); len(b) != 1 || b[0] != writers*increments {
+		t.Errorf("counter: got %v, want [%d]", b, writers*increments)
+	}
+}
+
+func TestWithTxRollback(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+	errAbort := errors.New("abort")
+
+	err := store.WithTx(context.Background(), func(tx *zqlsession.Tx) error {
+		if err := tx.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("tx: got %v, want %v", err, errAbort)
+	}
+	if _, found, _ := store.Find("token"); found {
+		t.Error("commit was not rolled back")
+	}
+}
+
+func TestFindOrCommit(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+	expiry := time.Now().Add(time.Hour)
+
+	b, created, err := store.FindOrCommit("token", []byte("default"), expiry)
+	if err != nil || !created || string(b) != "default" {
+		t.Fatalf("create: got %q, %v, %v, want %q, true", b, created, err, "default")
+	}
+	b, created, err = store.FindOrCommit("token", []byte("other"), expiry)
+	if err != nil || created || string(b) != "default" {
+		t.Fatalf("find: got %q, %v, %v, want %q, false", b, created, err, "default")
+	}
+}
+
+func TestFindOrCommitWriteBehind(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithWriteBehind(time.Hour, 100))
+	expiry := time.Now().Add(time.Hour)
+
+	if err := store.Commit("token", []byte("buffered"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	b, created, err := store.FindOrCommit("token", []byte("default"), expiry)
+	if err != nil || created || string(b) != "buffered" {
+		t.Fatalf("find buffered: got %q, %v, %v, want %q, false", b, created, err, "buffered")
+	}
+
+	if err := store.Delete("token"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	b, created, err = store.FindOrCommit("token", []byte("default"), expiry)
+	if err != nil || !created || string(b) != "default" {
+		t.Fatalf("create after buffered delete: got %q, %v, %v, want %q, true", b, created, err, "default")
+	}
+	if b, _, _ := store.Find("token"); string(b) != "default" {
+		t.Errorf("find: got %q, want %q", b, "default")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithWriteBehind(time.Hour, 100))
+	expiry := time.Now().Add(time.Hour)
+
+	if err := store.Commit("token", []byte("old"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	previous, existed, err := store.Swap("token", []byte("new"), expiry)
+	if err != nil || !existed || string(previous) != "old" {
+		t.Fatalf("swap: got %q, %v, %v, want %q, true", previous, existed, err, "old")
+	}
+	if b, _, _ := store.Find("token"); string(b) != "new" {
+		t.Errorf("find: got %q, want %q", b, "new")
+	}
+}
+
+func TestWithTxWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithWriteBehind(time.Hour, 100))
+	expiry := time.Now().Add(time.Hour)
+
+	if err := store.Commit("token", []byte("buffered"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	err := store.WithTx(ctx, func(tx *zqlsession.Tx) error {
+		b, found, err := tx.Find("token")
+		if err != nil || !found || string(b) != "buffered" {
+			t.Errorf("tx find: got %q, %v, %v, want %q", b, found, err, "buffered")
+		}
+		return tx.Commit("token", []byte("tx"), expiry)
+	})
+	if err != nil {
+		t.Fatalf("with tx: %v", err)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if b, _, _ := store.Find("token"); string(b) != "tx" {
+		t.Errorf("find after flush: got %q, want %q", b, "tx")
+	}
+}
+
+func TestOnWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithWriteBehind(time.Hour, 100))
+	expiry := time.Now().Add(time.Hour)
+
+	conn, err := db.Take(ctx)
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	defer db.Put(conn)
+
+	if err := store.Commit("kept", []byte("buffered"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if b, found, err := store.FindOn(conn, "kept"); err != nil || !found || string(b) != "buffered" {
+		t.Errorf("find on: got %q, %v, %v, want %q", b, found, err, "buffered")
+	}
+
+	if err := store.Commit("committed", []byte("buffered"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.CommitOn(conn, "committed", []byte("on"), expiry); err != nil {
+		t.Fatalf("commit on: %v", err)
+	}
+	if err := store.Commit("deleted", []byte("buffered"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.DeleteOn(conn, "deleted"); err != nil {
+		t.Fatalf("delete on: %v", err)
+	}
+
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if b, _, _ := store.Find("committed"); string(b) != "on" {
+		t.Errorf("find committed: got %q, want %q", b, "on")
+	}
+	if _, found, _ := store.Find("deleted"); found {
+		t.Error("found a session deleted on conn after a flush")
+	}
+	if b, _, _ := store.Find("kept"); string(b) != "buffered" {
+		t.Errorf("find kept: got %q, want %q", b, "buffered")
+	}
+}
@@ -0,0 +1,153 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// DedupeByUserID deletes all but the keep newest sessions of each user,
+// returning the number of sessions deleted. Sessions are ordered by creation
+// when the WithSequence option is used and by expiry otherwise. Each user's
+// sessions are deduplicated in their own transaction.
+//
+// This is a one-off maintenance operation for tables where users have
+// accumulated more sessions than they should have. It only affects sessions
+// with a user_id, see WithUserID, and with WithTokenPrefix only sessions in the
+// store's namespace.
+func (p *SQLitexStore) DedupeByUserID(keep int) (_ int, err error) {
+	defer p.logSlow(OpDedupeByUserID, 0, time.Now())
+	defer p.wrapError(OpDedupeByUserID, &err)
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	conn, put, err := p.take(context.Background(), OpDedupeByUserID)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	prefix := p.scopePrefix("")
+	var users []string
+	err = sqlitex.Execute(conn, p.q.userIDs,
+		&sqlitex.ExecOptions{
+			Args: []any{prefix, prefixUpperBound(prefix)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				users = append(users, stmt.ColumnText(0))
+				return nil
+			},
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for _, user := range users {
+		n, err := p.dedupeUserID(conn, user, keep)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+func (p *SQLitexStore) dedupeUserID(conn *sqlite.Conn, user string, keep int) (n int, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	prefix := p.scopePrefix("")
+	err = sqlitex.Execute(conn, p.q.dedupeUserID,
+		&sqlitex.ExecOptions{
+			Args: []any{user, prefix, prefixUpperBound(prefix), keep},
+		})
+	if err != nil {
+		return 0, err
+	}
+	return conn.Changes(), nil
+}
+
+// SessionCountsByUser returns the number of active sessions of each user with
+// at least one active session. Sessions without a user_id are not counted, see
+// WithUserID. With WithTokenPrefix only sessions in the store's namespace are
+// counted.
+func (p *SQLitexStore) SessionCountsByUser() (_ map[string]int, err error) {
+	defer p.logSlow(OpSessionCountsByUser, 0, time.Now())
+	defer p.wrapError(OpSessionCountsByUser, &err)
+
+	return p.sessionCountsByUser(p.q.countsByUser)
+}
+
+// SessionCountsByUserAbove is like SessionCountsByUser but only returns users
+// with more than n active sessions, which is useful for flagging anomalies.
+func (p *SQLitexStore) SessionCountsByUserAbove(n int) (_ map[string]int, err error) {
+	defer p.logSlow(OpSessionCountsByUser, 0, time.Now())
+	defer p.wrapError(OpSessionCountsByUser, &err)
+
+	return p.sessionCountsByUser(p.q.countsByUserAbove, n)
+}
+
+func (p *SQLitexStore) sessionCountsByUser(query string, args ...any) (_ map[string]int, err error) {
+	conn, put, err := p.take(context.Background(), OpSessionCountsByUser)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := p.scopePrefix("")
+	args = append([]any{prefix, prefixUpperBound(prefix)}, args...)
+	counts := make(map[string]int)
+	err = sqlitex.Execute(conn, query,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				counts[stmt.ColumnText(0)] = stmt.ColumnInt(1)
+				return nil
+			},
+			Args: args,
+		})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// IterateByUserID calls fn with the token and data of each active session of
+// the given user, as recorded by WithUserID, without loading them all into
+// memory. fn receives its own copy of the data. If fn returns an error the
+// iteration stops and IterateByUserID returns that error.
+//
+// As with Iterate, the sessions are read from a consistent snapshot, and fn
+// should be quick and must not use the store, which could wait forever on a
+// pool of one connection.
+func (p *SQLitexStore) IterateByUserID(ctx context.Context, userID string, fn func(token string, data []byte) error) (err error) {
+	defer p.logSlow(OpIterateByUserID, 0, time.Now())
+	defer p.wrapError(OpIterateByUserID, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(ctx, OpIterateByUserID)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+
+	return p.iterate(ctx, conn, p.q.iterateByUserID, []any{userID}, fn)
+}
@@ -0,0 +1,145 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// userOf returns the user of session data of the form "user:rest".
+func userOf(b []byte) string {
+	user, _, _ := strings.Cut(string(b), ":")
+	return user
+}
+
+func TestDedupeByUserID(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithUserID(userOf))
+
+	// alice has three sessions, of which the two expiring last are kept.
+	now := time.Now()
+	sessions := []struct {
+		token, data string
+		expiry      time.Duration
+	}{
+		{"a1", "alice:1", 1 * time.Hour},
+		{"a2", "alice:2", 3 * time.Hour},
+		{"a3", "alice:3", 2 * time.Hour},
+		{"b1", "bob:1", time.Hour},
+		{"anon", "", time.Hour},
+	}
+	for _, s := range sessions {
+		if err := store.Commit(s.token, []byte(s.data), now.Add(s.expiry)); err != nil {
+			t.Fatalf("commit %q: %v", s.token, err)
+		}
+	}
+	n, err := store.DedupeByUserID(2)
+	if err != nil || n != 1 {
+		t.Fatalf("dedupe: got %d, %v, want 1", n, err)
+	}
+	for token, want := range map[string]bool{"a1": false, "a2": true, "a3": true, "b1": true, "anon": true} {
+		if _, found, _ := store.Find(token); found != want {
+			t.Errorf("find %q: got %v, want %v", token, found, want)
+		}
+	}
+}
+
+func TestDedupeByUserIDSequence(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t,
+		zqlsession.WithUserID(userOf), zqlsession.WithSequence())
+
+	// With sequence numbers the newest created sessions are kept,
+	// whatever their expiry.
+	now := time.Now()
+	for i, token := range []string{"a1", "a2", "a3"} {
+		expiry := now.Add(time.Duration(3-i) * time.Hour)
+		if err := store.Commit(token, []byte("alice:"+token), expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	if n, err := store.DedupeByUserID(1); err != nil || n != 2 {
+		t.Fatalf("dedupe: got %d, %v, want 2", n, err)
+	}
+	if _, found, _ := store.Find("a3"); !found {
+		t.Error("newest session was deleted")
+	}
+}
+
+func TestSessionCountsByUser(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithUserID(userOf))
+
+	expiry := time.Now().Add(time.Hour)
+	for _, data := range []string{"alice:1", "alice:2", "bob:1"} {
+		if err := store.Commit(data, []byte(data), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	counts, err := store.SessionCountsByUser()
+	if err != nil {
+		t.Fatalf("counts by user: %v", err)
+	}
+	if want := map[string]int{"alice": 2, "bob": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("counts by user: got %v, want %v", counts, want)
+	}
+	above, err := store.SessionCountsByUserAbove(1)
+	if err != nil {
+		t.Fatalf("counts by user above: %v", err)
+	}
+	if want := map[string]int{"alice": 2}; !reflect.DeepEqual(above, want) {
+		t.Errorf("counts by user above: got %v, want %v", above, want)
+	}
+}
+
+func TestUserForeignKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{
+		PoolSize: 4,
+		PrepareConn: func(conn *sqlite.Conn) error {
+			return sqlitex.ExecuteTransient(conn, "PRAGMA foreign_keys = ON;", nil)
+		},
+	})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	execute(t, db, "CREATE TABLE users (name TEXT PRIMARY KEY);")
+	execute(t, db, "INSERT INTO users (name) VALUES ('alice'), ('bob');")
+	store := newStore(t, db,
+		zqlsession.WithUserID(userOf), zqlsession.WithUserForeignKey("users", "name"))
+
+	expiry := time.Now().Add(time.Hour)
+	for _, data := range []string{"alice:1", "alice:2", "bob:1", ""} {
+		if err := store.Commit("token"+data, []byte(data), expiry); err != nil {
+			t.Fatalf("commit %q: %v", data, err)
+		}
+	}
+	if err := store.Commit("mallory", []byte("mallory:1"), expiry); err == nil {
+		t.Error("commit for a missing user: got nil, want a constraint error")
+	}
+
+	execute(t, db, "DELETE FROM users WHERE name = 'alice';")
+	for token, want := range map[string]bool{
+		"tokenalice:1": false, "tokenalice:2": false, "tokenbob:1": true, "token": true,
+	} {
+		if _, found, _ := store.Find(token); found != want {
+			t.Errorf("find %q: got %v, want %v", token, found, want)
+		}
+	}
+}
+
+func TestUserForeignKeyInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("invalid table name did not panic")
+		}
+	}()
+	zqlsession.WithUserForeignKey("users; DROP TABLE sessions", "name")
+}
@@ -0,0 +1,166 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ConflictPolicy says what happens when two commits to the same session race,
+// see WithConflictPolicy.
+type ConflictPolicy int
+
+const (
+	// LastWriterWins lets the later of two racing commits silently replace
+	// the earlier one. It is the default.
+	LastWriterWins ConflictPolicy = iota
+	// RejectOnConflict keeps a version number for each session, so that
+	// CommitVersion can refuse to overwrite a session which has changed
+	// since it was read.
+	RejectOnConflict
+)
+
+// ErrConflict is returned by CommitVersion when the session has been
+// committed or deleted since its version was read.
+var ErrConflict = errors.New("zqlsession: session changed since it was read")
+
+// ErrNoVersion is returned by FindVersion and CommitVersion when the store was
+// not created with the RejectOnConflict policy.
+var ErrNoVersion = errors.New("zqlsession: session versions are not enabled")
+
+// WithConflictPolicy sets the policy for racing commits to the same session.
+// Commit, like the scs Store interface it implements, is always last writer
+// wins, as it has no way to know what the caller last read. With
+// RejectOnConflict the store also counts the commits to each session in the
+// version column, and callers which need to detect races can read a session
+// with FindVersion and write it back with CommitVersion.
+//
+// Tables created before the version column was added to Schema need it added
+// before this option is used:
+//
+//	ALTER TABLE sessions ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(p *SQLitexStore) {
+		p.conflictPolicy = policy
+	}
+}
+
+// FindVersion is like Find, but also returns the version of the session, for
+// passing to CommitVersion. The version of a session which is not found is 0.
+// It returns ErrNoVersion without the RejectOnConflict policy.
+func (p *SQLitexStore) FindVersion(token string) (b []byte, version int64, found bool, err error) {
+	defer p.logSlow(OpFindVersion, len(token), time.Now())
+	defer p.wrapError(OpFindVersion, &err)
+
+	if p.conflictPolicy != RejectOnConflict {
+		return nil, 0, false, ErrNoVersion
+	}
+	key := p.normalizeToken(token)
+	if key == "" {
+		return nil, 0, false, nil
+	}
+	if p.tokenTooLong(key) {
+		return nil, 0, false, ErrTokenTooLong
+	}
+	conn, put, err := p.take(context.Background(), OpFindVersion)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer put(&err)
+
+	// Buffered writes have no version until they are in the database.
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, 0, false, err
+		}
+	}
+	b, version, found, err = p.findVersion(conn, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	p.countFind(found)
+	return b, version, found, nil
+}
+
+func (p *SQLitexStore) findVersion(conn *sqlite.Conn, token string) (b []byte, version int64, found bool, err error) {
+	defer p.checkCorrupt(&err)
+
+	err = sqlitex.Execute(conn, p.q.findVersion,
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				found = true
+				version = stmt.ColumnInt64(1)
+				b, err = p.columnData(stmt, 0, token)
+				return err
+			},
+		})
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return b, version, found, nil
+}
+
+// CommitVersion is like Commit, but fails with ErrConflict unless the session
+// is still at version, as returned by FindVersion. A version of 0 commits a
+// new session, and fails if an active session already exists for the token.
+// It returns ErrNoVersion without the RejectOnConflict policy.
+func (p *SQLitexStore) CommitVersion(token string, b []byte, expiry time.Time, version int64) (err error) {
+	defer p.logSlow(OpCommitVersion, len(token), time.Now())
+	defer p.wrapError(OpCommitVersion, &err)
+
+	if p.conflictPolicy != RejectOnConflict {
+		return ErrNoVersion
+	}
+	if token == "" {
+		return ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return err
+	}
+	expiry = p.jitter(expiry)
+	conn, put, err := p.take(context.Background(), OpCommitVersion)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return err
+		}
+	}
+	return p.commitVersion(conn, token, b, expiry, version, skip)
+}
+
+func (p *SQLitexStore) commitVersion(conn *sqlite.Conn, token string, b []byte, expiry time.Time, version int64, skip bool) (err error) {
+	// The version is checked under the write lock, as with a deferred
+	// transaction a racing commit would fail with SQLITE_BUSY rather than
+	// ErrConflict.
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return err
+	}
+	defer endFn(&err)
+
+	_, current, _, err := p.findVersion(conn, p.normalizeToken(token))
+	if err != nil {
+		return err
+	}
+	if current != version {
+		return ErrConflict
+	}
+	return p.commitOrDelete(conn, token, b, expiry, skip)
+}
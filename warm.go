@@ -0,0 +1,49 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"time"
+
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Warm reads the whole sessions table and its primary key index, so that the
+// first lookups after a cold start find their pages already cached instead of
+// waiting on the disk. It is meant to be called once at startup, before
+// serving traffic.
+//
+// SQLite's page cache belongs to a single connection, so Warm reads through
+// each of the connections given by WithPoolSize, or through one connection
+// without it. How much stays cached depends on the cache_size of the
+// connections, see WithCacheSize, and on the operating system's page cache,
+// which is shared by every connection.
+func (p *SQLitexStore) Warm(ctx context.Context) (err error) {
+	defer p.logSlow(OpWarm, 0, time.Now())
+	defer p.wrapError(OpWarm, &err)
+
+	n := p.poolSize
+	if n < 1 {
+		n = 1
+	}
+	if p.maxConcurrency > 0 && n > p.maxConcurrency {
+		n = p.maxConcurrency
+	}
+	// The connections are held until all have been warmed, so that each
+	// take returns a different one.
+	for i := 0; i < n; i++ {
+		conn, put, err := p.take(ctx, OpWarm)
+		if err != nil {
+			return err
+		}
+		defer put(&err)
+
+		for _, query := range []string{p.q.warmTable, p.q.warmIndex} {
+			if err := sqlitex.ExecuteTransient(conn, query, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
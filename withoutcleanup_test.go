@@ -0,0 +1,76 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+// TestWithoutCleanup checks that expired sessions are never returned by reads
+// while their rows are left in the table.
+func TestWithoutCleanup(t *testing.T) {
+	ctx := context.Background()
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithoutCleanup())
+
+	if err := store.Commit("expired", []byte("data"), time.Now().Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Commit("active", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := countRows(t, db, "sessions"); n != 2 {
+		t.Fatalf("got %d rows, want the expired row kept", n)
+	}
+
+	if _, found, err := store.Find("expired"); err != nil || found {
+		t.Errorf("find: got %v, %v, want false", found, err)
+	}
+	if ok, err := store.Exists("expired"); err != nil || ok {
+		t.Errorf("exists: got %v, %v, want false", ok, err)
+	}
+	results, err := store.FindBatch([]string{"expired", "active"})
+	if err != nil {
+		t.Fatalf("find batch: %v", err)
+	}
+	if results[0].Found || !results[1].Found {
+		t.Errorf("find batch: got %+v, want only active", results)
+	}
+	if n, err := store.Count(); err != nil || n != 1 {
+		t.Errorf("count: got %d, %v, want 1", n, err)
+	}
+	all, err := store.All()
+	if err != nil || len(all) != 1 || all["active"] == nil {
+		t.Errorf("all: got %q, %v, want only active", keys(all), err)
+	}
+	ttls, err := store.AllWithTTL()
+	if _, ok := ttls["expired"]; err != nil || ok {
+		t.Errorf("all with ttl: got %v, %v, want only active", ttls, err)
+	}
+	tokens, err := store.FindByPrefix("exp")
+	if err != nil || len(tokens) != 0 {
+		t.Errorf("find by prefix: got %q, %v, want none", tokens, err)
+	}
+	err = store.Iterate(ctx, func(token string, data []byte) error {
+		if token == "expired" {
+			t.Error("iterate: got the expired session")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	sessions, err := store.Export(ctx, zqlsession.Decoded)
+	if err != nil || len(sessions) != 1 {
+		t.Errorf("export: got %d sessions, %v, want 1", len(sessions), err)
+	}
+
+	if n, err := store.DeleteExpired(ctx); err != nil || n != 1 {
+		t.Errorf("delete expired: got %d, %v, want 1", n, err)
+	}
+}
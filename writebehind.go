@@ -0,0 +1,400 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// writeBehind buffers commits and deletes in memory until they are flushed to
+// the database, see WithWriteBehind.
+type writeBehind struct {
+	interval    time.Duration
+	maxBuffered int
+
+	// pending holds the latest buffered write of each normalized token.
+	// flushing holds the writes of a flush in progress, which are still
+	// consulted by Find until they have been written.
+	mu       sync.Mutex
+	pending  map[string]bufferedWrite
+	flushing map[string]bufferedWrite
+
+	// flushMu serializes flushes so that an older batch can never be
+	// written over a newer one.
+	flushMu sync.Mutex
+
+	full     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// bufferedWrite is a commit, or a delete if deleted is set, waiting to be
+// flushed.
+type bufferedWrite struct {
+	token   string
+	data    []byte
+	expiry  time.Time
+	deleted bool
+	// encrypted is set for a commit by CommitEncrypted.
+	encrypted bool
+}
+
+func (w *writeBehind) start(p *SQLitexStore) {
+	w.pending = make(map[string]bufferedWrite)
+	w.full = make(chan struct{}, 1)
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+	go p.runWriteBehind()
+}
+
+// buffer records a write for its normalized token, replacing any earlier
+// buffered write, and signals a flush once the buffer is full.
+func (w *writeBehind) buffer(key string, bw bufferedWrite) {
+	w.mu.Lock()
+	w.pending[key] = bw
+	full := w.maxBuffered > 0 && len(w.pending) >= w.maxBuffered
+	w.mu.Unlock()
+
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// lookup returns the most recent buffered write for a normalized token.
+func (w *writeBehind) lookup(key string) (bufferedWrite, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if bw, ok := w.pending[key]; ok {
+		return bw, true
+	}
+	bw, ok := w.flushing[key]
+	return bw, ok
+}
+
+// bufferCommit buffers a commit instead of writing it to the database,
+// encrypting it when it is flushed if encrypted is set.
+func (p *SQLitexStore) bufferCommit(token string, b []byte, expiry time.Time, encrypted bool) error {
+	key := p.normalizeToken(token)
+	if key == "" {
+		return ErrEmptyToken
+	}
+	if p.corrupt.Load() && !p.recoverCorrupt(context.Background()) {
+		return ErrCorrupt
+	}
+	done, err := p.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	p.writeBehind.buffer(key, bufferedWrite{
+		token:     token,
+		data:      data,
+		expiry:    expiry,
+		encrypted: encrypted,
+	})
+	return nil
+}
+
+// bufferDelete buffers a delete instead of writing it to the database.
+func (p *SQLitexStore) bufferDelete(token string) error {
+	key := p.normalizeToken(token)
+	if key == "" {
+		return nil
+	}
+	if p.corrupt.Load() && !p.recoverCorrupt(context.Background()) {
+		return ErrCorrupt
+	}
+	done, err := p.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	p.writeBehind.buffer(key, bufferedWrite{
+		token:   token,
+		deleted: true,
+	})
+	return nil
+}
+
+// snapshot returns a copy of the buffered writes by normalized token, with
+// those being flushed replaced by any later pending writes.
+func (w *writeBehind) snapshot() map[string]bufferedWrite {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	writes := make(map[string]bufferedWrite, len(w.pending)+len(w.flushing))
+	for key, bw := range w.flushing {
+		writes[key] = bw
+	}
+	for key, bw := range w.pending {
+		writes[key] = bw
+	}
+	return writes
+}
+
+// overlayBuffered calls fn with the token of each buffered write, as returned
+// by All, and whether the write leaves an active session at now, so that
+// methods returning many sessions can apply the writes over the results read
+// from the database. A buffered commit shadows the database's session for its
+// token, and a buffered delete or expired commit hides it.
+func (p *SQLitexStore) overlayBuffered(now time.Time, fn func(token string, bw bufferedWrite, active bool)) {
+	for key, bw := range p.writeBehind.snapshot() {
+		token, ok := p.stripPrefix(key)
+		if !ok {
+			continue
+		}
+		fn(token, bw, !bw.deleted && now.Before(bw.expiry))
+	}
+}
+
+// overlayCount adjusts n, the number of active sessions in the database, for
+// the buffered writes.
+func (p *SQLitexStore) overlayCount(conn *sqlite.Conn, n int) (int, error) {
+	now := time.Now()
+	for key, bw := range p.writeBehind.snapshot() {
+		inDB, err := p.exists(conn, key)
+		if err != nil {
+			return 0, err
+		}
+		active := !bw.deleted && now.Before(bw.expiry)
+		switch {
+		case active && !inDB:
+			n++
+		case !active && inDB:
+			n--
+		}
+	}
+	return n, nil
+}
+
+// overlayCounts is overlayCount for the active and total counts returned by
+// Counts. A buffered write to a token without a row adds to the total, and a
+// buffered delete of a token with one, even an expired one, takes from it.
+func (p *SQLitexStore) overlayCounts(conn *sqlite.Conn, active, total int) (int, int, error) {
+	now := time.Now()
+	for key, bw := range p.writeBehind.snapshot() {
+		var inDB, activeInDB bool
+		err := sqlitex.Execute(conn, p.q.isActive,
+			&sqlitex.ExecOptions{
+				Args: []any{key},
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					inDB = true
+					activeInDB = stmt.ColumnBool(0)
+					return nil
+				},
+			})
+		if err != nil {
+			return 0, 0, err
+		}
+		isActive := !bw.deleted && now.Before(bw.expiry)
+		switch {
+		case isActive && !activeInDB:
+			active++
+		case !isActive && activeInDB:
+			active--
+		}
+		switch {
+		case !bw.deleted && !inDB:
+			total++
+		case bw.deleted && inDB:
+			total--
+		}
+	}
+	return active, total, nil
+}
+
+// findBuffered reports the data of a token's buffered write, if it has one.
+// A buffered delete or an expired buffered commit is reported as found but
+// not existing.
+func (p *SQLitexStore) findBuffered(token string) (b []byte, exists, found bool) {
+	bw, ok := p.writeBehind.lookup(p.normalizeToken(token))
+	if !ok {
+		return nil, false, false
+	}
+	if bw.deleted || !time.Now().Before(bw.expiry) {
+		return nil, false, true
+	}
+	b = make([]byte, len(bw.data))
+	copy(b, bw.data)
+	return b, true, true
+}
+
+// Flush writes all commits and deletes buffered by WithWriteBehind to the
+// database in a single transaction. It does nothing if write-behind is not
+// enabled. If the flush fails the writes stay buffered and are retried by the
+// next flush.
+func (p *SQLitexStore) Flush(ctx context.Context) (err error) {
+	defer p.wrapError(OpFlush, &err)
+
+	if p.writeBehind == nil {
+		return nil
+	}
+	conn, put, err := p.take(ctx, OpFlush)
+	if err != nil {
+		return err
+	}
+	defer put(&err)
+
+	return p.flush(conn)
+}
+
+func (p *SQLitexStore) runWriteBehind() {
+	w := p.writeBehind
+	defer close(w.done)
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-w.full:
+		case <-w.stop:
+			return
+		}
+		if p.corrupt.Load() {
+			continue
+		}
+		// The pool is taken from directly since buffered writes must
+		// still be flushed after StopCleanup has closed the store.
+		db := p.pool()
+		conn, err := db.Take(context.Background())
+		if err == nil {
+			err = p.prepareConn(conn)
+			if err == nil {
+				err = p.flush(conn)
+			}
+			db.Put(conn)
+		}
+		p.recordResult(err)
+		if err != nil {
+			p.logger.Printf("zqlsession: %s: write-behind flush: %v", p.name, err)
+		}
+	}
+}
+
+// stopWriteBehind stops the write-behind goroutine and flushes any remaining
+// buffered writes. It is called by Shutdown once no operations are in flight.
+func (p *SQLitexStore) stopWriteBehind(ctx context.Context) error {
+	w := p.writeBehind
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	db := p.pool()
+	conn, err := db.Take(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Put(conn)
+
+	if err := p.prepareConn(conn); err != nil {
+		return err
+	}
+	return p.flush(conn)
+}
+
+// flush writes the pending buffered writes to the database.
+func (p *SQLitexStore) flush(conn *sqlite.Conn) error {
+	w := p.writeBehind
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	batch := w.pending
+	if len(batch) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	w.pending = make(map[string]bufferedWrite)
+	w.flushing = batch
+	w.mu.Unlock()
+
+	err := p.flushBatch(conn, batch)
+
+	w.mu.Lock()
+	if err != nil {
+		// Put back the writes which have not been superseded while
+		// flushing, so that they are retried.
+		for key, bw := range batch {
+			if _, ok := w.pending[key]; !ok {
+				w.pending[key] = bw
+			}
+		}
+	}
+	w.flushing = nil
+	w.mu.Unlock()
+	return err
+}
+
+// flushToken writes the buffered write of a single token, if it has one, on
+// conn, so that a write made on a connection the caller owns is not later
+// overwritten by it.
+func (p *SQLitexStore) flushToken(conn *sqlite.Conn, token string) error {
+	w := p.writeBehind
+	key := p.normalizeToken(token)
+	if _, ok := w.lookup(key); !ok {
+		return nil
+	}
+	// Holding flushMu waits for any flush in progress, which could
+	// otherwise write an older buffered write for the token after this one.
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	bw, ok := w.pending[key]
+	delete(w.pending, key)
+	w.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := p.flushBatch(conn, map[string]bufferedWrite{key: bw})
+	if err != nil {
+		w.mu.Lock()
+		if _, ok := w.pending[key]; !ok {
+			w.pending[key] = bw
+		}
+		w.mu.Unlock()
+	}
+	return err
+}
+
+func (p *SQLitexStore) flushBatch(conn *sqlite.Conn, batch map[string]bufferedWrite) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	for _, bw := range batch {
+		if bw.deleted {
+			err = p.delete(conn, bw.token)
+		} else if bw.encrypted {
+			err = p.commitEncrypted(conn, bw.token, bw.data, bw.expiry)
+		} else {
+			err = p.commit(conn, bw.token, bw.data, bw.expiry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+)
+
+// newWriteBehind returns a store of db with write-behind flushing only when
+// asked, and a store of the same table without it which sees only what has
+// been flushed.
+func newWriteBehind(t *testing.T) (buffered, flushed *zqlsession.SQLitexStore) {
+	t.Helper()
+
+	db := newPool(t)
+	return newStore(t, db, zqlsession.WithWriteBehind(0, 0)), newStore(t, db)
+}
+
+func TestWriteBehindFind(t *testing.T) {
+	ctx := context.Background()
+	store, plain := newWriteBehind(t)
+	expiry := time.Now().Add(time.Hour)
+
+	if err := store.Commit("token", []byte("data"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if b, found, err := store.Find("token"); err != nil || !found || string(b) != "data" {
+		t.Errorf("find buffered: got %q, %v, %v, want %q", b, found, err, "data")
+	}
+	if _, found, _ := plain.Find("token"); found {
+		t.Error("buffered commit was written before a flush")
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if b, found, _ := plain.Find("token"); !found || string(b) != "data" {
+		t.Errorf("find flushed: got %q, %v, want %q", b, found, "data")
+	}
+
+	// A buffered delete hides the flushed session until it is flushed.
+	if err := store.Delete("token"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, found, _ := store.Find("token"); found {
+		t.Error("found a session with a buffered delete")
+	}
+	if _, found, _ := plain.Find("token"); !found {
+		t.Error("buffered delete was written before a flush")
+	}
+}
+
+func TestWriteBehindCoalesce(t *testing.T) {
+	ctx := context.Background()
+	store, plain := newWriteBehind(t)
+	expiry := time.Now().Add(time.Hour)
+
+	for _, data := range []string{"1", "2", "3"} {
+		if err := store.Commit("token", []byte(data), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if b, _, _ := plain.Find("token"); string(b) != "3" {
+		t.Errorf("find: got %q, want the last write %q", b, "3")
+	}
+	if s := store.Stats(); s.Commits != 1 {
+		t.Errorf("commits: got %d, want the writes coalesced into 1", s.Commits)
+	}
+}
+
+func TestWriteBehindFull(t *testing.T) {
+	db := newPool(t)
+	store := newStore(t, db, zqlsession.WithWriteBehind(0, 2))
+	plain := newStore(t, db)
+	expiry := time.Now().Add(time.Hour)
+
+	for _, token := range []string{"a", "b"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	// A full buffer is flushed in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if n, _ := plain.Count(); n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("full buffer was not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteBehindShutdown(t *testing.T) {
+	db := newPool(t)
+	store, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate(), zqlsession.WithWriteBehind(0, 0))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := store.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shut down: %v", err)
+	}
+	if _, found, _ := newStore(t, db).Find("token"); !found {
+		t.Error("buffered commit was lost on shutdown")
+	}
+}
+
+// TestWriteBehindAll checks that All and Iterate overlay the buffered writes
+// on the sessions in the database.
+func TestWriteBehindAll(t *testing.T) {
+	ctx := context.Background()
+	store, plain := newWriteBehind(t)
+	expiry := time.Now().Add(time.Hour)
+
+	for _, token := range []string{"db", "shadowed", "deleted"} {
+		if err := plain.Commit(token, []byte("db"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	for _, token := range []string{"buffered", "shadowed"} {
+		if err := store.Commit(token, []byte("buffered"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	if err := store.Delete("deleted"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	all, err := store.All()
+	if err != nil {
+		t.Fatalf("all: %v", err)
+	}
+	iterated := make(map[string][]byte)
+	err = store.Iterate(ctx, func(token string, data []byte) error {
+		if _, ok := iterated[token]; ok {
+			t.Errorf("iterate: %q seen twice", token)
+		}
+		iterated[token] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("iterate: %v", err)
+	}
+	for _, tt := range []struct {
+		name, token string
+		data        string
+		found       bool
+	}{
+		{"BufferedOnly", "buffered", "buffered", true},
+		{"DBOnly", "db", "db", true},
+		{"BufferedShadowsDB", "shadowed", "buffered", true},
+		{"BufferedDeleteHidesDB", "deleted", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for method, sessions := range map[string]map[string][]byte{"All": all, "Iterate": iterated} {
+				b, found := sessions[tt.token]
+				if found != tt.found || string(b) != tt.data {
+					t.Errorf("%s: got %q, %v, want %q, %v", method, b, found, tt.data, tt.found)
+				}
+			}
+		})
+	}
+	if len(all) != 3 || len(iterated) != 3 {
+		t.Errorf("got %d sessions from All and %d from Iterate, want 3", len(all), len(iterated))
+	}
+}
+
+func TestWriteBehindImport(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newWriteBehind(t)
+	expiry := time.Now().Add(time.Hour)
+
+	if err := store.Commit("token", []byte("buffered"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// DumpRow reports the row the buffered commit writes.
+	if dump, found, err := store.DumpRow("token"); err != nil || !found || dump.DataLen != len("buffered") {
+		t.Errorf("dump: got length %d, %v, %v, want the buffered commit", dump.DataLen, found, err)
+	}
+
+	if err := store.Commit("token", []byte("older"), expiry); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	sessions := []zqlsession.SessionRecord{{Token: "token", Data: []byte("imported"), Expiry: expiry}}
+	if err := store.Import(ctx, sessions, zqlsession.Decoded); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if b, _, _ := store.Find("token"); string(b) != "imported" {
+		t.Errorf("find after flush: got %q, want %q", b, "imported")
+	}
+}
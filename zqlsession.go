@@ -4,122 +4,525 @@ package zqlsession
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
 )
 
+// ErrClosed is returned by store operations started after StopCleanup or
+// Shutdown has been called.
+var ErrClosed = errors.New("zqlsession: store is closed")
+
+// ErrEmptyToken is returned when committing a session with an empty token.
+var ErrEmptyToken = errors.New("zqlsession: empty session token")
+
+// ErrPoolTimeout is returned when a connection could not be taken from the
+// pool within the WithAcquireTimeout duration.
+var ErrPoolTimeout = errors.New("zqlsession: timed out waiting for a connection")
+
+// ErrReadOnly is returned by methods which modify the store when it was
+// created with the WithReadOnly option.
+var ErrReadOnly = errors.New("zqlsession: store is read-only")
+
+// ErrTokenTooLong is returned when a token is longer than the limit set by
+// WithMaxTokenLength.
+var ErrTokenTooLong = errors.New("zqlsession: session token too long")
+
+// ErrNoSequence is returned by methods which order sessions by creation when
+// the store was not created with the WithSequence option.
+var ErrNoSequence = errors.New("zqlsession: sequence tracking is not enabled")
+
+// defaultMaxTokenLength is the longest token accepted when WithMaxTokenLength
+// is not given. Tokens generated by scs are 43 bytes.
+const defaultMaxTokenLength = 256
+
+// defaultCleanupInterval is the cleanup interval of stores created by New.
+const defaultCleanupInterval = 5 * time.Minute
+
+// minBackgroundPoolSize is the smallest pool which leaves a connection for
+// requests while a background goroutine holds one, see WithPoolSize.
+const minBackgroundPoolSize = 2
+
 // SQLitexStore represents the session store.
 type SQLitexStore struct {
-	db          *sqlitex.Pool
+	// db is replaced by WithReconnect's factory when the pool fails, see
+	// pool.
+	db          atomic.Pointer[sqlitex.Pool]
 	stopCleanup chan bool
+	stopOnce    sync.Once
+
+	// cleanupCtx is cancelled by StopCleanup so that a cleanup blocked on
+	// taking a connection from an exhausted pool notices the stop request.
+	cleanupCtx    context.Context
+	cancelCleanup context.CancelFunc
+
+	// cleaner is the shared Cleaner the store is registered with, if it
+	// was created by NewWithCleaner.
+	cleaner *Cleaner
+
+	// closed is checked without holding mu so closed stores fail fast, but
+	// it is only set while holding mu so that no operation can be added to
+	// inflight once Shutdown has started waiting on it.
+	mu       sync.Mutex
+	closed   atomic.Bool
+	inflight sync.WaitGroup
+
+	// corrupt is set once SQLite reports the database is corrupt, see
+	// checkCorrupt.
+	corrupt atomic.Bool
+
+	// originalBytes and storedBytes total the data encoded by the codec,
+	// see CompressionStats.
+	originalBytes atomic.Int64
+	storedBytes   atomic.Int64
+
+	statsMu sync.Mutex
+	stats   Stats
+
+	// prepared holds the pool connections already set up by prepareConn.
+	preparedMu sync.Mutex
+	prepared   map[*sqlite.Conn]struct{}
+
+	name             string
+	label            string
+	table            string
+	cleanupInterval  time.Duration
+	cleanupSchedule  func(now time.Time) time.Time
+	withoutCleanup   bool
+	autoMigrate      bool
+	schemaVersion    bool
+	expiryJitter     time.Duration
+	sequence         bool
+	expiryEncoding   ExpiryEncoding
+	splitData        bool
+	userID           func(b []byte) string
+	normalize        func(token string) string
+	tokenPrefix      string
+	touchPolicy      func(current, now time.Time) (time.Time, bool)
+	observer         func(Event)
+	afterCleanup     func(deleted int, d time.Duration, err error)
+	logger           *log.Logger
+	slowThreshold    time.Duration
+	archiveRetention time.Duration
+	maxSessions      int
+	conflictPolicy   ConflictPolicy
+	acquireTimeout   time.Duration
+	breaker          *breaker
+	reconnect        *reconnector
+	pastExpiryPolicy PastExpiryPolicy
+	pastExpiryGrace  time.Duration
+	poolSize         int
+	maxConcurrency   int
+	readOnly         bool
+	coveringIndex    bool
+	userForeignKey   string
+	exclusiveLocking bool
+	cacheSize        int
+	codec            Codec
+	access           *accessCounter
+	aead             cipher.AEAD
+	maxTokenLength   int
+	errorCodes       bool
+	dataChecksum     bool
+	checksumFallback bool
+	ownsPool         bool
+	skipUnchanged    bool
+	writeBehind      *writeBehind
+	tokenGenerator   func() (string, error)
+
+	// sem holds a value for each running operation when WithMaxConcurrency
+	// is used.
+	sem chan struct{}
+
+	// politeBatch is the batch size set by WithPoliteCleanup, and waiting
+	// counts the operations waiting for a connection while it is set.
+	politeBatch int
+	waiting     atomic.Int64
+
+	// cleanupBudget is the time limit set by WithCleanupTimeBudget.
+	cleanupBudget time.Duration
+
+	// adaptive is set by WithAdaptiveCleanup.
+	adaptive *adaptiveCleanup
+
+	// cleanupProgress is the callback set by WithCleanupProgress.
+	cleanupProgress func(deletedSoFar, estimatedRemaining int)
+
+	// nextCleanup is the UnixNano time the cleanup goroutine next runs, or
+	// 0 if it is not going to, see NextCleanup.
+	nextCleanup atomic.Int64
+
+	idempotency       idempotencyRing
+	idempotencyWindow time.Duration
+
+	// q holds the effective SQL for this store's options.
+	q queries
 }
 
 // New returns a new SQLitexStore instance, with a background cleanup goroutine
 // that runs every 5 minutes to remove expired session data.
-func New(db *sqlitex.Pool) *SQLitexStore {
-	return NewWithCleanupInterval(db, 5*time.Minute)
+func New(db *sqlitex.Pool, opts ...Option) *SQLitexStore {
+	return NewWithCleanupInterval(db, defaultCleanupInterval, opts...)
+}
+
+// NewE is like New, but returns an error if creating the table for the
+// WithAutoMigrate option fails, rather than only logging it.
+func NewE(db *sqlitex.Pool, opts ...Option) (*SQLitexStore, error) {
+	p, err := newStore(db, defaultCleanupInterval, opts)
+	if err != nil {
+		p.Shutdown(context.Background())
+		return nil, err
+	}
+	return p, nil
 }
 
 // NewWithCleanupInterval returns a new SQLitexStore instance. The cleanupInterval
 // parameter controls how frequently expired session data is removed by the
 // background cleanup goroutine. Setting it to 0 prevents the cleanup goroutine
 // from running (i.e. expired sessions will not be removed).
-func NewWithCleanupInterval(db *sqlitex.Pool, cleanupInterval time.Duration) *SQLitexStore {
-	p := &SQLitexStore{db: db}
-	if cleanupInterval > 0 {
-		go p.startCleanup(cleanupInterval)
+func NewWithCleanupInterval(db *sqlitex.Pool, cleanupInterval time.Duration, opts ...Option) *SQLitexStore {
+	p, err := newStore(db, cleanupInterval, opts)
+	if err != nil {
+		p.logger.Printf("zqlsession: %s: create table: %v", p.name, err)
 	}
 	return p
 }
 
-// Find returns the data for a given session token from the SQLitexStore instance.
-// If the session token is not found or is expired, the returned exists flag will
-// be set to false.
-func (p *SQLitexStore) Find(token string) ([]byte, bool, error) {
-	conn, err := p.db.Take(context.Background())
+// newStore creates and starts a store, returning it along with any error
+// from creating its table for WithAutoMigrate.
+func newStore(db *sqlitex.Pool, cleanupInterval time.Duration, opts []Option) (*SQLitexStore, error) {
+	p := &SQLitexStore{
+		table:           defaultTable,
+		cleanupInterval: cleanupInterval,
+		logger:          log.Default(),
+		maxTokenLength:  defaultMaxTokenLength,
+		expiryEncoding:  JulianDayExpiry,
+
+		idempotencyWindow: defaultIdempotencyWindow,
+	}
+	p.db.Store(db)
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.name == "" {
+		p.name = p.table
+	} else {
+		// The comment ends at the first */, so one in the name is
+		// broken up.
+		p.label = "/* store: " + strings.ReplaceAll(p.name, "*/", "* /") + " */ "
+	}
+	if p.readOnly || p.withoutCleanup {
+		cleanupInterval = 0
+		p.cleanupInterval = 0
+		p.cleanupSchedule = nil
+	}
+	if p.cleanupSchedule != nil {
+		cleanupInterval = 0
+		p.cleanupInterval = 0
+	}
+	if p.readOnly {
+		p.writeBehind = nil
+		p.access = nil
+	}
+	if p.maxConcurrency > 0 {
+		p.sem = make(chan struct{}, p.maxConcurrency)
+	}
+	p.q = newQueries(p)
+	background := cleanupInterval > 0 || p.cleanupSchedule != nil || p.writeBehind != nil || p.access != nil
+	if p.poolSize > 0 && p.poolSize < minBackgroundPoolSize && background {
+		p.logger.Printf("zqlsession: %s: pool size %d is too small for background cleanup, which may take the only connection from a request",
+			p.name, p.poolSize)
+	}
+	// The table is created before the background goroutines start, so
+	// that they never find it missing.
+	var err error
+	if p.autoMigrate {
+		err = p.CreateTable(context.Background())
+	}
+	if err == nil {
+		p.checkExpiryIndex()
+	}
+	if p.writeBehind != nil {
+		p.writeBehind.start(p)
+	}
+	if p.access != nil {
+		p.access.start(p)
+	}
+	if cleanupInterval > 0 || p.cleanupSchedule != nil {
+		p.stopCleanup = make(chan bool)
+		p.cleanupCtx, p.cancelCleanup = context.WithCancel(context.Background())
+		if p.cleanupSchedule != nil {
+			go p.startCleanupSchedule(p.cleanupSchedule)
+		} else {
+			p.nextCleanup.Store(time.Now().Add(cleanupInterval).UnixNano())
+			go p.startCleanup(cleanupInterval)
+		}
+	}
+	return p, err
+}
+
+// Name returns the label set by WithName, or the table name if no name was
+// given.
+func (p *SQLitexStore) Name() string {
+	return p.name
+}
+
+// CreateTable creates the store's table and its indexes if they do not already
+// exist, and with WithSchemaVersion records the schema version.
+func (p *SQLitexStore) CreateTable(ctx context.Context) (err error) {
+	defer p.wrapError(OpCreateTable, &err)
+
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	conn, put, err := p.take(ctx, OpCreateTable)
 	if err != nil {
-		return nil, false, err
+		return err
 	}
-	defer p.db.Put(conn)
+	defer put(&err)
 
-	var found bool
-	var b []byte
-	err = sqlitex.Execute(conn,
-		"SELECT data FROM sessions WHERE token = $1 AND julianday('now') < expiry",
+	err = sqlitex.ExecuteScript(conn, p.q.schema, nil)
+	if err != nil {
+		return err
+	}
+	if p.archiveRetention > 0 {
+		err = sqlitex.ExecuteScript(conn, p.q.schemaArchive, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if p.schemaVersion {
+		return setSchemaVersion(conn, CurrentSchemaVersion)
+	}
+	return nil
+}
+
+// checkExpiryIndex logs a warning if the store's table exists without an index
+// on expiry, which would make every cleanup scan the whole table. A missing
+// table is not reported, as it may be created after the store.
+func (p *SQLitexStore) checkExpiryIndex() {
+	conn, put, err := p.take(context.Background(), OpCheckExpiryIndex)
+	if err != nil {
+		return
+	}
+	defer put(&err)
+
+	var exists, indexed bool
+	err = sqlitex.Execute(conn, p.q.expiryIndex,
 		&sqlitex.ExecOptions{
+			Args: []any{p.table},
 			ResultFunc: func(stmt *sqlite.Stmt) error {
-				found = true
-				b = make([]byte, stmt.ColumnLen(0))
-				stmt.ColumnBytes(0, b)
+				exists = stmt.ColumnBool(0)
+				indexed = stmt.ColumnBool(1)
 				return nil
 			},
-			Args: []any{token},
 		})
+	if err == nil && exists && !indexed {
+		p.logger.Printf("zqlsession: %s: table %s has no index on expiry, so cleanup scans the whole table; run CreateTable to add it",
+			p.name, p.table)
+	}
+}
 
-	if !found {
+// Find returns the data for a given session token from the SQLitexStore instance.
+// If the session token is not found or is expired, the returned exists flag will
+// be set to false. An empty token is never found, and is reported as such
+// without querying the database.
+//
+// The data of a session which exists is never nil: a session committed with
+// empty or nil data is returned as an empty, non-nil slice. A session which
+// does not exist is returned as nil data with exists false, so only the exists
+// flag tells the two apart reliably.
+func (p *SQLitexStore) Find(token string) (_ []byte, _ bool, err error) {
+	defer p.logSlow(OpFind, len(token), time.Now())
+	defer p.wrapError(OpFind, &err)
+
+	// A token too long to have been committed is simply not found, so
+	// that a client with an oversized cookie is given a new session rather
+	// than an error on every request.
+	if token == "" || p.tokenTooLong(token) {
 		return nil, false, nil
 	}
+	if p.writeBehind != nil {
+		if b, exists, ok := p.findBuffered(token); ok {
+			p.countFind(exists)
+			if exists {
+				p.countAccess(p.normalizeToken(token))
+			}
+			return b, exists, nil
+		}
+	}
+	conn, put, err := p.take(context.Background(), OpFind)
 	if err != nil {
 		return nil, false, err
 	}
-	return b, true, nil
+	defer put(&err)
+
+	b, exists, err := p.find(conn, token)
+	if exists {
+		p.countAccess(p.normalizeToken(token))
+	}
+	return b, exists, err
+}
+
+// Exists reports whether an active session exists for token, without reading
+// its data. See WithCoveringIndex.
+func (p *SQLitexStore) Exists(token string) (_ bool, err error) {
+	defer p.logSlow(OpExists, len(token), time.Now())
+	defer p.wrapError(OpExists, &err)
+
+	key := p.normalizeToken(token)
+	if key == "" {
+		return false, nil
+	}
+	if p.tokenTooLong(key) {
+		return false, ErrTokenTooLong
+	}
+	if p.writeBehind != nil {
+		if _, exists, ok := p.findBuffered(token); ok {
+			return exists, nil
+		}
+	}
+	conn, put, err := p.take(context.Background(), OpExists)
+	if err != nil {
+		return false, err
+	}
+	defer put(&err)
+
+	return p.exists(conn, key)
+}
+
+func (p *SQLitexStore) exists(conn *sqlite.Conn, token string) (bool, error) {
+	var exists bool
+	err := sqlitex.Execute(conn, p.q.exists,
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				exists = true
+				return nil
+			},
+		})
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
 }
 
 // Commit adds a session token and data to the SQLitexStore instance with the
 // given expiry time. If the session token already exists, then the data and expiry
-// time are updated.
-func (p *SQLitexStore) Commit(token string, b []byte, expiry time.Time) error {
-	conn, err := p.db.Take(context.Background())
+// time are updated. An empty token is rejected with ErrEmptyToken. Empty or nil
+// data is stored as a zero-length blob, which Find returns as an empty,
+// non-nil slice. When two commits to the same token race, the later one wins
+// and silently replaces the other, see WithConflictPolicy. An expiry which has
+// already passed is rejected with ErrExpiryInPast, see WithPastExpiry.
+//
+// The expiry is an instant; its location does not matter. It is converted to
+// UTC before being stored and compared against the database's UTC clock, so
+// sessions expire at the same instant regardless of the time zone of the
+// process or the database, and across daylight saving transitions. Like Go
+// and SQLite, the store ignores leap seconds.
+func (p *SQLitexStore) Commit(token string, b []byte, expiry time.Time) (err error) {
+	defer p.logSlow(OpCommit, len(token), time.Now())
+	defer p.wrapError(OpCommit, &err)
+
+	if token == "" {
+		return ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	skip, err := p.pastExpiry(expiry)
+	if err != nil {
+		return err
+	}
+	expiry = p.jitter(expiry)
+	if p.writeBehind != nil {
+		if skip {
+			return p.bufferDelete(token)
+		}
+		return p.bufferCommit(token, b, expiry, false)
+	}
+	conn, put, err := p.take(context.Background(), OpCommit)
 	if err != nil {
 		return err
 	}
-	defer p.db.Put(conn)
+	defer put(&err)
 
-	err = sqlitex.Execute(conn,
-		"REPLACE INTO sessions (token, data, expiry) VALUES ($1, $2, julianday($3))",
-		&sqlitex.ExecOptions{
-			Args: []any{token, b, expiry.UTC().Format("2006-01-02T15:04:05.999")},
-		})
-	return err
+	return p.commitOrDelete(conn, token, b, expiry, skip)
 }
 
 // Delete removes a session token and corresponding data from the SQLitexStore
-// instance.
-func (p *SQLitexStore) Delete(token string) error {
-	conn, err := p.db.Take(context.Background())
+// instance. Deleting an empty token does nothing, as it can never have been
+// committed.
+func (p *SQLitexStore) Delete(token string) (err error) {
+	defer p.logSlow(OpDelete, len(token), time.Now())
+	defer p.wrapError(OpDelete, &err)
+
+	if token == "" {
+		return nil
+	}
+	if p.tokenTooLong(token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	if p.writeBehind != nil {
+		return p.bufferDelete(token)
+	}
+	conn, put, err := p.take(context.Background(), OpDelete)
 	if err != nil {
 		return err
 	}
-	defer p.db.Put(conn)
+	defer put(&err)
 
-	err = sqlitex.Execute(conn, "DELETE FROM sessions WHERE token = $1",
-		&sqlitex.ExecOptions{
-			Args: []any{token},
-		})
-	return err
+	return p.delete(conn, token)
 }
 
 // All returns a map containing the token and data for all active (i.e.
 // not expired) sessions in the SQLitexStore instance.
 func (p *SQLitexStore) All() (map[string][]byte, error) {
-	conn, err := p.db.Take(context.Background())
+	return p.AllCtx(context.Background())
+}
+
+// AllCtx is like All, but stops reading sessions and returns ctx's error once
+// ctx is done.
+func (p *SQLitexStore) AllCtx(ctx context.Context) (_ map[string][]byte, err error) {
+	defer p.logSlow(OpAll, 0, time.Now())
+	defer p.wrapError(OpAll, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(ctx, OpAll)
 	if err != nil {
 		return nil, err
 	}
-	defer p.db.Put(conn)
+	defer put(&err)
 
 	sessions := make(map[string][]byte)
 
-	err = sqlitex.Execute(conn, "SELECT token, data FROM sessions WHERE julianday('now') < expiry",
+	err = sqlitex.Execute(conn, p.q.all,
 		&sqlitex.ExecOptions{
 			ResultFunc: func(stmt *sqlite.Stmt) error {
-				var data []byte
-				var token = stmt.ColumnText(0)
-				data = make([]byte, stmt.ColumnLen(1))
-				stmt.ColumnBytes(1, data)
+				token, ok := p.stripPrefix(stmt.ColumnText(0))
+				if !ok {
+					return nil
+				}
+				data, err := p.columnData(stmt, 1, stmt.ColumnText(0))
+				if err != nil {
+					return err
+				}
 				sessions[token] = data
 				return nil
 			},
@@ -127,26 +530,401 @@ func (p *SQLitexStore) All() (map[string][]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if p.writeBehind != nil {
+		p.overlayBuffered(time.Now(), func(token string, bw bufferedWrite, active bool) {
+			if active {
+				sessions[token] = append([]byte{}, bw.data...)
+			} else {
+				delete(sessions, token)
+			}
+		})
+	}
 	return sessions, nil
 }
 
+// Count returns the number of active sessions.
+func (p *SQLitexStore) Count() (int, error) {
+	return p.CountCtx(context.Background())
+}
+
+// CountCtx is like Count, but gives up with ctx's error once ctx is done.
+func (p *SQLitexStore) CountCtx(ctx context.Context) (_ int, err error) {
+	defer p.logSlow(OpCount, 0, time.Now())
+	defer p.wrapError(OpCount, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(ctx, OpCount)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	var n int
+	err = sqlitex.Execute(conn, p.q.count,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				n = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+	if err != nil {
+		return 0, err
+	}
+	if p.writeBehind != nil {
+		return p.overlayCount(conn, n)
+	}
+	return n, nil
+}
+
+// Counts returns the number of active sessions, as Count does, and the total
+// number of sessions, including expired sessions which cleanup has not yet
+// deleted, both from a single query. As with Count, writes buffered by
+// WithWriteBehind are counted without being flushed.
+func (p *SQLitexStore) Counts() (active, total int, err error) {
+	defer p.logSlow(OpCounts, 0, time.Now())
+	defer p.wrapError(OpCounts, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(context.Background(), OpCounts)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer put(&err)
+
+	err = sqlitex.Execute(conn, p.q.counts,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				// SUM is NULL for an empty table, which reads as 0.
+				active = stmt.ColumnInt(0)
+				total = stmt.ColumnInt(1)
+				return nil
+			},
+		})
+	if err != nil {
+		return 0, 0, err
+	}
+	if p.writeBehind != nil {
+		return p.overlayCounts(conn, active, total)
+	}
+	return active, total, nil
+}
+
+// AllOrderedByCreated returns the tokens of all active sessions in the order
+// they were first committed, oldest first. It requires the WithSequence option.
+func (p *SQLitexStore) AllOrderedByCreated() (_ []string, err error) {
+	defer p.logSlow(OpAllOrderedByCreated, 0, time.Now())
+	defer p.wrapError(OpAllOrderedByCreated, &err)
+
+	if !p.sequence {
+		return nil, ErrNoSequence
+	}
+	conn, put, err := p.take(context.Background(), OpAllOrderedByCreated)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	var tokens []string
+	err = sqlitex.Execute(conn, p.q.allOrderedByCreated,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if token, ok := p.stripPrefix(stmt.ColumnText(0)); ok {
+					tokens = append(tokens, token)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// ExpiringWithin returns the tokens of active sessions which expire within d
+// from now, soonest first. This is useful for refreshing sessions before they
+// expire without scanning the whole table.
+func (p *SQLitexStore) ExpiringWithin(d time.Duration) (_ []string, err error) {
+	defer p.logSlow(OpExpiringWithin, 0, time.Now())
+	defer p.wrapError(OpExpiringWithin, &err)
+
+	conn, put, err := p.take(context.Background(), OpExpiringWithin)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	var tokens []string
+	err = sqlitex.Execute(conn, p.q.expiringWithin,
+		&sqlitex.ExecOptions{
+			Args: []any{p.encodeExpiry(time.Now().Add(d))},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if token, ok := p.stripPrefix(stmt.ColumnText(0)); ok {
+					tokens = append(tokens, token)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// maxExpiredSessions is the most tokens ExpiredSessions returns, so that a
+// large cleanup backlog is not loaded all at once.
+const maxExpiredSessions = 1000
+
+// ExpiredSessions returns the tokens of up to 1000 sessions which have expired
+// but not yet been deleted, longest expired first. It is meant for checking
+// that cleanup keeps up; Count reports how many sessions are still active.
+func (p *SQLitexStore) ExpiredSessions() (_ []string, err error) {
+	defer p.logSlow(OpExpiredSessions, 0, time.Now())
+	defer p.wrapError(OpExpiredSessions, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(context.Background(), OpExpiredSessions)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	if p.writeBehind != nil {
+		if err := p.flush(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	prefix := p.scopePrefix("")
+	var tokens []string
+	err = sqlitex.Execute(conn, p.q.expiredSessions,
+		&sqlitex.ExecOptions{
+			Args: []any{prefix, prefixUpperBound(prefix), maxExpiredSessions},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if token, ok := p.stripPrefix(stmt.ColumnText(0)); ok {
+					tokens = append(tokens, token)
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// AllExpiringBetween returns the data of the active sessions which expire at
+// or after start and before end, keyed by token. Like All, it never returns
+// expired sessions, so a start in the past behaves as the current time. The
+// range is filtered in the database with the expiry index.
+func (p *SQLitexStore) AllExpiringBetween(start, end time.Time) (_ map[string][]byte, err error) {
+	defer p.logSlow(OpAllExpiringBetween, 0, time.Now())
+	defer p.wrapError(OpAllExpiringBetween, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(context.Background(), OpAllExpiringBetween)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	sessions := make(map[string][]byte)
+	err = sqlitex.Execute(conn, p.q.expiringBetween,
+		&sqlitex.ExecOptions{
+			Args: []any{p.encodeExpiry(start), p.encodeExpiry(end)},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				token, ok := p.stripPrefix(stmt.ColumnText(0))
+				if !ok {
+					return nil
+				}
+				data, err := p.columnData(stmt, 1, stmt.ColumnText(0))
+				if err != nil {
+					return err
+				}
+				sessions[token] = data
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if p.writeBehind != nil {
+		p.overlayBuffered(time.Now(), func(token string, bw bufferedWrite, active bool) {
+			if active && !bw.expiry.Before(start) && bw.expiry.Before(end) {
+				sessions[token] = append([]byte{}, bw.data...)
+			} else {
+				delete(sessions, token)
+			}
+		})
+	}
+	return sessions, nil
+}
+
+// AllWithTTL returns the remaining time until expiry of every active session,
+// keyed by token. The time remaining is measured from when AllWithTTL was
+// called, and sessions with none left by then are left out.
+func (p *SQLitexStore) AllWithTTL() (_ map[string]time.Duration, err error) {
+	defer p.logSlow(OpAllWithTTL, 0, time.Now())
+	defer p.wrapError(OpAllWithTTL, &err)
+	defer p.checkCorrupt(&err)
+
+	conn, put, err := p.take(context.Background(), OpAllWithTTL)
+	if err != nil {
+		return nil, err
+	}
+	defer put(&err)
+
+	now := time.Now()
+	ttls := make(map[string]time.Duration)
+	err = sqlitex.Execute(conn, p.q.allExpiry,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				token, ok := p.stripPrefix(stmt.ColumnText(0))
+				ttl := p.decodeExpiry(stmt, 1).Sub(now)
+				if ok && ttl > 0 {
+					ttls[token] = ttl
+				}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if p.writeBehind != nil {
+		p.overlayBuffered(now, func(token string, bw bufferedWrite, active bool) {
+			if active {
+				ttls[token] = bw.expiry.Sub(now)
+			} else {
+				delete(ttls, token)
+			}
+		})
+	}
+	return ttls, nil
+}
+
 func (p *SQLitexStore) startCleanup(interval time.Duration) {
-	p.stopCleanup = make(chan bool)
 	ticker := time.NewTicker(interval)
 	for {
 		select {
-		case <-ticker.C:
-			err := p.deleteExpired()
-			if err != nil {
-				log.Println(err)
+		case now := <-ticker.C:
+			if p.corrupt.Load() {
+				// There is no point cleaning up a corrupt
+				// database, but the goroutine keeps ticking
+				// so that cleanup resumes if WithReconnect
+				// recovers the store.
+				p.nextCleanup.Store(0)
+				continue
 			}
+			p.nextCleanup.Store(now.Add(interval).UnixNano())
+			p.runCleanup()
 		case <-p.stopCleanup:
 			ticker.Stop()
+			p.nextCleanup.Store(0)
 			return
 		}
 	}
 }
 
+// startCleanupSchedule is startCleanup for WithCleanupSchedule, with a timer
+// reset to the next scheduled time after each cleanup.
+func (p *SQLitexStore) startCleanupSchedule(next func(now time.Time) time.Time) {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	defer p.nextCleanup.Store(0)
+	for {
+		at := next(time.Now())
+		if !at.IsZero() {
+			timer.Reset(time.Until(at))
+			p.nextCleanup.Store(at.UnixNano())
+		} else {
+			p.nextCleanup.Store(0)
+		}
+		select {
+		case <-timer.C:
+			// As with startCleanup, a corrupt database is not
+			// cleaned up.
+			if !p.corrupt.Load() {
+				p.runCleanup()
+			}
+		case <-p.stopCleanup:
+			return
+		}
+	}
+}
+
+// runCleanup deletes expired sessions for the cleanup goroutine or a shared
+// Cleaner, and reports the outcome.
+func (p *SQLitexStore) runCleanup() {
+	plan := cleanupFull
+	if p.adaptive != nil {
+		plan = p.adaptive.plan()
+	}
+	if plan == cleanupSkip {
+		return
+	}
+	start := time.Now()
+	var n int
+	var err error
+	// DeleteExpired counts its own result towards the circuit breaker.
+	if plan == cleanupShort && p.archiveRetention <= 0 {
+		n, err = p.deleteExpiredShort()
+		p.recordResult(err)
+	} else if p.cleanupBudget > 0 && p.archiveRetention <= 0 {
+		n, err = p.deleteExpiredWithin(p.cleanupBudget)
+		p.recordResult(err)
+	} else {
+		n, err = p.DeleteExpired(p.cleanupCtx)
+	}
+	d := time.Since(start)
+	p.observe(Event{
+		Op:       OpCleanup,
+		Duration: d,
+		Rows:     n,
+		Err:      err,
+	})
+	if err != nil && p.cleanupCtx.Err() == nil {
+		p.logger.Printf("zqlsession: %s: %v", p.name, err)
+	}
+	if p.afterCleanup != nil {
+		p.afterCleanup(n, d, err)
+	}
+}
+
+// NextCleanup returns when the background cleanup, or the shared Cleaner, will
+// next delete expired sessions, the interval between cleanups, and whether
+// cleanup is enabled at all. Cleanup is not enabled when the store was created
+// with a cleanup interval of 0, once StopCleanup has been called, or once the
+// database has been found corrupt. With WithCleanupSchedule the interval is 0,
+// and cleanup is enabled until the schedule returns the zero time. While a
+// cleanup is running next may be in the past.
+func (p *SQLitexStore) NextCleanup() (next time.Time, interval time.Duration, enabled bool) {
+	if p.closed.Load() || p.corrupt.Load() {
+		return time.Time{}, p.cleanupInterval, false
+	}
+	ns := p.nextCleanup.Load()
+	if p.cleaner != nil {
+		ns = p.cleaner.next.Load()
+	}
+	if ns == 0 {
+		return time.Time{}, p.cleanupInterval, false
+	}
+	return time.Unix(0, ns), p.cleanupInterval, true
+}
+
 // StopCleanup terminates the background cleanup goroutine for the SQLitexStore
 // instance. It's rare to terminate this; generally SQLitexStore instances and
 // their cleanup goroutines are intended to be long-lived and run for the lifetime
@@ -157,22 +935,483 @@ func (p *SQLitexStore) startCleanup(interval time.Duration) {
 // scenario, the cleanup goroutine (which will run forever) will prevent the
 // SQLitexStore object from being garbage collected even after the test function
 // has finished. You can prevent this by manually calling StopCleanup.
+//
+// StopCleanup also closes the store, after which all operations return
+// ErrClosed. Use Shutdown to additionally wait for in-flight operations.
 func (p *SQLitexStore) StopCleanup() {
-	if p.stopCleanup != nil {
-		p.stopCleanup <- true
+	p.stopOnce.Do(func() {
+		if p.cleaner != nil {
+			p.cleaner.Unregister(p)
+		}
+		if p.cancelCleanup != nil {
+			p.cancelCleanup()
+		}
+		if p.stopCleanup != nil {
+			p.stopCleanup <- true
+		}
+	})
+
+	p.mu.Lock()
+	p.closed.Store(true)
+	p.mu.Unlock()
+}
+
+// Shutdown stops the background cleanup goroutine and waits for all in-flight
+// store operations to finish, or for ctx to be done. With WithWriteBehind and
+// WithAccessCounting, it then flushes any buffered writes and access counts.
+// Once Shutdown returns nil it is safe to close the underlying pool; a store
+// created by NewMemory closes its own pool, discarding the database.
+// Operations started after Shutdown has been called return ErrClosed.
+func (p *SQLitexStore) Shutdown(ctx context.Context) error {
+	p.StopCleanup()
+
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if p.writeBehind != nil {
+		if err := p.stopWriteBehind(ctx); err != nil {
+			return err
+		}
+	}
+	if p.access != nil {
+		if err := p.stopAccessFlush(ctx); err != nil {
+			return err
+		}
+	}
+	if p.ownsPool {
+		return p.pool().Close()
+	}
+	return nil
+}
+
+// take checks out a connection from the pool for a single store operation,
+// tracking it as in-flight. The returned put function must be called with the
+// operation's error once it is done with the connection, usually deferred with
+// a pointer to its named err result. Once it has been called, the observer is
+// sent an Event for op with the time spent waiting for the connection, the
+// time it was held and the error. While the WithCircuitBreaker breaker is
+// open it fails with ErrCircuitOpen instead.
+func (p *SQLitexStore) take(ctx context.Context, op Op) (*sqlite.Conn, func(*error), error) {
+	if p.corrupt.Load() && !p.recoverCorrupt(ctx) {
+		return nil, nil, ErrCorrupt
+	}
+	if p.breaker != nil {
+		if err := p.breaker.allow(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return p.acquire(ctx, op)
+}
+
+// acquire is take without the check for a corrupt database.
+func (p *SQLitexStore) acquire(ctx context.Context, op Op) (*sqlite.Conn, func(*error), error) {
+	done, err := p.track()
+	if err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	p.countLoad(op)
+	waited := p.startWaiting(op)
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			waited()
+			done()
+			return nil, nil, ctx.Err()
+		}
+		untrack := done
+		done = func() {
+			<-p.sem
+			untrack()
+		}
+	}
+
+	// The connection must go back to the pool it came from, even if
+	// WithReconnect has since replaced it.
+	db := p.pool()
+	conn, err := p.takeConn(ctx, db)
+	waited()
+	if err != nil {
+		done()
+		p.observe(Event{Op: op, Wait: time.Since(start), Err: err})
+		p.checkReconnect(db, err)
+		return nil, nil, err
+	}
+	if err := p.prepareConn(conn); err != nil {
+		db.Put(conn)
+		done()
+		return nil, nil, err
 	}
+	taken := time.Now()
+	return conn, func(err *error) {
+		held := time.Since(taken)
+		db.Put(conn)
+		done()
+		p.observe(Event{Op: op, Duration: held, Wait: taken.Sub(start), Err: *err})
+	}, nil
 }
 
-func (p *SQLitexStore) deleteExpired() error {
-	conn, err := p.db.Take(context.Background())
+// takeConn takes a connection from db, waiting for at most the
+// WithAcquireTimeout duration if one was given.
+func (p *SQLitexStore) takeConn(ctx context.Context, db *sqlitex.Pool) (*sqlite.Conn, error) {
+	if p.acquireTimeout <= 0 {
+		return db.Take(ctx)
+	}
+	takeCtx, cancel := context.WithTimeout(ctx, p.acquireTimeout)
+	defer cancel()
+
+	conn, err := db.Take(takeCtx)
+	if err != nil {
+		if ctx.Err() == nil && takeCtx.Err() == context.DeadlineExceeded {
+			return nil, ErrPoolTimeout
+		}
+		return nil, err
+	}
+	// The pool interrupts the connection when the context it was taken
+	// with is done, but the timeout only applies to taking it.
+	conn.SetInterrupt(ctx.Done())
+	return conn, nil
+}
+
+// prepareConn applies the connection settings required by the store's options
+// to a connection taken from the pool. The settings last for the life of the
+// connection, so each connection is only prepared once.
+func (p *SQLitexStore) prepareConn(conn *sqlite.Conn) error {
+	if p.userForeignKey == "" && !p.exclusiveLocking && p.cacheSize <= 0 {
+		return nil
+	}
+	p.preparedMu.Lock()
+	_, ok := p.prepared[conn]
+	p.preparedMu.Unlock()
+	if ok {
+		return nil
+	}
+
+	if p.userForeignKey != "" {
+		if err := sqlitex.ExecuteTransient(conn, "PRAGMA foreign_keys = ON", nil); err != nil {
+			return err
+		}
+	}
+	if p.exclusiveLocking {
+		if err := sqlitex.ExecuteTransient(conn, "PRAGMA locking_mode = EXCLUSIVE", nil); err != nil {
+			return err
+		}
+	}
+	if p.cacheSize > 0 {
+		// A negative cache_size is a size in KiB rather than in pages.
+		pragma := fmt.Sprintf("PRAGMA cache_size = -%d", p.cacheSize)
+		if err := sqlitex.ExecuteTransient(conn, pragma, nil); err != nil {
+			return err
+		}
+	}
+
+	p.preparedMu.Lock()
+	if p.prepared == nil {
+		p.prepared = make(map[*sqlite.Conn]struct{})
+	}
+	p.prepared[conn] = struct{}{}
+	p.preparedMu.Unlock()
+	return nil
+}
+
+// track records a store operation as in-flight, failing with ErrClosed if the
+// store has been closed. The returned done function must be called once the
+// operation has finished.
+func (p *SQLitexStore) track() (func(), error) {
+	if p.closed.Load() {
+		return nil, ErrClosed
+	}
+	p.mu.Lock()
+	if p.closed.Load() {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	p.inflight.Add(1)
+	p.mu.Unlock()
+
+	return p.inflight.Done, nil
+}
+
+// DeleteExpired removes all expired sessions, returning the number removed.
+// It is run periodically by the background cleanup goroutine, but may also be
+// called directly, for example from a scheduled job when cleanup is disabled.
+func (p *SQLitexStore) DeleteExpired(ctx context.Context) (_ int, err error) {
+	defer p.logSlow(OpDeleteExpired, 0, time.Now())
+	defer p.wrapError(OpDeleteExpired, &err)
+	defer p.checkCorrupt(&err)
+
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+	var n int
+	if p.politeBatch > 0 && p.archiveRetention <= 0 {
+		n, err = p.deleteExpiredBatches(ctx, p.politeBatch, true, time.Time{})
+		if n > 0 {
+			p.lifecycle(OpSessionsExpired, n)
+		}
+		return n, err
+	}
+	conn, put, err := p.take(ctx, OpDeleteExpired)
+	if err != nil {
+		return 0, err
+	}
+	defer put(&err)
+
+	if p.archiveRetention > 0 {
+		n, err = p.archiveExpired(conn)
+	} else {
+		err = sqlitex.Execute(conn, p.q.deleteExpired, nil)
+		n = conn.Changes()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		p.lifecycle(OpSessionsExpired, n)
+	}
+	return n, nil
+}
+
+// find uses a cached prepared statement directly rather than sqlitex.Execute.
+// Many lookups are for tokens which do not exist (old cookies, bots) so this
+// keeps the not-found path free of the closure and argument allocations.
+func (p *SQLitexStore) find(conn *sqlite.Conn, token string) (_ []byte, _ bool, err error) {
+	defer p.checkCorrupt(&err)
+
+	token = p.normalizeToken(token)
+	if token == "" || p.tokenTooLong(token) {
+		return nil, false, nil
+	}
+	stmt, err := conn.Prepare(p.q.find)
+	if err != nil {
+		return nil, false, err
+	}
+	defer stmt.Reset()
+
+	stmt.BindText(1, token)
+	found, err := stmt.Step()
+	if err != nil {
+		return nil, false, err
+	}
+	p.countFind(found)
+	if !found {
+		return nil, false, nil
+	}
+	b, err := p.columnData(stmt, 0, token)
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func (p *SQLitexStore) commit(conn *sqlite.Conn, token string, b []byte, expiry time.Time) error {
+	stored, err := p.encodeData(b)
+	if err != nil {
+		return err
+	}
+	if p.aead != nil && len(stored) > 0 && stored[0] == encryptedMarker {
+		// Plaintext which looks encrypted is encrypted, so that it
+		// reads back unchanged.
+		if stored, err = p.encrypt(stored, p.normalizeToken(token)); err != nil {
+			return err
+		}
+	}
+	return p.commitStored(conn, token, b, p.addChecksum(stored), expiry)
+}
+
+// jitter returns expiry with the random offset of WithExpiryJitter added. It
+// is applied once by the methods which commit a caller's session, so that
+// imported, moved and buffered sessions keep the expiry they already have.
+func (p *SQLitexStore) jitter(expiry time.Time) time.Time {
+	if p.expiryJitter > 0 {
+		expiry = expiry.Add(time.Duration(rand.Int63n(int64(p.expiryJitter))))
+	}
+	return expiry
+}
+
+// commitStored commits a session whose data is b, stored as its encoded form
+// stored.
+func (p *SQLitexStore) commitStored(conn *sqlite.Conn, token string, b, stored []byte, expiry time.Time) (err error) {
+	defer p.checkCorrupt(&err)
+
+	token = p.normalizeToken(token)
+	if token == "" {
+		return ErrEmptyToken
+	}
+	if p.tokenTooLong(token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	var hash []byte
+	if p.skipUnchanged {
+		sum := sha256.Sum256(stored)
+		hash = sum[:]
+		touched, err := p.touchUnchanged(conn, token, hash, expiry)
+		if err != nil {
+			return err
+		}
+		if touched {
+			p.lifecycle(OpSessionRefreshed, 1)
+			return nil
+		}
+	}
+	query := p.q.commit
+	if p.sequence {
+		query = p.q.commitSequence
+	}
+	// Options which run more than one statement need them to be atomic.
+	if p.userID != nil || p.splitData || p.maxSessions > 0 || p.observer != nil || hash != nil {
+		defer sqlitex.Save(conn)(&err)
+	}
+	// Observers are told whether the session is new or refreshed, which
+	// the upsert cannot tell apart by itself.
+	var existed bool
+	if p.observer != nil {
+		existed, err = p.exists(conn, token)
+		if err != nil {
+			return err
+		}
+	}
+	var data any = stored
+	if p.splitData {
+		data, err = p.commitData(conn, token, stored)
+		if err != nil {
+			return err
+		}
+	}
+	err = sqlitex.Execute(conn, query,
+		&sqlitex.ExecOptions{
+			Args: []any{token, data, p.encodeExpiry(expiry)},
+		})
+	if err != nil {
+		return err
+	}
+
+	if hash != nil {
+		err = sqlitex.Execute(conn, p.q.setDataHash,
+			&sqlitex.ExecOptions{
+				Args: []any{hash, token},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if p.userID != nil {
+		var userID any
+		if id := p.userID(b); id != "" {
+			userID = id
+		}
+		err = sqlitex.Execute(conn, p.q.setUserID,
+			&sqlitex.ExecOptions{
+				Args: []any{userID, token},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if p.maxSessions > 0 {
+		err = sqlitex.Execute(conn, p.q.evictOldest,
+			&sqlitex.ExecOptions{
+				Args: []any{token, p.maxSessions},
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	op := OpSessionCreated
+	if existed {
+		op = OpSessionRefreshed
+	}
+	p.lifecycle(op, 1)
+	return nil
+}
+
+// commitData stores b in the data table for the WithSplitData option,
+// returning the data_id the session row should reference. The data_id of an
+// existing session is reused.
+func (p *SQLitexStore) commitData(conn *sqlite.Conn, token string, b []byte) (int64, error) {
+	var id int64
+	var found bool
+	err := sqlitex.Execute(conn, p.q.dataID,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				found = true
+				id = stmt.ColumnInt64(0)
+				return nil
+			},
+			Args: []any{token},
+		})
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return id, sqlitex.Execute(conn, p.q.updateData,
+			&sqlitex.ExecOptions{
+				Args: []any{b, id},
+			})
+	}
+	err = sqlitex.Execute(conn, p.q.insertData,
+		&sqlitex.ExecOptions{
+			Args: []any{b},
+		})
+	if err != nil {
+		return 0, err
+	}
+	return conn.LastInsertRowID(), nil
+}
+
+func (p *SQLitexStore) delete(conn *sqlite.Conn, token string) (err error) {
+	defer p.checkCorrupt(&err)
+
+	token = p.normalizeToken(token)
+	if token == "" {
+		return nil
+	}
+	if p.tokenTooLong(token) {
+		return ErrTokenTooLong
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	err = sqlitex.Execute(conn, p.q.delete,
+		&sqlitex.ExecOptions{
+			Args: []any{token},
+		})
 	if err != nil {
 		return err
 	}
-	defer p.db.Put(conn)
+	if n := conn.Changes(); n > 0 {
+		p.lifecycle(OpSessionDeleted, n)
+	}
+	return nil
+}
+
+// tokenTooLong reports whether token exceeds the WithMaxTokenLength limit.
+func (p *SQLitexStore) tokenTooLong(token string) bool {
+	return p.maxTokenLength > 0 && len(token) > p.maxTokenLength
+}
 
-	return sqlitex.Execute(
-		conn,
-		"DELETE FROM sessions WHERE expiry < julianday('now')",
-		nil,
-	)
+// normalizeToken applies the WithTokenNormalizer function, if any, to token
+// and adds the WithTokenPrefix namespace. Every method which queries by token
+// must normalize it first, exactly once, and every method which returns
+// tokens must strip the namespace with stripPrefix.
+func (p *SQLitexStore) normalizeToken(token string) string {
+	if p.normalize != nil {
+		token = p.normalize(token)
+	}
+	if token == "" || p.tokenPrefix == "" {
+		return token
+	}
+	return p.tokenPrefix + token
 }
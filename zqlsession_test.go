@@ -0,0 +1,271 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsession_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestConformance(t *testing.T) {
+	zqlsessiontest.RunConformance(t, zqlsessiontest.NewMemoryStore(t))
+}
+
+// TestConformanceConfigured runs the conformance suite against stores
+// configured the way an application might, to check the options keep to the
+// store contract.
+func TestConformanceConfigured(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []zqlsession.Option
+	}{
+		{"TableName", []zqlsession.Option{zqlsession.WithTableName("admin_sessions")}},
+		{"Encryption", []zqlsession.Option{
+			zqlsession.WithEncryptionKey(testKey), zqlsession.WithDataChecksum()}},
+		{"Codec", []zqlsession.Option{zqlsession.WithCodec(prefixCodec{})}},
+		{"UnixExpiry", []zqlsession.Option{zqlsession.WithUnixExpiry()}},
+		{"TokenPrefix", []zqlsession.Option{zqlsession.WithTokenPrefix("app:")}},
+		{"CoveringIndex", []zqlsession.Option{zqlsession.WithCoveringIndex()}},
+		{"Sequence", []zqlsession.Option{zqlsession.WithSequence()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			zqlsessiontest.RunConformance(t, zqlsessiontest.NewMemoryStore(t, tt.opts...))
+		})
+	}
+
+	// Two stores sharing a file database through one pool, each with a
+	// table of its own.
+	t.Run("SharedPool", func(t *testing.T) {
+		db := newPool(t)
+		users := newStore(t, db)
+		admins := newStore(t, db, zqlsession.WithTableName("admin_sessions"))
+		zqlsessiontest.RunConformance(t, users)
+		zqlsessiontest.RunConformance(t, admins)
+	})
+}
+
+// FuzzCommitFind round trips arbitrary data through every layer of the stored
+// form: the codec, encryption and the checksum.
+func FuzzCommitFind(f *testing.F) {
+	zqlsessiontest.FuzzCommitFind(f, zqlsessiontest.NewMemoryStore(f,
+		zqlsession.WithCodec(prefixCodec{}),
+		zqlsession.WithEncryptionKey(testKey),
+		zqlsession.WithDataChecksum()))
+}
+
+func TestEmptyToken(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	err := store.Commit("", []byte("data"), time.Now().Add(time.Hour))
+	if !errors.Is(err, zqlsession.ErrEmptyToken) {
+		t.Errorf("commit: got %v, want ErrEmptyToken", err)
+	}
+	if b, found, err := store.Find(""); err != nil || found || b != nil {
+		t.Errorf("find: got %q, %v, %v, want nil, false, nil", b, found, err)
+	}
+	if err := store.Delete(""); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if n, err := store.Count(); err != nil || n != 0 {
+		t.Errorf("count: got %d, %v, want 0", n, err)
+	}
+}
+
+func TestEmptyData(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t)
+
+	expiry := time.Now().Add(time.Hour)
+	for _, data := range [][]byte{nil, {}} {
+		if err := store.Commit("token", data, expiry); err != nil {
+			t.Fatalf("commit %#v: %v", data, err)
+		}
+		b, found, err := store.Find("token")
+		if err != nil || !found {
+			t.Fatalf("find %#v: got %v, %v, want found", data, found, err)
+		}
+		if b == nil || len(b) != 0 {
+			t.Errorf("find %#v: got %#v, want empty, non-nil data", data, b)
+		}
+	}
+}
+
+// TestEmptyDataReads checks that every read of a session committed with empty
+// data returns empty, non-nil data, whatever the stored form, and that a
+// missing session is reported by found alone.
+func TestEmptyDataReads(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		opts []zqlsession.Option
+	}{
+		{"Plain", nil},
+		{"Codec", []zqlsession.Option{zqlsession.WithCodec(prefixCodec{})}},
+		{"Encrypted", []zqlsession.Option{
+			zqlsession.WithEncryptionKey(testKey), zqlsession.WithDataChecksum()}},
+		{"SplitData", []zqlsession.Option{zqlsession.WithSplitData()}},
+		{"WriteBehind", []zqlsession.Option{zqlsession.WithWriteBehind(time.Hour, 100)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := zqlsessiontest.NewMemoryStore(t, tt.opts...)
+			if err := store.Commit("token", []byte{}, time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			empty := func(method string, b []byte) {
+				t.Helper()
+				if b == nil || len(b) != 0 {
+					t.Errorf("%s: got %#v, want empty, non-nil data", method, b)
+				}
+			}
+
+			b, found, err := store.Find("token")
+			if err != nil || !found {
+				t.Fatalf("find: got %v, %v, want found", found, err)
+			}
+			empty("Find", b)
+			b, found, err = store.Find("missing")
+			if err != nil || found || b != nil {
+				t.Errorf("find missing: got %#v, %v, %v, want nil, false", b, found, err)
+			}
+			results, err := store.FindBatch([]string{"token", "missing"})
+			if err != nil {
+				t.Fatalf("find batch: %v", err)
+			}
+			empty("FindBatch", results[0].Data)
+			if results[1].Found || results[1].Data != nil {
+				t.Errorf("find batch missing: got %+v, want nil, false", results[1])
+			}
+			all, err := store.All()
+			if err != nil {
+				t.Fatalf("all: %v", err)
+			}
+			empty("All", all["token"])
+			err = store.Iterate(ctx, func(token string, data []byte) error {
+				empty("Iterate", data)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("iterate: %v", err)
+			}
+			sessions, err := store.Export(ctx, zqlsession.Decoded)
+			if err != nil || len(sessions) != 1 {
+				t.Fatalf("export: got %d sessions, %v, want 1", len(sessions), err)
+			}
+			empty("Export", sessions[0].Data)
+			err = store.WithTx(ctx, func(tx *zqlsession.Tx) error {
+				b, _, err := tx.Find("token")
+				empty("Tx.Find", b)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("tx: %v", err)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	for _, close := range []struct {
+		name string
+		fn   func(*zqlsession.SQLitexStore) error
+	}{
+		{"StopCleanup", func(s *zqlsession.SQLitexStore) error {
+			s.StopCleanup()
+			return nil
+		}},
+		{"Shutdown", func(s *zqlsession.SQLitexStore) error {
+			return s.Shutdown(context.Background())
+		}},
+	} {
+		t.Run(close.name, func(t *testing.T) {
+			store := newStore(t, newPool(t))
+			if err := close.fn(store); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour))
+			if !errors.Is(err, zqlsession.ErrClosed) {
+				t.Errorf("commit: got %v, want ErrClosed", err)
+			}
+			if _, _, err := store.Find("token"); !errors.Is(err, zqlsession.ErrClosed) {
+				t.Errorf("find: got %v, want ErrClosed", err)
+			}
+			if err := store.Delete("token"); !errors.Is(err, zqlsession.ErrClosed) {
+				t.Errorf("delete: got %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+// TestStopCleanupExhaustedPool stops cleanup while it waits for a connection
+// from an exhausted pool, which must return without the connection.
+func TestStopCleanupExhaustedPool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sqlitex.NewPool(path, sqlitex.PoolOptions{PoolSize: 1})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	store := zqlsession.NewWithCleanupInterval(db, time.Millisecond, zqlsession.WithAutoMigrate())
+
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	defer db.Put(conn)
+	// Give cleanup time to start waiting for the connection.
+	time.Sleep(20 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		store.StopCleanup()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopCleanup is waiting for the pool")
+	}
+}
+
+func TestExistsCoveringIndex(t *testing.T) {
+	store := zqlsessiontest.NewMemoryStore(t, zqlsession.WithCoveringIndex())
+
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if ok, err := store.Exists("token"); err != nil || !ok {
+		t.Errorf("exists: got %v, %v, want true", ok, err)
+	}
+	if ok, err := store.Exists("missing"); err != nil || ok {
+		t.Errorf("exists missing: got %v, %v, want false", ok, err)
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	store := zqlsessiontest.NewMemoryStore(b)
+	if err := store.Commit("token", []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		b.Fatalf("commit: %v", err)
+	}
+	for _, bm := range []struct {
+		name  string
+		token string
+	}{
+		{"Found", "token"},
+		{"NotFound", "missing"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.Find(bm.token); err != nil {
+					b.Fatalf("find: %v", err)
+				}
+			}
+		})
+	}
+}
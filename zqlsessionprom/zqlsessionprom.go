@@ -0,0 +1,168 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+
+// Package zqlsessionprom exports the metrics of zqlsession stores to
+// Prometheus. It is kept apart from zqlsession so that only programs which
+// use it depend on the Prometheus client.
+//
+// A Collector receives the Events of each store it observes and reads their
+// Stats and session counts when scraped:
+//
+//	c := zqlsessionprom.NewCollector()
+//	store := zqlsession.New(db, zqlsession.WithObserver(c.Observe))
+//	c.Watch(store)
+//	prometheus.MustRegister(c)
+//
+// Every metric has a store label holding the store's name, see
+// zqlsession.WithName, so one Collector can serve several stores.
+package zqlsessionprom
+
+import (
+	"sync"
+
+	"git.sr.ht/~kota/zqlsession"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a prometheus.Collector for zqlsession stores. It exports:
+//
+//   - zqlsession_operations_total, the number of operations by op and result,
+//     which is "ok" or "error"; background cleanup runs have the op
+//     "cleanup"
+//   - zqlsession_operation_duration_seconds, a histogram of how long
+//     operations held their connection, by op
+//   - zqlsession_pool_wait_seconds, a histogram of how long operations waited
+//     for a connection
+//   - zqlsession_sessions, the number of active sessions in each watched
+//     store
+//   - zqlsession_finds_total, zqlsession_find_hits_total,
+//     zqlsession_commits_total, zqlsession_sessions_deleted_total and
+//     zqlsession_sessions_expired_total, from the Stats of each watched store
+//
+// The operation metrics come from the Events given to Observe, and the others
+// are read from the watched stores on each scrape, which counts the sessions
+// with a query.
+type Collector struct {
+	operations *prometheus.CounterVec
+	durations  *prometheus.HistogramVec
+	waits      *prometheus.HistogramVec
+
+	sessions *prometheus.Desc
+	finds    *prometheus.Desc
+	hits     *prometheus.Desc
+	commits  *prometheus.Desc
+	deleted  *prometheus.Desc
+	expired  *prometheus.Desc
+
+	mu     sync.Mutex
+	stores []*zqlsession.SQLitexStore
+}
+
+// NewCollector returns a Collector which is watching no stores.
+func NewCollector() *Collector {
+	store := []string{"store"}
+	return &Collector{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "zqlsession_operations_total",
+			Help: "Number of session store operations.",
+		}, []string{"store", "op", "result"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "zqlsession_operation_duration_seconds",
+			Help:    "Time session store operations held their connection.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"store", "op"}),
+		waits: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "zqlsession_pool_wait_seconds",
+			Help:    "Time session store operations waited for a connection.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, store),
+
+		sessions: prometheus.NewDesc("zqlsession_sessions",
+			"Number of active sessions.", store, nil),
+		finds: prometheus.NewDesc("zqlsession_finds_total",
+			"Number of session lookups by token.", store, nil),
+		hits: prometheus.NewDesc("zqlsession_find_hits_total",
+			"Number of session lookups which found an active session.", store, nil),
+		commits: prometheus.NewDesc("zqlsession_commits_total",
+			"Number of sessions written.", store, nil),
+		deleted: prometheus.NewDesc("zqlsession_sessions_deleted_total",
+			"Number of sessions explicitly deleted.", store, nil),
+		expired: prometheus.NewDesc("zqlsession_sessions_expired_total",
+			"Number of expired sessions removed.", store, nil),
+	}
+}
+
+// Observe records an Event. Pass it to zqlsession.WithObserver, or call it from
+// an observer which does other work too.
+func (c *Collector) Observe(e zqlsession.Event) {
+	switch e.Op {
+	case zqlsession.OpSessionCreated, zqlsession.OpSessionRefreshed,
+		zqlsession.OpSessionDeleted, zqlsession.OpSessionsExpired,
+		zqlsession.OpCorrupt:
+		// Lifecycle events are counted by the store's Stats, and
+		// corruption shows in the operations which fail.
+		return
+	}
+	result := "ok"
+	if e.Err != nil {
+		result = "error"
+	}
+	op := string(e.Op)
+	c.operations.WithLabelValues(e.Store, op, result).Inc()
+	c.durations.WithLabelValues(e.Store, op).Observe(e.Duration.Seconds())
+	if e.Op != zqlsession.OpCleanup {
+		c.waits.WithLabelValues(e.Store).Observe(e.Wait.Seconds())
+	}
+}
+
+// Watch adds store to the stores whose session counts and Stats are exported.
+func (c *Collector) Watch(store *zqlsession.SQLitexStore) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stores = append(c.stores, store)
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.operations.Describe(ch)
+	c.durations.Describe(ch)
+	c.waits.Describe(ch)
+	ch <- c.sessions
+	ch <- c.finds
+	ch <- c.hits
+	ch <- c.commits
+	ch <- c.deleted
+	ch <- c.expired
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.operations.Collect(ch)
+	c.durations.Collect(ch)
+	c.waits.Collect(ch)
+
+	c.mu.Lock()
+	stores := append([]*zqlsession.SQLitexStore(nil), c.stores...)
+	c.mu.Unlock()
+
+	for _, store := range stores {
+		name := store.Name()
+		if n, err := store.Count(); err != nil {
+			ch <- prometheus.NewInvalidMetric(c.sessions, err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(c.sessions,
+				prometheus.GaugeValue, float64(n), name)
+		}
+		s := store.Stats()
+		counter := func(desc *prometheus.Desc, v int64) {
+			ch <- prometheus.MustNewConstMetric(desc,
+				prometheus.CounterValue, float64(v), name)
+		}
+		counter(c.finds, s.Finds)
+		counter(c.hits, s.Hits)
+		counter(c.commits, s.Commits)
+		counter(c.deleted, s.Deleted)
+		counter(c.expired, s.Expired)
+	}
+}
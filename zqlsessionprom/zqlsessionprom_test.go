@@ -0,0 +1,126 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsessionprom_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessionprom"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"github.com/prometheus/client_golang/prometheus"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// value returns the value of the counter or gauge called name with the given
+// labels gathered from reg, or -1 if there is none.
+func value(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if want, ok := labels[l.GetName()]; ok && want != l.GetValue() {
+					continue metrics
+				}
+			}
+			if m.Counter != nil {
+				return m.Counter.GetValue()
+			}
+			return m.Gauge.GetValue()
+		}
+	}
+	return -1
+}
+
+func TestObserveResult(t *testing.T) {
+	c := zqlsessionprom.NewCollector()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	db, err := sqlitex.NewPool(filepath.Join(t.TempDir(), "sessions.db"), sqlitex.PoolOptions{})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+	store, err := zqlsession.NewE(db, zqlsession.WithAutoMigrate(),
+		zqlsession.WithName("app"), zqlsession.WithObserver(c.Observe))
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	defer store.Shutdown(context.Background())
+
+	if _, _, err := store.Find("token"); err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	conn, err := db.Take(context.Background())
+	if err != nil {
+		t.Fatalf("take: %v", err)
+	}
+	err = sqlitex.ExecuteTransient(conn, "DROP TABLE sessions", nil)
+	db.Put(conn)
+	if err != nil {
+		t.Fatalf("drop table: %v", err)
+	}
+	// The query fails once the connection has been taken.
+	if _, _, err := store.Find("token"); err == nil {
+		t.Fatal("find without a table: got no error")
+	}
+
+	for result, want := range map[string]float64{"ok": 1, "error": 1} {
+		labels := map[string]string{"store": "app", "op": "find", "result": result}
+		if got := value(t, reg, "zqlsession_operations_total", labels); got != want {
+			t.Errorf("find operations with result %q: got %v, want %v", result, got, want)
+		}
+	}
+}
+
+func TestCollectWatched(t *testing.T) {
+	c := zqlsessionprom.NewCollector()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+
+	store := zqlsessiontest.NewMemoryStore(t,
+		zqlsession.WithName("app"), zqlsession.WithObserver(c.Observe))
+	c.Watch(store)
+
+	expiry := time.Now().Add(time.Hour)
+	for _, token := range []string{"token1", "token2"} {
+		if err := store.Commit(token, []byte("data"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+	}
+	for _, token := range []string{"token1", "missing"} {
+		if _, _, err := store.Find(token); err != nil {
+			t.Fatalf("find: %v", err)
+		}
+	}
+
+	app := map[string]string{"store": "app"}
+	for name, want := range map[string]float64{
+		"zqlsession_sessions":               2,
+		"zqlsession_finds_total":            2,
+		"zqlsession_find_hits_total":        1,
+		"zqlsession_commits_total":          2,
+		"zqlsession_sessions_deleted_total": 0,
+	} {
+		if got := value(t, reg, name, app); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	commits := map[string]string{"store": "app", "op": "commit", "result": "ok"}
+	if got := value(t, reg, "zqlsession_operations_total", commits); got != 2 {
+		t.Errorf("commit operations: got %v, want 2", got)
+	}
+}
@@ -0,0 +1,373 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+
+// Package zqlsessiontest provides helpers for testing code built on
+// zqlsession. It is kept separate so the main package does not import
+// testing.
+package zqlsessiontest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// NewMemoryStore returns a store backed by a new in-memory database, with its
+// table created, for tests of code which uses sessions. The store is created
+// with zqlsession.NewMemory and opts, with a cleanup every 5 minutes as for
+// zqlsession.New. It is shut down, discarding its database, when the test and
+// its subtests complete.
+func NewMemoryStore(t testing.TB, opts ...zqlsession.Option) *zqlsession.SQLitexStore {
+	t.Helper()
+
+	store, err := zqlsession.NewMemory(5*time.Minute, opts...)
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := store.Shutdown(context.Background()); err != nil {
+			t.Errorf("shut down store: %v", err)
+		}
+	})
+	return store
+}
+
+// AssertUsesIndex runs EXPLAIN QUERY PLAN for query against an in-memory
+// database created with zqlsession.Schema and fails t if the plan contains a
+// full table scan. A scan which walks an index, such as for an ORDER BY, is
+// not considered a full table scan.
+func AssertUsesIndex(t testing.TB, query string) {
+	t.Helper()
+
+	var scans []string
+	for _, detail := range explain(t, zqlsession.Schema, query) {
+		if strings.HasPrefix(detail, "SCAN ") && !strings.Contains(detail, " USING ") {
+			scans = append(scans, detail)
+		}
+	}
+	if len(scans) > 0 {
+		t.Errorf("query %q performs a full table scan: %s",
+			query, strings.Join(scans, "; "))
+	}
+}
+
+// AssertIndexOnly is like AssertUsesIndex, but the database also has the
+// index created by zqlsession.SchemaCoveringIndex, and t fails unless every
+// table access in the plan is answered from a covering index without reading
+// table rows.
+func AssertIndexOnly(t testing.TB, query string) {
+	t.Helper()
+
+	var reads []string
+	schema := zqlsession.Schema + "\n" + zqlsession.SchemaCoveringIndex
+	for _, detail := range explain(t, schema, query) {
+		if (strings.HasPrefix(detail, "SCAN ") || strings.HasPrefix(detail, "SEARCH ")) &&
+			!strings.Contains(detail, " USING COVERING INDEX ") {
+			reads = append(reads, detail)
+		}
+	}
+	if len(reads) > 0 {
+		t.Errorf("query %q reads table rows: %s",
+			query, strings.Join(reads, "; "))
+	}
+}
+
+// explain returns the detail of each step of query's plan against an
+// in-memory database created with schema.
+func explain(t testing.TB, schema, query string) []string {
+	t.Helper()
+
+	conn, err := sqlite.OpenConn(":memory:")
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	defer conn.Close()
+
+	if err := sqlitex.ExecuteScript(conn, schema, nil); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+
+	// The statement is stepped directly rather than through sqlitex so the
+	// query's parameters may be left unbound.
+	stmt, _, err := conn.PrepareTransient("EXPLAIN QUERY PLAN " + query)
+	if err != nil {
+		t.Fatalf("explain %q: %v", query, err)
+	}
+	defer stmt.Finalize()
+
+	var details []string
+	for {
+		row, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("explain %q: %v", query, err)
+		}
+		if !row {
+			return details
+		}
+		details = append(details, stmt.GetText("detail"))
+	}
+}
+
+// FuzzCommitFind fuzzes store with arbitrary tokens and data, failing if
+// committed data does not round trip through Find byte for byte. Committed
+// empty data must be found as an empty, non-nil slice, and tokens which are
+// empty or too long must be rejected. It is intended to be called from a fuzz
+// test in your own package, against a store configured the way your
+// application uses it:
+//
+//	func FuzzStore(f *testing.F) {
+//		zqlsessiontest.FuzzCommitFind(f, newConfiguredStore(f))
+//	}
+func FuzzCommitFind(f *testing.F, store *zqlsession.SQLitexStore) {
+	f.Add("token", []byte("data"))
+	f.Add("token", []byte{})
+	f.Add("", []byte("data"))
+	f.Add("\x00\xff", []byte{0, 0xff, 0xfe, 0})
+	f.Add("ünïcødé", []byte("\x00invalid \xc3\x28 utf-8"))
+
+	f.Fuzz(func(t *testing.T, token string, data []byte) {
+		expiry := time.Now().Add(time.Hour)
+		if token == "" {
+			err := store.Commit(token, data, expiry)
+			if !errors.Is(err, zqlsession.ErrEmptyToken) {
+				t.Fatalf("commit empty token: got %v, want ErrEmptyToken", err)
+			}
+			return
+		}
+		if max := store.Config().MaxTokenLength; max > 0 && len(token) > max {
+			err := store.Commit(token, data, expiry)
+			if !errors.Is(err, zqlsession.ErrTokenTooLong) {
+				t.Fatalf("commit long token: got %v, want ErrTokenTooLong", err)
+			}
+			return
+		}
+		if err := store.Commit(token, data, expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+		got, found, err := store.Find(token)
+		if err != nil {
+			t.Fatalf("find %q: %v", token, err)
+		}
+		if !found {
+			t.Fatalf("find %q: not found", token)
+		}
+		if got == nil {
+			t.Fatalf("find %q: got nil data", token)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("find %q: got %q, want %q", token, got, data)
+		}
+	})
+}
+
+// RunConformance runs a suite of subtests against store which checks that it
+// honours the session store contract through its public API: commits round
+// trip through Find, commits overwrite, deletes and expiry hide sessions, All
+// returns exactly the active sessions, concurrent use is safe and
+// DeleteExpired removes expired sessions. It is intended for checking a store
+// configured the way your application uses it, such as with a custom table
+// name:
+//
+//	func TestStore(t *testing.T) {
+//		zqlsessiontest.RunConformance(t, newConfiguredStore(t))
+//	}
+//
+// The store must be writable and its table must already exist. Sessions are
+// created with tokens from store.NewToken and are deleted afterwards, so the
+// suite may be run against a table which holds other sessions, although All is
+// only checked for the suite's own sessions.
+func RunConformance(t *testing.T, store *zqlsession.SQLitexStore) {
+	ctx := context.Background()
+	expiry := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	newToken := func(t *testing.T) string {
+		t.Helper()
+
+		token, err := store.NewToken()
+		if err != nil {
+			t.Fatalf("new token: %v", err)
+		}
+		t.Cleanup(func() {
+			store.Delete(token)
+		})
+		return token
+	}
+	commit := func(t *testing.T, token string, data []byte, expiry time.Time) {
+		t.Helper()
+
+		if err := store.Commit(token, data, expiry); err != nil {
+			t.Fatalf("commit %q: %v", token, err)
+		}
+	}
+	// Commits with a past expiry are rejected by default, see
+	// zqlsession.WithPastExpiry, so expired sessions are imported instead.
+	commitExpired := func(t *testing.T, token string, data []byte) {
+		t.Helper()
+
+		sessions := []zqlsession.SessionRecord{{
+			Token:  token,
+			Data:   data,
+			Expiry: past,
+		}}
+		if err := store.Import(ctx, sessions, zqlsession.Decoded); err != nil {
+			t.Fatalf("import expired %q: %v", token, err)
+		}
+	}
+	find := func(t *testing.T, token string) ([]byte, bool) {
+		t.Helper()
+
+		data, found, err := store.Find(token)
+		if err != nil {
+			t.Fatalf("find %q: %v", token, err)
+		}
+		return data, found
+	}
+	flush := func(t *testing.T) {
+		t.Helper()
+
+		if err := store.Flush(ctx); err != nil {
+			t.Fatalf("flush: %v", err)
+		}
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		token := newToken(t)
+		data := []byte("\x00round trip \xff")
+		commit(t, token, data, expiry)
+		got, found := find(t, token)
+		if !found {
+			t.Fatalf("find %q: not found", token)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("find %q: got %q, want %q", token, got, data)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		token := newToken(t)
+		commit(t, token, []byte("first"), expiry)
+		commit(t, token, []byte("second"), expiry)
+		got, found := find(t, token)
+		if !found || string(got) != "second" {
+			t.Fatalf("find %q: got %q, %v, want %q", token, got, found, "second")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		token := newToken(t)
+		commit(t, token, []byte("data"), expiry)
+		if err := store.Delete(token); err != nil {
+			t.Fatalf("delete %q: %v", token, err)
+		}
+		if _, found := find(t, token); found {
+			t.Fatalf("find %q: found after delete", token)
+		}
+		if err := store.Delete(token); err != nil {
+			t.Fatalf("delete %q again: %v", token, err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		token := newToken(t)
+		commitExpired(t, token, []byte("data"))
+		if _, found := find(t, token); found {
+			t.Fatalf("find %q: found expired session", token)
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		active := newToken(t)
+		expired := newToken(t)
+		commit(t, active, []byte("active "+active), expiry)
+		commitExpired(t, expired, []byte("expired "+expired))
+		flush(t)
+
+		all, err := store.All()
+		if err != nil {
+			t.Fatalf("all: %v", err)
+		}
+		// All returns normalized tokens, so sessions are recognised
+		// by their data.
+		var foundActive bool
+		for _, data := range all {
+			switch string(data) {
+			case "active " + active:
+				foundActive = true
+			case "expired " + expired:
+				t.Errorf("all: includes expired session %q", expired)
+			}
+		}
+		if !foundActive {
+			t.Errorf("all: missing active session %q", active)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const workers, commits = 8, 20
+		tokens := make([]string, workers*commits)
+		for i := range tokens {
+			tokens[i] = newToken(t)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, len(tokens))
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(tokens []string) {
+				defer wg.Done()
+				for _, token := range tokens {
+					if err := store.Commit(token, []byte(token), expiry); err != nil {
+						errs <- err
+						return
+					}
+					got, found, err := store.Find(token)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !found || string(got) != token {
+						errs <- fmt.Errorf("find %q: got %q, %v", token, got, found)
+						return
+					}
+				}
+			}(tokens[w*commits : (w+1)*commits])
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+
+	t.Run("DeleteExpired", func(t *testing.T) {
+		active := newToken(t)
+		expired := newToken(t)
+		commit(t, active, []byte("data"), expiry)
+		commitExpired(t, expired, []byte("data"))
+		flush(t)
+
+		n, err := store.DeleteExpired(ctx)
+		if err != nil {
+			t.Fatalf("delete expired: %v", err)
+		}
+		if n < 1 {
+			t.Errorf("delete expired: deleted %d sessions, want at least 1", n)
+		}
+		if _, found, err := store.DumpRow(expired); err != nil || found {
+			t.Errorf("dump %q: got %v, %v, want no row", expired, found, err)
+		}
+		if _, found := find(t, active); !found {
+			t.Errorf("find %q: active session deleted", active)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsessiontest_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.sr.ht/~kota/zqlsession"
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+)
+
+func TestNewMemoryStore(t *testing.T) {
+	var store *zqlsession.SQLitexStore
+	t.Run("Store", func(t *testing.T) {
+		store = zqlsessiontest.NewMemoryStore(t)
+		other := zqlsessiontest.NewMemoryStore(t, zqlsession.WithTableName("other"))
+
+		expiry := time.Now().Add(time.Hour)
+		if err := store.Commit("token", []byte("data"), expiry); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+		if err := other.Commit("other", []byte("data"), expiry); err != nil {
+			t.Fatalf("commit with options: %v", err)
+		}
+		if _, found, _ := other.Find("token"); found {
+			t.Error("separate stores share sessions")
+		}
+		if got, _, err := store.Find("token"); err != nil || string(got) != "data" {
+			t.Errorf("find: got %q, %v, want %q", got, err, "data")
+		}
+	})
+	// The store is shut down once the test which created it completes.
+	if _, _, err := store.Find("token"); !errors.Is(err, zqlsession.ErrClosed) {
+		t.Errorf("find after the test: got %v, want ErrClosed", err)
+	}
+}
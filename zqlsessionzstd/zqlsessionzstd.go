@@ -0,0 +1,102 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+
+// Package zqlsessionzstd provides a zqlsession.Codec which compresses session
+// data with zstd, optionally using a shared dictionary. It is a module of its
+// own so the main module does not depend on a zstd implementation.
+package zqlsessionzstd
+
+import (
+	"bytes"
+	"fmt"
+
+	"git.sr.ht/~kota/zqlsession"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Stored data starts with a version byte saying how it was compressed,
+// followed by a zstd frame.
+const (
+	versionPlain byte = 1
+	versionDict  byte = 2
+)
+
+// frameMagic starts every zstd frame.
+var frameMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Codec compresses session data with zstd. It is safe for concurrent use.
+type Codec struct {
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+	version byte
+}
+
+// New returns a Codec which compresses with dict, a zstd dictionary such as
+// one trained on representative session data with zstd --train. Sessions
+// which are structurally similar, such as those using the same serialization
+// with the same keys, compress far better with a dictionary than alone. A nil
+// dict compresses without a dictionary.
+//
+// Data compressed without a dictionary can always be decoded, but data
+// compressed with a dictionary can only be decoded by a Codec with the same
+// dictionary, so a dictionary must be kept for as long as sessions compressed
+// with it may exist. Data stored before the codec was used is returned
+// unchanged.
+func New(dict []byte) (*Codec, error) {
+	c := &Codec{version: versionPlain}
+	var encOpts []zstd.EOption
+	var decOpts []zstd.DOption
+	if dict != nil {
+		c.version = versionDict
+		encOpts = append(encOpts, zstd.WithEncoderDict(dict))
+		decOpts = append(decOpts, zstd.WithDecoderDicts(dict))
+	}
+
+	var err error
+	c.enc, err = zstd.NewWriter(nil, encOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("zqlsessionzstd: %w", err)
+	}
+	c.dec, err = zstd.NewReader(nil, decOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("zqlsessionzstd: %w", err)
+	}
+	return c, nil
+}
+
+// WithZstdDictionary returns an option which compresses session data with a
+// Codec using dict, see New. It panics if dict is not a valid dictionary.
+func WithZstdDictionary(dict []byte) zqlsession.Option {
+	c, err := New(dict)
+	if err != nil {
+		panic(err)
+	}
+	return zqlsession.WithCodec(c)
+}
+
+// Encode compresses data, prefixed with the version byte. Empty data is stored
+// as is.
+func (c *Codec) Encode(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	return c.enc.EncodeAll(data, []byte{c.version}), nil
+}
+
+// Decode decompresses data stored by Encode, choosing how by its version
+// byte. Data which does not start with a known version byte and a zstd frame
+// was stored without the codec, and is returned unchanged.
+func (c *Codec) Decode(b []byte) ([]byte, error) {
+	if len(b) <= len(frameMagic) || !bytes.HasPrefix(b[1:], frameMagic) {
+		return b, nil
+	}
+	switch b[0] {
+	case versionPlain, versionDict:
+		data, err := c.dec.DecodeAll(b[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("zqlsessionzstd: %w", err)
+		}
+		return data, nil
+	}
+	return b, nil
+}
@@ -0,0 +1,124 @@
+// License: LGPL-3.0-only
+// (c) 2024 Dakota Walsh <kota@nilsu.org>
+package zqlsessionzstd_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"git.sr.ht/~kota/zqlsession/zqlsessiontest"
+	"git.sr.ht/~kota/zqlsession/zqlsessionzstd"
+	"github.com/klauspost/compress/zstd"
+)
+
+// sample returns session data shaped like a typical serialized session, which
+// differ only in their values.
+func sample(i int) []byte {
+	return []byte(fmt.Sprintf(`{"deadline":"2024-06-01T12:%02d:00Z",`+
+		`"values":{"user_id":%d,"csrf_token":"%032x","flash":"",`+
+		`"theme":"dark","locale":"en-NZ","cart_items":%d}}`,
+		i%60, 1000+i, i*7919, i%5))
+}
+
+// newDict trains a dictionary on sample session data.
+func newDict(t testing.TB) []byte {
+	t.Helper()
+
+	var contents [][]byte
+	var history []byte
+	for i := 0; i < 200; i++ {
+		contents = append(contents, sample(i))
+		if i < 20 {
+			history = append(history, sample(i)...)
+		}
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+	})
+	if err != nil {
+		t.Fatalf("build dictionary: %v", err)
+	}
+	return dict
+}
+
+func newCodec(t testing.TB, dict []byte) *zqlsessionzstd.Codec {
+	t.Helper()
+
+	c, err := zqlsessionzstd.New(dict)
+	if err != nil {
+		t.Fatalf("new codec: %v", err)
+	}
+	return c
+}
+
+func TestConformance(t *testing.T) {
+	zqlsessiontest.RunConformance(t, zqlsessiontest.NewMemoryStore(t,
+		zqlsessionzstd.WithZstdDictionary(newDict(t))))
+}
+
+func TestDecode(t *testing.T) {
+	plain := newCodec(t, nil)
+	dict := newCodec(t, newDict(t))
+	data := sample(1000)
+
+	// A codec with a dictionary still decodes data compressed without
+	// one, and any codec returns data stored without a codec unchanged.
+	b, err := plain.Encode(data)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	for name, c := range map[string]*zqlsessionzstd.Codec{"Plain": plain, "Dict": dict} {
+		got, err := c.Decode(b)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: decode plain: got %q, %v, want %q", name, got, err, data)
+		}
+		got, err = c.Decode(data)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: decode uncompressed: got %q, %v, want %q", name, got, err, data)
+		}
+	}
+
+	b, err = dict.Encode(data)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if got, err := dict.Decode(b); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decode dictionary: got %q, %v, want %q", got, err, data)
+	}
+	if _, err := plain.Decode(b); err == nil {
+		t.Error("decode dictionary without it: got nil, want an error")
+	}
+}
+
+// BenchmarkEncode compares compressing sample session data with and without
+// a dictionary, reporting the ratio of stored to original size.
+func BenchmarkEncode(b *testing.B) {
+	dict := newDict(b)
+	for _, bb := range []struct {
+		name string
+		dict []byte
+	}{
+		{"NoDictionary", nil},
+		{"Dictionary", dict},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			c := newCodec(b, bb.dict)
+			var original, stored int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data := sample(i)
+				enc, err := c.Encode(data)
+				if err != nil {
+					b.Fatalf("encode: %v", err)
+				}
+				original += len(data)
+				stored += len(enc)
+			}
+			b.ReportMetric(float64(stored)/float64(original), "ratio")
+		})
+	}
+}